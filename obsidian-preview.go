@@ -2,412 +2,6110 @@ package main
 
 import (
 	"bytes"
+	"compress/gzip"
+	"container/list"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
 	"encoding/json"
+	"flag"
 	"fmt"
+	gohtml "html"
 	"html/template"
-	"log"
+	"io"
+	"log/slog"
+	"maps"
+	"math"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"os/exec"
+	"path"
 	"path/filepath"
+	"reflect"
+	"regexp"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
+	"github.com/BurntSushi/toml"
+	chromahtml "github.com/alecthomas/chroma/v2/formatters/html"
+	"github.com/alecthomas/chroma/v2/styles"
 	"github.com/fsnotify/fsnotify"
+	"github.com/microcosm-cc/bluemonday"
 	"github.com/yuin/goldmark"
+	emoji "github.com/yuin/goldmark-emoji"
+	highlighting "github.com/yuin/goldmark-highlighting/v2"
+	"github.com/yuin/goldmark/ast"
 	"github.com/yuin/goldmark/extension"
 	"github.com/yuin/goldmark/parser"
+	"github.com/yuin/goldmark/renderer"
 	"github.com/yuin/goldmark/renderer/html"
+	"github.com/yuin/goldmark/text"
+	"github.com/yuin/goldmark/util"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/simplifiedchinese"
+	textunicode "golang.org/x/text/encoding/unicode"
+	"gopkg.in/yaml.v3"
 )
 
 type FileNode struct {
-	Name     string      `json:"name"`
-	Path     string      `json:"path"`
-	IsDir    bool        `json:"isDir"`
-	Children []*FileNode `json:"children,omitempty"`
+	Name       string      `json:"name"`
+	Path       string      `json:"path"`
+	IsDir      bool        `json:"isDir"`
+	Count      int         `json:"count,omitempty"`      // 目录下（递归）的 markdown 文件数
+	FolderNote string      `json:"folderNote,omitempty"` // 目录对应的文件夹笔记
+	Aliases    []string    `json:"aliases,omitempty"`    // frontmatter 中声明的别名
+	Tags       []string    `json:"tags,omitempty"`       // frontmatter 和正文中的标签，不含 #
+	Words      int         `json:"words,omitempty"`      // 字数，目录为其中（不含索引类笔记）的总字数
+	Index      bool        `json:"index,omitempty"`      // 索引类笔记（--index-marker），不参与全文搜索和字数统计
+	Order      int         `json:"order,omitempty"`      // 在所在目录 .order 文件中的位置，从 1 开始，未列出为 0
+	Type       string      `json:"type,omitempty"`       // frontmatter 中的 type 属性，文件树中按 --note-types 显示颜色
+	Weight     *float64    `json:"weight,omitempty"`     // --sort frontmatter:字段 指定的排序值，目录取其文件夹笔记的值
+	Size       int64       `json:"size"`
+	ModTime    time.Time   `json:"modTime"`
+	Children   []*FileNode `json:"children,omitempty"`
+}
+
+// 单个文件的渲染结果及元数据
+type RenderedFile struct {
+	HTML    string    `json:"html"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modTime"`
+	Error   string    `json:"error,omitempty"`
 }
 
 var mdFiles []string
+
+// 最近一次生成页面时各笔记的渲染结果，供 /api/note 返回（由 mu 保护）
+var renderedNotes map[string]*RenderedFile
+var assetFiles []string
 var fileTree *FileNode
 var rootDir string
 var mu sync.RWMutex
 
-func main() {
-	if len(os.Args) > 1 && (os.Args[1] == "-h" || os.Args[1] == "--help") {
-		fmt.Println("用法: obsidian-preview")
-		fmt.Println("启动 HTTP 服务器在 9099 端口，自动监听文件变化")
-		os.Exit(0)
-	}
+// 初始扫描和生成是否完成（由 mu 保护）
+var ready bool
+var startTime = time.Now()
+
+// 链接解析索引：大小写折叠后的名称/路径 -> 磁盘上的实际路径
+var noteIndex map[string]string
+var assetIndex map[string]string
+var folderIndex map[string]string
+
+// 笔记路径 -> frontmatter 中声明的别名
+var noteAliases map[string][]string
+
+// 可以通过 ![[...]] 嵌入或被图片路径解析匹配的附件扩展名
+var imageExtensions = map[string]bool{
+	".png":  true,
+	".jpg":  true,
+	".jpeg": true,
+	".gif":  true,
+	".svg":  true,
+	".webp": true,
+	".bmp":  true,
+}
 
-	rootDir = "."
-	fmt.Printf("正在扫描目录: %s\n", rootDir)
+// 除 markdown 外，变化时也需要刷新预览的资源文件
+func isWatchedAsset(name string) bool {
+	ext := strings.ToLower(filepath.Ext(name))
+	return imageExtensions[ext] || ext == ".css"
+}
 
-	// 初始扫描
-	err := rescanDirectory()
-	if err != nil {
-		log.Fatalf("扫描目录错误: %v\n", err)
+// SSE 客户端，用于通知浏览器刷新
+var sseClients = make(map[chan string]bool)
+var sseMu sync.Mutex
+
+// 配置项，优先级：命令行参数 > 配置文件 > 内置默认值
+type Config struct {
+	Port       int      `yaml:"port"`
+	Host       string   `yaml:"host"`
+	Dir        string   `yaml:"dir"`
+	Ignore     []string `yaml:"ignore"`     // 跳过的目录名
+	Extensions []string `yaml:"extensions"` // 作为笔记处理的扩展名
+	LogJSON    bool     `yaml:"log_json"`   // 以 JSON 格式输出日志
+	Mermaid    string   `yaml:"mermaid"`    // Mermaid 渲染方式：client、server 或 none
+	Theme      string   `yaml:"theme"`      // 默认配色方案
+	MermaidCLI string   `yaml:"mmdc"`       // 服务端渲染使用的 mermaid-cli 可执行文件
+	CodeFold   int      `yaml:"code_fold"`  // 超过该行数的代码块默认折叠，0 表示不折叠
+	OpenNote   string   `yaml:"open_note"`  // 页面首次加载时打开的笔记
+
+	FollowGitignore bool `yaml:"follow_gitignore"` // 跳过 .gitignore 忽略的文件
+	SubSup          bool `yaml:"sub_sup"`          // 渲染 H~2~O 下标和 x^2^ 上标
+	Sanitize        bool `yaml:"sanitize"`         // 按安全策略过滤渲染结果中的 HTML
+
+	IndexFile string `yaml:"index_file"` // 作为首页的笔记，没有打开其他笔记时显示
+	Metrics   bool   `yaml:"metrics"`    // 提供 /metrics 监控接口
+
+	FolderNotes   []string `yaml:"folder_notes"`    // 文件夹笔记的命名规则，{name} 代表文件夹名
+	AttachmentDir string   `yaml:"attachment_dir"`  // 附件文件夹，未设置时读取 .obsidian/app.json
+	TreeState     string   `yaml:"tree_state"`      // 在服务端保存文件树展开状态的文件（相对路径位于用户缓存目录），为空时只在浏览器中保存
+	AllowHTML     bool     `yaml:"allow_html"`      // 渲染笔记中的 HTML，按 HTMLTags 白名单过滤
+	HTMLTags      []string `yaml:"html_tags"`       // 允许的 HTML 标签
+	ShowEmptyDirs bool     `yaml:"show_empty_dirs"` // 在文件树中显示不含笔记的目录
+
+	ExcludePatterns []string `yaml:"exclude_patterns"` // 跳过的文件名通配符，如 *.excalidraw.md
+
+	Poll          time.Duration `yaml:"poll"`           // 轮询检查文件变化的间隔，0 表示使用 fsnotify
+	RenderTimeout time.Duration `yaml:"render_timeout"` // 单个笔记的渲染时间上限，0 表示不限制
+	Highlight     bool          `yaml:"highlight"`      // 在服务端为代码块添加语法高亮
+	IndexMarker   string        `yaml:"index_marker"`   // 标记索引类笔记的 frontmatter 属性，如 type=index
+	BasePath      string        `yaml:"base_path"`      // 通过反向代理部署在子路径下时的路径前缀，如 /preview
+	CSV           bool          `yaml:"csv"`            // 在文件树中显示 .csv/.tsv 文件并渲染为表格
+	VaultName     string        `yaml:"vault_name"`     // obsidian:// 链接中的库名称，默认为笔记库目录名
+	HardWraps     bool          `yaml:"hard_wraps"`     // 段落内的单个换行渲染为 <br>
+	GFM           bool          `yaml:"gfm"`            // 启用 GFM 表格、删除线和任务列表
+	Autolink      bool          `yaml:"autolink"`       // 将正文中的网址和邮箱自动转换为链接
+	Emoji         bool          `yaml:"emoji"`          // 将 :smile: 等短代码渲染为 emoji
+	HeadingIDs    string        `yaml:"heading_ids"`    // 标题 id 的生成方式：goldmark、github 或 obsidian
+	MaxDepth      int           `yaml:"max_depth"`      // 扫描的最大目录深度，根目录下的条目为 1，0 表示不限制
+	HideExtension bool          `yaml:"hide_extension"` // 侧边栏中的笔记名称不显示扩展名
+	Gzip          bool          `yaml:"gzip"`           // 客户端支持时 gzip 压缩页面、接口等文本响应
+	Sort          string        `yaml:"sort"`           // 文件树的默认排序方式：name、modified、size 或 frontmatter:字段
+	AllowEdit     bool          `yaml:"allow_edit"`     // 允许在页面中编辑笔记并写回文件
+	ShowHidden    bool          `yaml:"show_hidden"`    // 扫描和监听以 . 开头的文件和目录
+	Banner        string        `yaml:"banner"`         // 页面顶部的提示横幅，{time} 替换为页面生成时间，为空时不显示
+	HeadingOffset int           `yaml:"heading_offset"` // 跳转到标题时标题与内容区顶部的距离（像素）
+
+	DebounceImmediate bool `yaml:"debounce_immediate"` // 空闲后的第一个变化立即更新，而不是等防抖时间结束
+	ShowVaultName     bool `yaml:"show_vault_name"`    // 在文件树顶部显示笔记库名称
+	InlineCodeLang    bool `yaml:"inline_code_lang"`   // 识别行内代码开头的 js: 等语言前缀，按语言显示颜色
+	CountEmbeds       bool `yaml:"count_embeds"`       // 统计链接和孤立笔记时，嵌入 ![[笔记]] 也算作链接
+	Math              bool `yaml:"math"`               // 渲染 $...$ 和 $$...$$ 数学公式（KaTeX）
+	RenderAPI         bool `yaml:"render_api"`         // 提供 POST /api/render 接口，渲染请求中的 markdown
+
+	NoteTypes    map[string]string `yaml:"note_types"`    // frontmatter type 属性值对应的颜色，如 person: "#e06c75"
+	CalloutIcons map[string]string `yaml:"callout_icons"` // callout 类型对应的图标（emoji 或 <svg>），覆盖内置图标
+
+	OpenBrowserOnChange bool `yaml:"open_browser_on_change"` // 笔记被修改时页面自动打开该笔记（演示模式）
+}
+
+var config = Config{
+	Port:       9099,
+	Dir:        ".",
+	Ignore:     []string{"node_modules", ".git"},
+	Extensions: []string{".md"},
+	Mermaid:    "client",
+	Theme:      "dark",
+	MermaidCLI: "mmdc",
+	CodeFold:   30,
+	HTMLTags:   []string{"details", "summary", "kbd", "sup", "sub", "mark", "abbr", "u", "ins", "s", "small", "span", "div", "br", "figure", "figcaption"},
+
+	RenderTimeout: time.Minute,
+	Highlight:     true,
+	HardWraps:     true,
+	GFM:           true,
+	Autolink:      true,
+	Emoji:         true,
+	Gzip:          true,
+	CountEmbeds:   true,
+	Sort:          "name",
+	HeadingIDs:    "goldmark",
+}
+
+// 内置配色方案，每个字段对应页面样式中的一个 CSS 变量
+type Theme struct {
+	Dark           bool // 深色方案，决定 color-scheme 和 Mermaid 的基础主题
+	Background     string
+	Sidebar        string
+	Header         string
+	Input          string
+	ButtonHover    string
+	ItemHover      string
+	ItemActive     string
+	Scrollbar      string
+	ScrollbarHover string
+	Border         string
+	Text           string
+	TextStrong     string
+	TextMuted      string
+	TextFile       string
+	TextCode       string
+	Accent         string
+	AccentAlt      string
+	Warning        string
+	Danger         string
+	Success        string
+	Chroma         string // 代码高亮使用的 chroma 样式
+}
+
+var themeNames = []string{"dark", "light", "solarized", "nord"}
+
+var themes = map[string]Theme{
+	"dark": {
+		Dark: true, Background: "#1e1e1e", Sidebar: "#252526", Header: "#2d2d30", Input: "#3c3c3c",
+		ButtonHover: "#4c4c4c", ItemHover: "#2a2d2e", ItemActive: "#37373d", Scrollbar: "#424242", ScrollbarHover: "#4e4e4e",
+		Border: "#3e3e42", Text: "#d4d4d4", TextStrong: "#ffffff", TextMuted: "#858585", TextFile: "#9cdcfe", TextCode: "#d7ba7d",
+		Accent: "#007acc", AccentAlt: "#4ec9b0", Warning: "#d7ba7d", Danger: "#f48771", Success: "#89d185",
+		Chroma: "github-dark",
+	},
+	"light": {
+		Background: "#ffffff", Sidebar: "#f3f3f3", Header: "#e8e8e8", Input: "#ffffff",
+		ButtonHover: "#dcdcdc", ItemHover: "#e4e6f1", ItemActive: "#d6ebff", Scrollbar: "#c1c1c1", ScrollbarHover: "#a8a8a8",
+		Border: "#d4d4d4", Text: "#333333", TextStrong: "#000000", TextMuted: "#6e6e6e", TextFile: "#0451a5", TextCode: "#a31515",
+		Accent: "#007acc", AccentAlt: "#16825d", Warning: "#bf8803", Danger: "#d13438", Success: "#388a34",
+		Chroma: "github",
+	},
+	"solarized": {
+		Dark: true, Background: "#002b36", Sidebar: "#073642", Header: "#0b3c49", Input: "#0f4654",
+		ButtonHover: "#155566", ItemHover: "#0b3c49", ItemActive: "#184f5d", Scrollbar: "#2d5a66", ScrollbarHover: "#3d6b77",
+		Border: "#1f4e5a", Text: "#93a1a1", TextStrong: "#fdf6e3", TextMuted: "#657b83", TextFile: "#839496", TextCode: "#cb4b16",
+		Accent: "#268bd2", AccentAlt: "#2aa198", Warning: "#b58900", Danger: "#dc322f", Success: "#859900",
+		Chroma: "solarized-dark",
+	},
+	"nord": {
+		Dark: true, Background: "#2e3440", Sidebar: "#3b4252", Header: "#434c5e", Input: "#434c5e",
+		ButtonHover: "#4c566a", ItemHover: "#434c5e", ItemActive: "#4c566a", Scrollbar: "#4c566a", ScrollbarHover: "#5e6a82",
+		Border: "#4c566a", Text: "#d8dee9", TextStrong: "#eceff4", TextMuted: "#8892a6", TextFile: "#81a1c1", TextCode: "#ebcb8b",
+		Accent: "#5e81ac", AccentAlt: "#8fbcbb", Warning: "#ebcb8b", Danger: "#bf616a", Success: "#a3be8c",
+		Chroma: "nord",
+	},
+}
+
+// 生成所有配色方案的 CSS 变量，按 <html> 的 data-theme 属性生效
+func themeCSS() string {
+	var b strings.Builder
+	for _, name := range themeNames {
+		t := themes[name]
+		scheme := "light"
+		if t.Dark {
+			scheme = "dark"
+		}
+		fmt.Fprintf(&b, "        :root[data-theme=%q] {\n            color-scheme: %s;\n", name, scheme)
+		for _, v := range [][2]string{
+			{"bg", t.Background}, {"bg-sidebar", t.Sidebar}, {"bg-header", t.Header}, {"bg-input", t.Input},
+			{"bg-button-hover", t.ButtonHover}, {"bg-item-hover", t.ItemHover}, {"bg-item-active", t.ItemActive},
+			{"scrollbar", t.Scrollbar}, {"scrollbar-hover", t.ScrollbarHover}, {"border", t.Border},
+			{"text", t.Text}, {"text-strong", t.TextStrong}, {"text-muted", t.TextMuted}, {"text-file", t.TextFile},
+			{"text-code", t.TextCode}, {"accent", t.Accent}, {"accent-alt", t.AccentAlt},
+			{"warning", t.Warning}, {"danger", t.Danger}, {"success", t.Success},
+		} {
+			fmt.Fprintf(&b, "            --%s: %s;\n", v[0], v[1])
+		}
+		b.WriteString("        }\n")
+		if config.Highlight {
+			writeChromaCSS(&b, name, t.Chroma)
+		}
 	}
+	return b.String()
+}
 
-	// 生成初始 HTML
-	err = generateHTML("index.html")
-	if err != nil {
-		log.Fatalf("生成 HTML 错误: %v\n", err)
+// 输出配色方案对应的代码高亮样式，规则限定在该方案的 data-theme 下，随配色方案切换
+// 不使用 chroma 的背景色，代码块背景仍跟随页面配色
+func writeChromaCSS(b *strings.Builder, themeName, styleName string) {
+	var css strings.Builder
+	formatter := chromahtml.New(chromahtml.WithClasses(true))
+	if err := formatter.WriteCSS(&css, styles.Get(styleName)); err != nil {
+		slog.Warn("生成代码高亮样式失败", "style", styleName, "error", err)
+		return
+	}
+	for _, line := range strings.Split(css.String(), "\n") {
+		// 每行形如 /* Keyword */ .chroma .k { color: #ff7b72 }
+		if i := strings.Index(line, "*/"); i != -1 {
+			line = line[i+2:]
+		}
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, ".chroma .") {
+			continue
+		}
+		fmt.Fprintf(b, "        :root[data-theme=%q] %s\n", themeName, line)
 	}
+}
 
-	fmt.Printf("找到 %d 个 markdown 文件\n", len(mdFiles))
+// 未指定 --config 时在笔记库目录下查找的配置文件
+var configFileNames = []string{".obsidian-preview.yml", ".obsidian-preview.yaml", ".obsidian-preview.json"}
 
-	// 启动文件监听
-	go watchFiles()
+var dumpJSONFile string
+var dumpJSONPretty bool
 
-	// 启动 HTTP 服务器（简单的静态文件服务）
-	http.Handle("/", http.FileServer(http.Dir(".")))
+// 导出静态站点的目录，设置后生成页面、复制图片并写出 service worker，然后退出
+var exportDir string
 
-	fmt.Printf("HTTP 服务器启动在 http://localhost:9099\n")
-	fmt.Printf("按 Ctrl+C 停止服务器\n")
-	log.Fatal(http.ListenAndServe(":9099", nil))
-}
+// 生成静态站点的目录，设置后每篇笔记输出为单独的 HTML 页面，然后退出
+var siteOutDir string
 
-func rescanDirectory() error {
-	mu.Lock()
-	defer mu.Unlock()
+// 渲染单个笔记到标准输出后退出，附件地址以 renderBase 为前缀（默认为笔记库相对于当前目录的路径）
+var renderFile string
+var renderBase string
 
-	mdFiles = []string{}
-	fileTree = &FileNode{Name: ".", Path: ".", IsDir: true}
-	return scanDirectory(rootDir, fileTree)
-}
+// 链接检查模式：报告无法解析的 wikilink 后退出
+var checkLinks bool
+var checkLinksJSON bool
 
-func scanDirectory(dir string, parent *FileNode) error {
-	entries, err := os.ReadDir(dir)
+// 以 JSON 格式输出合并命令行参数和配置文件后的最终配置，然后退出
+var printConfig bool
+
+// 孤立笔记报告模式：列出既没有链接也没有被链接的笔记后退出
+var listOrphans bool
+
+func main() {
+	loadedConfig, err := parseConfig()
 	if err != nil {
-		return err
+		fatal("配置错误", err)
 	}
 
-	// 排序：目录在前，然后按名称排序
-	sort.Slice(entries, func(i, j int) bool {
-		if entries[i].IsDir() != entries[j].IsDir() {
-			return entries[i].IsDir()
+	setupLogger()
+	if loadedConfig != "" {
+		slog.Info("已加载配置文件", "path", loadedConfig)
+	}
+	if printConfig {
+		data, err := configJSON()
+		if err != nil {
+			fatal("输出配置错误", err)
 		}
-		return entries[i].Name() < entries[j].Name()
-	})
-
-	for _, entry := range entries {
-		name := entry.Name()
+		os.Stdout.Write(data)
+		return
+	}
 
-		// 跳过隐藏文件和目录
-		if strings.HasPrefix(name, ".") && name != "." {
-			continue
+	// 输出文件相对于启动时的工作目录
+	if dumpJSONFile != "" {
+		dumpJSONFile, err = filepath.Abs(dumpJSONFile)
+		if err != nil {
+			fatal("导出路径错误", err)
+		}
+	}
+	if exportDir != "" {
+		exportDir, err = filepath.Abs(exportDir)
+		if err != nil {
+			fatal("导出路径错误", err)
+		}
+	}
+	if siteOutDir != "" {
+		siteOutDir, err = filepath.Abs(siteOutDir)
+		if err != nil {
+			fatal("导出路径错误", err)
+		}
+	}
+	// 要渲染的笔记相对于启动时的工作目录，附件地址默认相对于启动时的工作目录
+	if renderFile != "" {
+		renderFile, err = filepath.Abs(renderFile)
+		if err != nil {
+			fatal("笔记路径错误", err)
 		}
+		if renderBase == "" {
+			vault, err := filepath.Abs(config.Dir)
+			if err != nil {
+				fatal("目录错误", err)
+			}
+			wd, err := os.Getwd()
+			if err != nil {
+				fatal("目录错误", err)
+			}
+			if rel, err := filepath.Rel(wd, vault); err == nil && rel != "." {
+				renderBase = slashPath(rel) + "/"
+			} else if err != nil {
+				renderBase = slashPath(vault) + "/"
+			}
+		}
+	}
 
-		// 跳过 node_modules 等常见目录
-		if entry.IsDir() && (name == "node_modules" || name == ".git") {
-			continue
+	// 相对路径的状态文件放在用户缓存目录中，不写入笔记库
+	if config.TreeState != "" {
+		config.TreeState, err = treeStatePath(config.TreeState)
+		if err != nil {
+			fatal("状态文件路径错误", err)
+		}
+		if err := loadTreeStates(); err != nil {
+			fatal("读取文件树状态错误", err)
 		}
+	}
 
-		path := filepath.Join(dir, name)
-		if dir == "." {
-			path = name
+	// 切换到笔记库目录，之后所有路径都相对于库根目录
+	if config.Dir != "." {
+		if err := os.Chdir(config.Dir); err != nil {
+			fatal("切换目录错误", err)
 		}
+	}
 
-		node := &FileNode{
-			Name:  name,
-			Path:  path,
-			IsDir: entry.IsDir(),
+	rootDir = "."
+
+	// 未指定库名称时使用笔记库目录名，与 Obsidian 中显示的库名称一致
+	if config.VaultName == "" {
+		if wd, err := os.Getwd(); err == nil {
+			config.VaultName = filepath.Base(wd)
 		}
+	}
 
-		if entry.IsDir() {
-			err := scanDirectory(path, node)
-			if err != nil {
-				continue
-			}
-			if len(node.Children) > 0 {
-				parent.Children = append(parent.Children, node)
-			}
-		} else if strings.HasSuffix(strings.ToLower(name), ".md") {
-			mdFiles = append(mdFiles, path)
-			parent.Children = append(parent.Children, node)
+	// 未指定附件文件夹时使用 Obsidian 自身的设置
+	if config.AttachmentDir == "" {
+		loadObsidianAttachmentDir()
+	}
+
+	if checkLinksJSON {
+		checkLinks = true
+	}
+
+	// 先启动 HTTP 服务器，初始扫描完成前 /healthz 返回未就绪（导出和链接检查模式不启动）
+	var serverErr <-chan error
+	if dumpJSONFile == "" && exportDir == "" && siteOutDir == "" && renderFile == "" && !checkLinks && !listOrphans {
+		serverErr, err = startServer()
+		if err != nil {
+			fatal("HTTP 服务器错误", err)
 		}
 	}
 
-	return nil
-}
+	slog.Info("正在扫描目录", "dir", config.Dir)
 
-func watchFiles() {
-	watcher, err := fsnotify.NewWatcher()
+	// 初始扫描
+	err = rescanDirectory()
 	if err != nil {
-		log.Printf("创建文件监听器错误: %v\n", err)
+		fatal("扫描目录错误", err)
+	}
+
+	// 渲染单个笔记到标准输出后直接退出
+	if renderFile != "" {
+		if err := renderToStdout(renderFile, renderBase); err != nil {
+			fatal("渲染笔记错误", err)
+		}
 		return
 	}
-	defer watcher.Close()
 
-	// 递归添加所有目录到监听器
-	err = filepath.Walk(rootDir, func(path string, info os.FileInfo, err error) error {
+	// 链接检查模式：输出报告，存在无效链接时以非零状态退出
+	if checkLinks {
+		broken, err := findBrokenLinks()
 		if err != nil {
-			return nil
+			fatal("检查链接错误", err)
 		}
-		if info.IsDir() {
-			// 跳过隐藏目录
-			if strings.HasPrefix(filepath.Base(path), ".") && filepath.Base(path) != "." {
-				return filepath.SkipDir
-			}
-			// 跳过 node_modules 等
-			if filepath.Base(path) == "node_modules" || filepath.Base(path) == ".git" {
-				return filepath.SkipDir
-			}
-			return watcher.Add(path)
+		if err := reportBrokenLinks(os.Stdout, broken, checkLinksJSON); err != nil {
+			fatal("输出报告错误", err)
+		}
+		slog.Info("链接检查完成", "files", len(mdFiles), "broken", len(broken))
+		if len(broken) > 0 {
+			os.Exit(1)
 		}
-		return nil
-	})
-
-	if err != nil {
-		log.Printf("添加监听路径错误: %v\n", err)
 		return
 	}
 
-	// 防抖：避免频繁更新
-	var debounceTimer *time.Timer
-	debounceDelay := 500 * time.Millisecond
+	// 孤立笔记报告：每行输出一个笔记路径
+	if listOrphans {
+		orphans, err := findOrphans()
+		if err != nil {
+			fatal("查找孤立笔记错误", err)
+		}
+		for _, path := range orphans {
+			fmt.Println(path)
+		}
+		slog.Info("孤立笔记检查完成", "files", len(mdFiles), "orphans", len(orphans))
+		return
+	}
 
-	for {
-		select {
-		case event, ok := <-watcher.Events:
-			if !ok {
-				return
-			}
-			// 只处理 markdown 文件的变化
-			if strings.HasSuffix(strings.ToLower(event.Name), ".md") ||
-				event.Op&fsnotify.Create != 0 ||
-				event.Op&fsnotify.Remove != 0 ||
-				event.Op&fsnotify.Rename != 0 {
-				// 重置防抖定时器
-				if debounceTimer != nil {
-					debounceTimer.Stop()
-				}
-				debounceTimer = time.AfterFunc(debounceDelay, func() {
-					fmt.Printf("检测到文件变化，重新扫描...\n")
-					err := rescanDirectory()
-					if err != nil {
-						log.Printf("重新扫描错误: %v\n", err)
-						return
-					}
-					err = generateHTML("index.html")
-					if err != nil {
-						log.Printf("重新生成 HTML 错误: %v\n", err)
-						return
-					}
-					fmt.Printf("已更新，找到 %d 个 markdown 文件\n", len(mdFiles))
-				})
-			}
-		case err, ok := <-watcher.Errors:
-			if !ok {
-				return
-			}
-			log.Printf("文件监听错误: %v\n", err)
+	// 导出模式：写出 JSON 后直接退出
+	if dumpJSONFile != "" {
+		err = dumpJSON(dumpJSONFile, dumpJSONPretty)
+		if err != nil {
+			fatal("导出 JSON 错误", err)
 		}
+		slog.Info("已导出 JSON", "files", len(mdFiles), "path", dumpJSONFile)
+		return
 	}
-}
 
-// 读取并渲染 markdown 文件
-func renderMarkdownFile(filePath string) (string, error) {
-	content, err := os.ReadFile(filePath)
-	if err != nil {
-		return "", err
+	// 导出静态站点后直接退出
+	if exportDir != "" {
+		err = exportSite(exportDir)
+		if err != nil {
+			fatal("导出站点错误", err)
+		}
+		slog.Info("已导出站点", "files", len(mdFiles), "dir", exportDir)
+		return
 	}
 
-	// 使用 goldmark 渲染 markdown
-	var buf bytes.Buffer
-	md := goldmark.New(
-		goldmark.WithExtensions(extension.GFM),
-		goldmark.WithParserOptions(
-			parser.WithAutoHeadingID(),
-		),
-		goldmark.WithRendererOptions(
-			html.WithHardWraps(),
-			html.WithXHTML(),
-		),
-	)
+	// 生成静态站点后直接退出
+	if siteOutDir != "" {
+		err = buildSite(siteOutDir)
+		if err != nil {
+			fatal("生成静态站点错误", err)
+		}
+		slog.Info("已生成静态站点", "files", len(mdFiles), "dir", siteOutDir)
+		return
+	}
 
-	if err := md.Convert(content, &buf); err != nil {
-		return "", err
+	// 生成初始 HTML
+	err = generateHTML("index.html")
+	if err != nil {
+		fatal("生成 HTML 错误", err)
 	}
 
-	// 处理图片路径
-	htmlContent := fixImagePaths(buf.String(), filePath)
+	mu.Lock()
+	ready = true
+	mu.Unlock()
+	slog.Info("扫描完成", "files", len(mdFiles))
 
-	// 处理 Mermaid 代码块
-	htmlContent = processMermaidBlocks(htmlContent)
+	// 启动文件监听
+	go watchFiles()
 
-	return htmlContent, nil
+	fatal("HTTP 服务器错误", <-serverErr)
 }
 
-// 修复 markdown 中的图片路径
-func fixImagePaths(htmlContent, mdFilePath string) string {
-	// 获取 markdown 文件所在目录（相对于根目录）
-	mdDir := filepath.Dir(mdFilePath)
-	if mdDir == "." {
-		mdDir = ""
+// 注册路由并开始监听，返回服务器退出时的错误
+func startServer() (<-chan error, error) {
+	// 简单的静态文件服务
+	http.Handle("/", countRequests("static", http.HandlerFunc(handleStatic)))
+	http.Handle("/api/raw", countRequests("raw", http.HandlerFunc(handleRaw)))
+	http.Handle("/api/note", countRequests("note", http.HandlerFunc(handleNote)))
+	http.Handle("/events", countRequests("events", http.HandlerFunc(handleEvents)))
+	http.Handle("/healthz", countRequests("healthz", http.HandlerFunc(handleHealthz)))
+	http.Handle("/sitemap", countRequests("sitemap", http.HandlerFunc(handleSitemap)))
+	http.Handle("/api/files.txt", countRequests("files", http.HandlerFunc(handleFilesText)))
+	http.Handle("/stats", countRequests("stats", http.HandlerFunc(handleStats)))
+	if config.Metrics {
+		http.HandleFunc("/metrics", handleMetrics)
+	}
+	if config.TreeState != "" {
+		http.Handle("/api/tree-state", countRequests("tree-state", http.HandlerFunc(handleTreeState)))
+	}
+	if config.RenderAPI {
+		http.Handle("/api/render", countRequests("render", http.HandlerFunc(handleRender)))
+	}
+	if config.AllowEdit {
+		http.Handle("/api/save", countRequests("save", http.HandlerFunc(handleSave)))
 	}
 
-	// 使用更安全的方式处理图片标签
-	var result strings.Builder
-	content := htmlContent
-	processed := 0
-	maxIterations := 1000
+	listener, err := net.Listen("tcp", fmt.Sprintf("%s:%d", config.Host, config.Port))
+	if err != nil {
+		return nil, err
+	}
 
-	for processed < maxIterations {
-		start := strings.Index(content, `<img src="`)
-		if start == -1 {
-			result.WriteString(content)
-			break
-		}
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- http.Serve(listener, withRequestID(withGzip(withBasePath(http.DefaultServeMux))))
+	}()
 
-		result.WriteString(content[:start])
+	host := config.Host
+	if host == "" {
+		host = "localhost"
+	}
+	slog.Info("HTTP 服务器已启动，按 Ctrl+C 停止", "url", fmt.Sprintf("http://%s:%d%s/", host, config.Port, config.BasePath))
+	return serverErr, nil
+}
 
-		start += len(`<img src="`)
-		end := strings.Index(content[start:], `"`)
-		if end == -1 {
-			result.WriteString(content[start-len(`<img src="`):])
-			break
+// 客户端支持时压缩文本类型的响应（--gzip），图片、音视频等已压缩的内容原样返回
+func withGzip(next http.Handler) http.Handler {
+	if !config.Gzip {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead || !acceptsGzip(r.Header.Get("Accept-Encoding")) {
+			next.ServeHTTP(w, r)
+			return
 		}
+		gw := &gzipResponseWriter{ResponseWriter: w}
+		defer gw.Close()
+		next.ServeHTTP(gw, r)
+	})
+}
 
-		imgPath := content[start : start+end]
-		tagEnd := strings.Index(content[start+end:], `>`)
-		if tagEnd == -1 {
-			result.WriteString(content[start-len(`<img src="`):])
-			break
+// Accept-Encoding 中是否包含 gzip（q=0 表示不接受）
+func acceptsGzip(header string) bool {
+	for _, item := range strings.Split(header, ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(item), ";")
+		if strings.EqualFold(strings.TrimSpace(coding), "gzip") {
+			return strings.ReplaceAll(strings.TrimSpace(params), " ", "") != "q=0"
 		}
+	}
+	return false
+}
 
-		originalImgTag := content[start-len(`<img src="`) : start+end+tagEnd+1]
-
-		// 检查是否已经处理过
-		if strings.Contains(originalImgTag, `onclick="openImageModal`) {
-			result.WriteString(originalImgTag)
-			content = content[start+end+tagEnd+1:]
-			continue
-		}
+// 值得压缩的响应类型
+func compressibleType(contentType string) bool {
+	mediaType, _, _ := strings.Cut(contentType, ";")
+	mediaType = strings.TrimSpace(mediaType)
+	// SSE 需要逐条推送，不压缩
+	if mediaType == "text/event-stream" {
+		return false
+	}
+	return strings.HasPrefix(mediaType, "text/") || mediaType == "application/json" ||
+		mediaType == "image/svg+xml" || strings.HasSuffix(mediaType, "+xml") || mediaType == "application/xml"
+}
 
-		// 处理相对路径
-		if !strings.HasPrefix(imgPath, "/") && !strings.HasPrefix(imgPath, "http://") && !strings.HasPrefix(imgPath, "https://") && !strings.HasPrefix(imgPath, "data:") {
-			var fullPath string
-			if strings.HasPrefix(imgPath, "../") || strings.HasPrefix(imgPath, "./") {
-				fullPath = filepath.Join(mdDir, imgPath)
-			} else if mdDir != "" {
-				fullPath = filepath.Join(mdDir, imgPath)
-			} else {
-				fullPath = imgPath
-			}
+// 在写出响应头时根据状态码和 Content-Type 决定是否压缩
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	gz      *gzip.Writer
+	decided bool
+}
 
-			fullPath = filepath.Clean(fullPath)
-			fullPath = strings.ReplaceAll(fullPath, "\\", "/")
-			if strings.HasPrefix(fullPath, "/") {
-				fullPath = fullPath[1:]
+func (g *gzipResponseWriter) WriteHeader(status int) {
+	if !g.decided {
+		g.decided = true
+		h := g.Header()
+		if compressibleType(h.Get("Content-Type")) {
+			h.Add("Vary", "Accept-Encoding")
+			// 范围请求的部分内容和已编码的内容不压缩
+			if status == http.StatusOK && h.Get("Content-Encoding") == "" && h.Get("Content-Range") == "" {
+				h.Del("Content-Length")
+				h.Set("Content-Encoding", "gzip")
+				g.gz = gzip.NewWriter(g.ResponseWriter)
 			}
-
-			// 转换为相对路径（用于静态文件服务）
-			newTag := strings.Replace(originalImgTag, `src="`+imgPath+`"`, `src="`+fullPath+`" class="preview-image" onclick="openImageModal(this.src)"`, 1)
-			result.WriteString(newTag)
-		} else {
-			beforeClose := originalImgTag[:len(originalImgTag)-1]
-			newTag := beforeClose + ` class="preview-image" onclick="openImageModal(this.src)">`
-			result.WriteString(newTag)
 		}
-
-		content = content[start+end+tagEnd+1:]
-		processed++
 	}
+	g.ResponseWriter.WriteHeader(status)
+}
 
-	if processed >= maxIterations {
-		return htmlContent
+func (g *gzipResponseWriter) Write(b []byte) (int, error) {
+	if !g.decided {
+		if g.Header().Get("Content-Type") == "" {
+			g.Header().Set("Content-Type", http.DetectContentType(b))
+		}
+		g.WriteHeader(http.StatusOK)
+	}
+	if g.gz != nil {
+		return g.gz.Write(b)
+	}
+	return g.ResponseWriter.Write(b)
+}
+
+func (g *gzipResponseWriter) Flush() {
+	if g.gz != nil {
+		g.gz.Flush()
+	}
+	if flusher, ok := g.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (g *gzipResponseWriter) Unwrap() http.ResponseWriter {
+	return g.ResponseWriter
+}
+
+func (g *gzipResponseWriter) Close() {
+	if g.gz != nil {
+		g.gz.Close()
+	}
+}
+
+type requestIDKey struct{}
+
+// 沿用反向代理传入的请求 ID
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// 为每个请求分配 ID，通过 X-Request-Id 响应头返回，并记录在接口错误的日志和响应中，便于对照
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-Id")
+		if !requestIDPattern.MatchString(id) {
+			id = newRequestID()
+		}
+		w.Header().Set("X-Request-Id", id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	})
+}
+
+// 生成请求 ID 的随机数来源，测试中替换以模拟读取失败
+var randomBytes = rand.Read
+
+var (
+	requestIDCounter  atomic.Uint64
+	requestIDFailOnce sync.Once
+)
+
+// 随机生成 16 位十六进制的请求 ID；系统随机数不可用时改用当前时间和进程内递增的序号，
+// 仍然不会重复，失败只记录一次日志
+func newRequestID() string {
+	b := make([]byte, 8)
+	if _, err := randomBytes(b); err != nil {
+		requestIDFailOnce.Do(func() {
+			slog.Warn("生成随机请求 ID 失败，改用时间和序号", "error", err)
+		})
+		return fmt.Sprintf("%x-%d", time.Now().UnixNano(), requestIDCounter.Add(1))
+	}
+	return hex.EncodeToString(b)
+}
+
+// 接口的错误响应：{"error": 说明, "code": HTTP 状态码, "requestId": 请求 ID}
+// 服务端错误记录为 error 日志，其他记录为 info，日志中带有请求 ID
+func writeJSONError(w http.ResponseWriter, r *http.Request, code int, message string) {
+	id, _ := r.Context().Value(requestIDKey{}).(string)
+	log := slog.Info
+	if code >= http.StatusInternalServerError {
+		log = slog.Error
+	}
+	log("接口请求失败", "request_id", id, "method", r.Method, "url", r.URL.RequestURI(), "code", code, "error", message)
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(struct {
+		Error     string `json:"error"`
+		Code      int    `json:"code"`
+		RequestID string `json:"requestId,omitempty"`
+	}{message, code, id})
+}
+
+// 设置了 --base-path 时去掉请求路径中的前缀再交给路由，前缀之外的路径返回 404
+// 访问不带结尾 / 的前缀时重定向，保证页面中的相对路径正确
+func withBasePath(next http.Handler) http.Handler {
+	if config.BasePath == "" {
+		return next
+	}
+	stripped := http.StripPrefix(config.BasePath, next)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == config.BasePath:
+			http.Redirect(w, r, config.BasePath+"/", http.StatusMovedPermanently)
+		case strings.HasPrefix(r.URL.Path, config.BasePath+"/"):
+			stripped.ServeHTTP(w, r)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+}
+
+// 从 .obsidian/app.json 读取 Obsidian 的附件文件夹设置，文件不存在或无法解析时忽略
+func loadObsidianAttachmentDir() {
+	data, err := os.ReadFile(filepath.Join(".obsidian", "app.json"))
+	if err != nil {
+		return
+	}
+	var app struct {
+		AttachmentFolderPath string `json:"attachmentFolderPath"`
+	}
+	if err := json.Unmarshal(data, &app); err != nil {
+		slog.Warn("无法解析 Obsidian 配置", "path", ".obsidian/app.json", "error", err)
+		return
+	}
+	if app.AttachmentFolderPath != "" {
+		config.AttachmentDir = app.AttachmentFolderPath
+		slog.Info("使用 Obsidian 的附件文件夹设置", "attachment_dir", config.AttachmentDir)
+	}
+}
+
+// 根据配置初始化全局日志
+func setupLogger() {
+	var handler slog.Handler
+	if config.LogJSON {
+		handler = slog.NewJSONHandler(os.Stderr, nil)
+	} else {
+		handler = slog.NewTextHandler(os.Stderr, nil)
+	}
+	slog.SetDefault(slog.New(handler))
+}
+
+// 记录错误并退出
+func fatal(msg string, err error) {
+	slog.Error(msg, "error", err)
+	os.Exit(1)
+}
+
+// 解析命令行参数并合并配置文件，返回加载的配置文件路径
+func parseConfig() (string, error) {
+	flag.Usage = func() {
+		out := flag.CommandLine.Output()
+		fmt.Fprintln(out, "用法: obsidian-preview [选项]")
+		fmt.Fprintln(out, "启动 HTTP 服务器（默认 9099 端口），自动监听文件变化")
+		fmt.Fprintln(out)
+		fmt.Fprintln(out, "选项:")
+		flag.PrintDefaults()
+	}
+
+	var flags Config
+	var ignore, extensions, folderNotes, htmlTags, noteTypes, calloutIcons string
+	var excludePatterns stringList
+	configFile := flag.String("config", "", "配置文件路径，默认读取笔记库目录下的 .obsidian-preview.yml")
+	flag.IntVar(&flags.Port, "port", config.Port, "HTTP 服务端口")
+	flag.StringVar(&flags.Host, "host", config.Host, "HTTP 监听地址，默认监听所有地址")
+	flag.StringVar(&flags.Dir, "dir", config.Dir, "笔记库目录")
+	flag.StringVar(&ignore, "ignore", strings.Join(config.Ignore, ","), "跳过的目录名，逗号分隔")
+	flag.Var(&excludePatterns, "exclude-pattern", "跳过文件名匹配该通配符的文件（如 *.excalidraw.md 或 Untitled*.md），只匹配文件名，可以多次指定")
+	flag.StringVar(&extensions, "ext", strings.Join(config.Extensions, ","), "作为笔记处理的扩展名，逗号分隔")
+	flag.StringVar(&dumpJSONFile, "dump-json", "", "将文件树和渲染结果导出为 JSON 文件后退出")
+	flag.BoolVar(&dumpJSONPretty, "pretty", false, "导出 JSON 时使用缩进格式")
+	flag.StringVar(&exportDir, "export", "", "将预览页面和图片导出到目录后退出，导出的页面带有 service worker，可离线浏览")
+	flag.StringVar(&renderFile, "render", "", "渲染指定的笔记，将 HTML 写到标准输出后退出，便于在脚本中使用")
+	flag.StringVar(&renderBase, "base", "", "--render 输出中图片等附件地址的前缀，默认为笔记库相对于当前目录的路径，例如 https://example.com/notes/")
+	flag.StringVar(&siteOutDir, "site-out", "", "将每篇笔记渲染为单独的 HTML 页面（保持目录结构）并生成索引页 index.html 后退出，适合部署到静态托管")
+	flag.BoolVar(&checkLinks, "check-links", false, "检查所有笔记中的 wikilink，报告无法解析的链接后退出")
+	flag.BoolVar(&printConfig, "print-config", false, "以 JSON 格式输出合并配置文件和命令行参数后的最终配置后退出，键名与配置文件相同")
+	flag.BoolVar(&checkLinksJSON, "check-links-json", false, "同 --check-links，以 JSON 格式输出报告")
+	flag.BoolVar(&listOrphans, "orphans", false, "列出既没有链接到其他笔记、也没有被其他笔记链接的孤立笔记后退出")
+	flag.BoolVar(&flags.LogJSON, "log-json", config.LogJSON, "以 JSON 格式输出日志")
+	flag.StringVar(&flags.Mermaid, "mermaid", config.Mermaid, "Mermaid 渲染方式：client（浏览器）、server（使用 mmdc 渲染为 SVG）或 none（不处理，显示为代码块）")
+	noMermaid := flag.Bool("no-mermaid", false, "不处理 Mermaid 图表，也不加载 CDN 上的 Mermaid 脚本，图表代码显示为普通代码块，同 --mermaid none")
+	flag.StringVar(&flags.Theme, "theme", config.Theme, "默认配色方案："+strings.Join(themeNames, "、"))
+	flag.StringVar(&flags.MermaidCLI, "mmdc", config.MermaidCLI, "mermaid-cli 可执行文件路径")
+	flag.IntVar(&flags.CodeFold, "code-fold", config.CodeFold, "超过该行数的代码块默认折叠，0 表示不折叠")
+	flag.StringVar(&flags.OpenNote, "open-note", config.OpenNote, "页面首次加载时打开的笔记（路径或笔记名）")
+	flag.BoolVar(&flags.FollowGitignore, "follow-gitignore", config.FollowGitignore, "跳过 .gitignore（包括子目录中的）忽略的文件和目录")
+	flag.BoolVar(&flags.SubSup, "sub-sup", config.SubSup, "渲染 H~2~O 下标和 x^2^ 上标（Pandoc 风格）")
+	flag.BoolVar(&flags.Sanitize, "sanitize", config.Sanitize, "按安全策略过滤笔记渲染出的 HTML，移除脚本和事件属性")
+	flag.StringVar(&flags.IndexFile, "index-file", config.IndexFile, "作为首页的笔记，例如 README.md 或 Home.md")
+	flag.BoolVar(&flags.Metrics, "metrics", config.Metrics, "提供 Prometheus 格式的 /metrics 监控接口")
+	flag.StringVar(&flags.AttachmentDir, "attachment-dir", config.AttachmentDir, "附件文件夹（同 Obsidian 的 attachmentFolderPath，./ 开头表示相对于笔记），默认读取 .obsidian/app.json")
+	flag.StringVar(&flags.TreeState, "tree-state", config.TreeState, "在服务端保存每个浏览器会话的文件树展开状态的 JSON 文件，相对路径位于用户缓存目录（默认不启用）")
+	flag.BoolVar(&flags.AllowHTML, "allow-html", config.AllowHTML, "渲染笔记中的 HTML 标签，按 --html-tags 白名单过滤，脚本等标签会被移除")
+	flag.StringVar(&htmlTags, "html-tags", strings.Join(config.HTMLTags, ","), "--allow-html 允许的 HTML 标签，逗号分隔")
+	flag.BoolVar(&flags.ShowEmptyDirs, "show-empty-dirs", config.ShowEmptyDirs, "在文件树中显示不含笔记的目录")
+	flag.DurationVar(&flags.Poll, "poll", config.Poll, "按间隔轮询检查文件变化（例如 2s），用于 fsnotify 收不到事件的 NFS/SMB 等网络文件系统，0 表示不轮询")
+	flag.DurationVar(&flags.RenderTimeout, "render-timeout", config.RenderTimeout, "单个笔记的渲染时间上限，超时的笔记显示错误信息，0 表示不限制")
+	flag.BoolVar(&flags.Highlight, "highlight", config.Highlight, "为代码块添加语法高亮，配色随页面配色方案切换")
+	flag.StringVar(&flags.IndexMarker, "index-marker", config.IndexMarker, "标记索引类（MOC、模板）笔记的 frontmatter 属性，格式为 key=value 或 key（值为 true），这些笔记不参与全文搜索和字数统计")
+	flag.StringVar(&flags.BasePath, "base-path", config.BasePath, "部署在反向代理的子路径下时的路径前缀，例如 /preview")
+	flag.BoolVar(&flags.CSV, "csv", config.CSV, "在文件树中显示 .csv 和 .tsv 文件，点击后渲染为表格")
+	flag.StringVar(&flags.VaultName, "vault-name", config.VaultName, "复制 obsidian:// 链接时使用的库名称，默认为笔记库目录名")
+	flag.BoolVar(&flags.HardWraps, "hard-wraps", config.HardWraps, "将段落内的单个换行渲染为换行（与 Obsidian 默认一致），设为 false 时按 CommonMark 合并为一行")
+	flag.BoolVar(&flags.GFM, "gfm", config.GFM, "启用 GFM 表格、删除线和任务列表")
+	flag.BoolVar(&flags.Autolink, "autolink", config.Autolink, "将正文中的网址和邮箱自动转换为链接")
+	flag.BoolVar(&flags.Emoji, "emoji", config.Emoji, "将 :smile: 等 emoji 短代码渲染为 emoji，代码中的内容不处理")
+	flag.StringVar(&flags.HeadingIDs, "heading-ids", config.HeadingIDs, "标题 id（页内锚点）的生成方式：goldmark（默认，只保留 ASCII 字母和数字）、github（与 GitHub 一致，保留中文）或 obsidian（保留标题原文）")
+	flag.StringVar(&noteTypes, "note-types", formatNoteTypes(config.NoteTypes), "按 frontmatter 的 type 属性在文件树中显示彩色圆点，格式为 类型=颜色，逗号分隔，例如 person=#e06c75,project=#61afef")
+	flag.StringVar(&calloutIcons, "callout-icons", "", "callout 类型对应的图标，格式为 类型=图标，逗号分隔，例如 note=📝,bug=🐛；default 为未知类型的图标，图标为空表示不显示")
+	flag.StringVar(&flags.Sort, "sort", config.Sort, "文件树的默认排序方式：name、modified、size，或 frontmatter:字段（如 frontmatter:weight，按 frontmatter 中的数值升序，没有该属性的笔记排在后面）")
+	flag.BoolVar(&flags.AllowEdit, "allow-edit", config.AllowEdit, "允许在页面中编辑笔记的原始 markdown 并保存到文件（POST /api/save），只应在可信的网络中启用")
+	flag.BoolVar(&flags.ShowHidden, "show-hidden", config.ShowHidden, "显示以 . 开头的笔记和文件夹（如 .obsidian 中的笔记），忽略列表中的目录（默认包括 .git）仍然跳过")
+	flag.BoolVar(&flags.DebounceImmediate, "debounce-immediate", config.DebounceImmediate, "空闲后的第一个文件变化立即更新页面，随后 500ms 内的变化合并在窗口结束时再更新一次；默认在变化停止 500ms 后才更新")
+	flag.BoolVar(&flags.ShowVaultName, "show-vault-name", config.ShowVaultName, "在文件树顶部显示笔记库名称（--vault-name，默认为目录名），同时预览多个笔记库时便于区分")
+	flag.BoolVar(&flags.InlineCodeLang, "inline-code-lang", config.InlineCodeLang, "识别行内代码开头的语言前缀（如 js:foo()），去掉前缀并按语言显示不同颜色的标记，只识别常见语言")
+	flag.BoolVar(&flags.CountEmbeds, "count-embeds", config.CountEmbeds, "统计链接（/stats 和 --orphans）时将嵌入 ![[笔记]] 算作链接，设为 false 时只统计普通 wikilink")
+	flag.BoolVar(&flags.Math, "math", config.Math, "渲染 $...$ 行内公式和 $$...$$ 公式块，页面从 CDN 加载 KaTeX 排版；callout、表格和嵌入笔记中的公式同样处理")
+	flag.BoolVar(&flags.RenderAPI, "render-api", config.RenderAPI, "提供 POST /api/render 接口，渲染请求体中的 markdown，供编辑器插件预览未保存的内容；同时进行的渲染数量有限制")
+	flag.StringVar(&flags.Banner, "banner", config.Banner, "在页面顶部显示一行提示横幅，例如 \"只读快照，生成于 {time}\"，{time} 替换为页面生成时间；为空时不显示")
+	flag.IntVar(&flags.HeadingOffset, "heading-offset", config.HeadingOffset, "通过链接或目录跳转到标题时，标题与内容区顶部保留的距离（像素），自定义样式中有固定在顶部的元素时避免遮挡标题")
+	flag.BoolVar(&flags.Gzip, "gzip", config.Gzip, "客户端支持时使用 gzip 压缩页面、接口 JSON 等文本响应，图片等已压缩的文件不压缩")
+	flag.BoolVar(&flags.HideExtension, "hide-extension", config.HideExtension, "侧边栏中的笔记名称不显示 .md 等扩展名（与 Obsidian 一致）")
+	flag.IntVar(&flags.MaxDepth, "max-depth", config.MaxDepth, "扫描的最大深度，根目录下的文件和文件夹为第 1 层，更深的内容不显示也不监听，0 表示不限制")
+	flag.BoolVar(&flags.OpenBrowserOnChange, "open-browser-on-change", config.OpenBrowserOnChange, "演示模式：笔记被修改时，已打开的页面自动切换到该笔记")
+	flag.StringVar(&folderNotes, "folder-notes", strings.Join(config.FolderNotes, ","), "文件夹笔记的命名规则，逗号分隔，{name} 代表文件夹名，例如 {name},index")
+	flag.Parse()
+
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+
+	// 查找配置文件
+	path := *configFile
+	if path == "" {
+		dir := config.Dir
+		if set["dir"] {
+			dir = flags.Dir
+		}
+		for _, name := range configFileNames {
+			candidate := filepath.Join(dir, name)
+			if _, err := os.Stat(candidate); err == nil {
+				path = candidate
+				break
+			}
+		}
+	}
+	if path != "" {
+		if err := readConfigFile(path); err != nil {
+			return "", fmt.Errorf("读取配置文件 %s: %w", path, err)
+		}
+	}
+
+	// 命令行参数覆盖配置文件
+	if set["port"] {
+		config.Port = flags.Port
+	}
+	if set["host"] {
+		config.Host = flags.Host
+	}
+	if set["dir"] {
+		config.Dir = flags.Dir
+	}
+	if set["ignore"] {
+		config.Ignore = splitList(ignore)
+	}
+	if set["exclude-pattern"] {
+		config.ExcludePatterns = excludePatterns
+	}
+	if set["ext"] {
+		config.Extensions = splitList(extensions)
+	}
+	if set["log-json"] {
+		config.LogJSON = flags.LogJSON
+	}
+	if set["mermaid"] {
+		config.Mermaid = flags.Mermaid
+	}
+	if *noMermaid {
+		config.Mermaid = "none"
+	}
+	if set["mmdc"] {
+		config.MermaidCLI = flags.MermaidCLI
+	}
+	if set["theme"] {
+		config.Theme = flags.Theme
+	}
+	if set["code-fold"] {
+		config.CodeFold = flags.CodeFold
+	}
+	if set["open-note"] {
+		config.OpenNote = flags.OpenNote
+	}
+	if set["follow-gitignore"] {
+		config.FollowGitignore = flags.FollowGitignore
+	}
+	if set["sub-sup"] {
+		config.SubSup = flags.SubSup
+	}
+	if set["sanitize"] {
+		config.Sanitize = flags.Sanitize
+	}
+	if set["index-file"] {
+		config.IndexFile = flags.IndexFile
+	}
+	if set["metrics"] {
+		config.Metrics = flags.Metrics
+	}
+	if set["folder-notes"] {
+		config.FolderNotes = splitList(folderNotes)
+	}
+	if set["attachment-dir"] {
+		config.AttachmentDir = flags.AttachmentDir
+	}
+	if set["tree-state"] {
+		config.TreeState = flags.TreeState
+	}
+	if set["show-empty-dirs"] {
+		config.ShowEmptyDirs = flags.ShowEmptyDirs
+	}
+	if set["poll"] {
+		config.Poll = flags.Poll
+	}
+	if set["render-timeout"] {
+		config.RenderTimeout = flags.RenderTimeout
+	}
+	if set["highlight"] {
+		config.Highlight = flags.Highlight
+	}
+	if set["index-marker"] {
+		config.IndexMarker = flags.IndexMarker
+	}
+	if set["base-path"] {
+		config.BasePath = flags.BasePath
+	}
+	if set["csv"] {
+		config.CSV = flags.CSV
+	}
+	if set["vault-name"] {
+		config.VaultName = flags.VaultName
+	}
+	if set["hard-wraps"] {
+		config.HardWraps = flags.HardWraps
+	}
+	if set["gfm"] {
+		config.GFM = flags.GFM
+	}
+	if set["autolink"] {
+		config.Autolink = flags.Autolink
+	}
+	if set["emoji"] {
+		config.Emoji = flags.Emoji
+	}
+	if set["heading-ids"] {
+		config.HeadingIDs = flags.HeadingIDs
+	}
+	if set["note-types"] {
+		types, err := parseNoteTypes(noteTypes)
+		if err != nil {
+			return "", err
+		}
+		config.NoteTypes = types
+	}
+	if set["callout-icons"] {
+		icons, err := parseCalloutIcons(calloutIcons)
+		if err != nil {
+			return "", err
+		}
+		config.CalloutIcons = icons
+	}
+	if set["gzip"] {
+		config.Gzip = flags.Gzip
+	}
+	if set["sort"] {
+		config.Sort = flags.Sort
+	}
+	if set["allow-edit"] {
+		config.AllowEdit = flags.AllowEdit
+	}
+	if set["show-hidden"] {
+		config.ShowHidden = flags.ShowHidden
+	}
+	if set["banner"] {
+		config.Banner = flags.Banner
+	}
+	if set["heading-offset"] {
+		config.HeadingOffset = flags.HeadingOffset
+	}
+	if set["show-vault-name"] {
+		config.ShowVaultName = flags.ShowVaultName
+	}
+	if set["debounce-immediate"] {
+		config.DebounceImmediate = flags.DebounceImmediate
+	}
+	if set["inline-code-lang"] {
+		config.InlineCodeLang = flags.InlineCodeLang
+	}
+	if set["count-embeds"] {
+		config.CountEmbeds = flags.CountEmbeds
+	}
+	if set["math"] {
+		config.Math = flags.Math
+	}
+	if set["render-api"] {
+		config.RenderAPI = flags.RenderAPI
+	}
+	if set["hide-extension"] {
+		config.HideExtension = flags.HideExtension
+	}
+	if set["max-depth"] {
+		config.MaxDepth = flags.MaxDepth
+	}
+	if set["open-browser-on-change"] {
+		config.OpenBrowserOnChange = flags.OpenBrowserOnChange
+	}
+	if set["allow-html"] {
+		config.AllowHTML = flags.AllowHTML
+	}
+	if set["html-tags"] {
+		config.HTMLTags = splitList(htmlTags)
+	}
+
+	for i, ext := range config.Extensions {
+		ext = strings.ToLower(ext)
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		config.Extensions[i] = ext
+	}
+	if config.Mermaid != "client" && config.Mermaid != "server" && config.Mermaid != "none" {
+		return "", fmt.Errorf("未知的 Mermaid 渲染方式: %s（可选 client、server、none）", config.Mermaid)
+	}
+	if config.HeadingIDs != "goldmark" && config.HeadingIDs != "github" && config.HeadingIDs != "obsidian" {
+		return "", fmt.Errorf("未知的标题 id 生成方式: %s（可选 goldmark、github、obsidian）", config.HeadingIDs)
+	}
+	// 统一为以 / 开头、不以 / 结尾的形式，根路径为空
+	if config.BasePath = strings.Trim(strings.TrimSpace(config.BasePath), "/"); config.BasePath != "" {
+		config.BasePath = "/" + config.BasePath
+	}
+	switch field, ok := strings.CutPrefix(config.Sort, "frontmatter:"); {
+	case ok && strings.TrimSpace(field) == "":
+		return "", fmt.Errorf("排序方式缺少 frontmatter 字段: %s（例如 frontmatter:weight）", config.Sort)
+	case !ok && config.Sort != "name" && config.Sort != "modified" && config.Sort != "size":
+		return "", fmt.Errorf("未知的排序方式: %s（可选 name、modified、size、frontmatter:字段）", config.Sort)
+	}
+	if config.Poll < 0 {
+		return "", fmt.Errorf("轮询间隔不能为负数: %s", config.Poll)
+	}
+	// 类型不区分大小写
+	types := make(map[string]string, len(config.NoteTypes))
+	for name, color := range config.NoteTypes {
+		if !noteTypeColorPattern.MatchString(color) {
+			return "", fmt.Errorf("笔记类型 %s 的颜色无效: %s", name, color)
+		}
+		types[strings.ToLower(strings.TrimSpace(name))] = color
+	}
+	config.NoteTypes = types
+	icons := make(map[string]string, len(config.CalloutIcons))
+	for name, icon := range config.CalloutIcons {
+		icons[strings.ToLower(strings.TrimSpace(name))] = strings.TrimSpace(icon)
+	}
+	config.CalloutIcons = icons
+	if config.MaxDepth < 0 {
+		return "", fmt.Errorf("最大深度不能为负数: %d", config.MaxDepth)
+	}
+	for _, pattern := range config.ExcludePatterns {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return "", fmt.Errorf("无效的文件名通配符 %q: %w", pattern, err)
+		}
+		if strings.Contains(pattern, "/") {
+			return "", fmt.Errorf("文件名通配符只匹配文件名，不能包含 /: %s", pattern)
+		}
+	}
+	if config.HeadingOffset < 0 {
+		return "", fmt.Errorf("标题跳转偏移不能为负数: %d", config.HeadingOffset)
+	}
+	if config.RenderTimeout < 0 {
+		return "", fmt.Errorf("渲染超时不能为负数: %s", config.RenderTimeout)
+	}
+	if _, ok := themes[config.Theme]; !ok {
+		return "", fmt.Errorf("未知的配色方案: %s（可选 %s）", config.Theme, strings.Join(themeNames, "、"))
+	}
+	return path, nil
+}
+
+// 按 Config 中字段的顺序将配置编码为 JSON，键名与配置文件相同，时间间隔写为 2s 这样的字符串
+func configJSON() ([]byte, error) {
+	var b bytes.Buffer
+	b.WriteByte('{')
+	value := reflect.ValueOf(config)
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Type().Field(i)
+		var item any = value.Field(i).Interface()
+		switch v := item.(type) {
+		case time.Duration:
+			item = v.String()
+		case []string:
+			// 未设置的列表输出为 []，便于工具处理
+			if v == nil {
+				item = []string{}
+			}
+		}
+		key, _ := json.Marshal(field.Tag.Get("yaml"))
+		data, err := json.Marshal(item)
+		if err != nil {
+			return nil, err
+		}
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.Write(key)
+		b.WriteByte(':')
+		b.Write(data)
+	}
+	b.WriteByte('}')
+
+	var out bytes.Buffer
+	if err := json.Indent(&out, b.Bytes(), "", "  "); err != nil {
+		return nil, err
+	}
+	out.WriteByte('\n')
+	return out.Bytes(), nil
+}
+
+// 读取 YAML（或 JSON）配置文件，配置中的相对目录以配置文件所在目录为基准
+func readConfigFile(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	decoder := yaml.NewDecoder(file)
+	decoder.KnownFields(true)
+	before := config.Dir
+	if err := decoder.Decode(&config); err != nil && err != io.EOF {
+		return err
+	}
+	if config.Dir != before && !filepath.IsAbs(config.Dir) {
+		config.Dir = filepath.Join(filepath.Dir(path), config.Dir)
+	}
+	return nil
+}
+
+// 可以多次指定的命令行参数，每次指定追加一项
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// 拆分逗号分隔的列表，忽略空项
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// 笔记类型的颜色：十六进制颜色或 CSS 颜色名
+var noteTypeColorPattern = regexp.MustCompile(`^(#[0-9a-fA-F]{3,8}|[a-zA-Z]+)$`)
+
+// 解析 --note-types，格式为 类型=颜色，逗号分隔
+func parseNoteTypes(value string) (map[string]string, error) {
+	types := make(map[string]string)
+	for _, item := range splitList(value) {
+		name, color, ok := strings.Cut(item, "=")
+		if !ok || strings.TrimSpace(name) == "" {
+			return nil, fmt.Errorf("笔记类型格式错误: %s（应为 类型=颜色）", item)
+		}
+		types[strings.TrimSpace(name)] = strings.TrimSpace(color)
+	}
+	return types, nil
+}
+
+// 将笔记类型格式化为 --note-types 的形式，用于帮助信息中的默认值
+func formatNoteTypes(types map[string]string) string {
+	var items []string
+	for name, color := range types {
+		items = append(items, name+"="+color)
+	}
+	sort.Strings(items)
+	return strings.Join(items, ",")
+}
+
+// 解析 --callout-icons，格式为 类型=图标，逗号分隔
+func parseCalloutIcons(value string) (map[string]string, error) {
+	icons := make(map[string]string)
+	for _, item := range splitList(value) {
+		name, icon, ok := strings.Cut(item, "=")
+		if !ok || strings.TrimSpace(name) == "" {
+			return nil, fmt.Errorf("callout 图标格式错误: %s（应为 类型=图标）", item)
+		}
+		icons[strings.TrimSpace(name)] = strings.TrimSpace(icon)
+	}
+	return icons, nil
+}
+
+// 是否为需要跳过的隐藏文件或目录（以 . 开头），--show-hidden 时不跳过
+func isHidden(name string) bool {
+	return !config.ShowHidden && strings.HasPrefix(name, ".") && name != "."
+}
+
+// 是否为需要跳过的目录
+func isIgnoredDir(name string) bool {
+	for _, ignored := range config.Ignore {
+		if name == ignored {
+			return true
+		}
+	}
+	return false
+}
+
+// 文件名是否匹配 --exclude-pattern，匹配的文件不扫描也不监听
+func isExcludedFile(name string) bool {
+	base := filepath.Base(name)
+	for _, pattern := range config.ExcludePatterns {
+		if matched, _ := filepath.Match(pattern, base); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// 是否为作为笔记处理的文件
+func isNoteFile(name string) bool {
+	if isTableFile(name) {
+		return true
+	}
+	ext := strings.ToLower(filepath.Ext(name))
+	for _, e := range config.Extensions {
+		if ext == e {
+			return true
+		}
+	}
+	return false
+}
+
+// 启用 --csv 时 .csv 和 .tsv 文件与笔记一起显示在文件树中，渲染为表格
+func isTableFile(name string) bool {
+	if !config.CSV {
+		return false
+	}
+	ext := strings.ToLower(filepath.Ext(name))
+	return ext == ".csv" || ext == ".tsv"
+}
+
+// Obsidian 画布文件，将 .canvas 加入 --ext 后可浏览
+func isCanvasFile(name string) bool {
+	return strings.ToLower(filepath.Ext(name)) == ".canvas"
+}
+
+// 内容为 markdown 的笔记；表格和画布文件没有 frontmatter、标签和 wikilink
+func isMarkdownNote(name string) bool {
+	return !isTableFile(name) && !isCanvasFile(name)
+}
+
+// gitignore 风格的忽略规则
+type ignoreRule struct {
+	pattern *regexp.Regexp
+	negate  bool
+	dirOnly bool
+}
+
+// 按目录缓存的忽略规则，目录为相对库根目录的路径（根目录为 "."）
+var ignoreRulesCache = make(map[string][]ignoreRule)
+var ignoreMu sync.Mutex
+
+// 清空忽略规则缓存，使忽略文件的修改在下次扫描时生效
+func resetIgnoreRules() {
+	ignoreMu.Lock()
+	ignoreRulesCache = make(map[string][]ignoreRule)
+	ignoreMu.Unlock()
+}
+
+// 读取目录下指定名称的忽略文件（如 .gitignore），结果会被缓存
+func loadIgnoreRules(dir, fileName string) []ignoreRule {
+	key := dir + "\x00" + fileName
+	ignoreMu.Lock()
+	defer ignoreMu.Unlock()
+	if rules, ok := ignoreRulesCache[key]; ok {
+		return rules
+	}
+
+	var rules []ignoreRule
+	content, err := os.ReadFile(filepath.Join(dir, fileName))
+	if err == nil {
+		for _, line := range strings.Split(string(content), "\n") {
+			if rule, ok := parseIgnoreRule(line); ok {
+				rules = append(rules, rule)
+			}
+		}
+	}
+	ignoreRulesCache[key] = rules
+	return rules
+}
+
+// 解析一行 gitignore 规则
+func parseIgnoreRule(line string) (ignoreRule, bool) {
+	line = strings.TrimRight(line, "\r")
+	if strings.TrimSpace(line) == "" || strings.HasPrefix(line, "#") {
+		return ignoreRule{}, false
+	}
+	line = strings.TrimRight(line, " ")
+
+	var rule ignoreRule
+	if strings.HasPrefix(line, "!") {
+		rule.negate = true
+		line = line[1:]
+	} else if strings.HasPrefix(line, "\\") {
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		rule.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	if line == "" {
+		return ignoreRule{}, false
+	}
+
+	// 包含 / 的模式相对于忽略文件所在目录匹配，否则匹配任意层级
+	anchored := strings.Contains(line, "/")
+	line = strings.TrimPrefix(line, "/")
+	expr := globToRegexp(line)
+	if anchored {
+		expr = "^" + expr + "$"
+	} else {
+		expr = "^(?:.*/)?" + expr + "$"
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return ignoreRule{}, false
+	}
+	rule.pattern = re
+	return rule, true
+}
+
+// 将 gitignore 通配符转换为正则表达式
+func globToRegexp(glob string) string {
+	var re strings.Builder
+	for i := 0; i < len(glob); i++ {
+		c := glob[i]
+		switch {
+		case strings.HasPrefix(glob[i:], "**/"):
+			re.WriteString("(?:.*/)?")
+			i += 2
+		case strings.HasPrefix(glob[i:], "/**") && i+3 == len(glob):
+			re.WriteString("/.*")
+			i += 2
+		case strings.HasPrefix(glob[i:], "**"):
+			re.WriteString(".*")
+			i++
+		case c == '*':
+			re.WriteString("[^/]*")
+		case c == '?':
+			re.WriteString("[^/]")
+		case c == '[':
+			end := strings.IndexByte(glob[i+1:], ']')
+			if end == -1 {
+				re.WriteString(regexp.QuoteMeta(string(c)))
+				continue
+			}
+			class := glob[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			re.WriteString("[" + class + "]")
+			i += end + 1
+		case c == '\\' && i+1 < len(glob):
+			i++
+			re.WriteString(regexp.QuoteMeta(string(glob[i])))
+		default:
+			re.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	return re.String()
+}
+
+// 按 gitignore 语义判断路径是否被忽略：从根目录到所在目录依次应用各层的规则，最后匹配的规则生效
+func matchIgnoreFiles(path string, isDir bool, fileName string) bool {
+	path = slashPath(path)
+
+	// 父目录被忽略时，其中的内容也都被忽略
+	if parent := slashPath(filepath.Dir(path)); parent != "." && matchIgnoreFiles(parent, true, fileName) {
+		return true
+	}
+
+	ignored := false
+	dir := "."
+	rel := path
+	for {
+		for _, rule := range loadIgnoreRules(dir, fileName) {
+			if rule.dirOnly && !isDir {
+				continue
+			}
+			if rule.pattern.MatchString(rel) {
+				ignored = !rule.negate
+			}
+		}
+
+		first, rest, found := strings.Cut(rel, "/")
+		if !found {
+			return ignored
+		}
+		if dir == "." {
+			dir = first
+		} else {
+			dir = dir + "/" + first
+		}
+		rel = rest
+	}
+}
+
+// 是否被 .gitignore 忽略（仅在启用 --follow-gitignore 时生效）
+func isGitIgnored(path string, isDir bool) bool {
+	return config.FollowGitignore && matchIgnoreFiles(path, isDir, ".gitignore")
+}
+
+func rescanDirectory() error {
+	mu.Lock()
+	defer mu.Unlock()
+
+	metrics.mu.Lock()
+	metrics.rescans++
+	metrics.mu.Unlock()
+
+	resetIgnoreRules()
+	mdFiles = []string{}
+	noteAliases = make(map[string][]string)
+	assetFiles = []string{}
+	fileTree = &FileNode{Name: ".", Path: ".", IsDir: true}
+	err := scanDirectory(rootDir, fileTree)
+	buildIndexes()
+	return err
+}
+
+// 建立笔记和附件的解析索引（需持有写锁）
+// 同名文件优先匹配层级较浅的那个，与 Obsidian 的最短路径规则一致
+func buildIndexes() {
+	noteIndex = make(map[string]string)
+	for _, path := range mdFiles {
+		addIndexEntry(noteIndex, foldPath(path), path)
+		// 表格和画布文件与 Obsidian 中的附件一样，需要带扩展名链接，避免与同名笔记冲突
+		if !isMarkdownNote(path) {
+			addIndexEntry(noteIndex, foldPath(filepath.Base(path)), path)
+			continue
+		}
+		addIndexEntry(noteIndex, foldPath(strings.TrimSuffix(path, filepath.Ext(path))), path)
+		base := filepath.Base(path)
+		addIndexEntry(noteIndex, foldPath(strings.TrimSuffix(base, filepath.Ext(base))), path)
+	}
+
+	// 别名的优先级低于文件名和路径，与已有名称冲突时忽略
+	aliasIndex := make(map[string]string)
+	for _, path := range mdFiles {
+		for _, alias := range noteAliases[path] {
+			addIndexEntry(aliasIndex, foldPath(alias), path)
+		}
+	}
+	for key, path := range aliasIndex {
+		if _, ok := noteIndex[key]; !ok {
+			noteIndex[key] = path
+		}
+	}
+
+	assetIndex = make(map[string]string)
+	for _, path := range assetFiles {
+		addIndexEntry(assetIndex, foldPath(path), path)
+		addIndexEntry(assetIndex, foldPath(filepath.Base(path)), path)
+	}
+
+	// 文件树中的文件夹，按路径或文件夹名匹配
+	folderIndex = make(map[string]string)
+	var walk func(node *FileNode)
+	walk = func(node *FileNode) {
+		for _, child := range node.Children {
+			if child.IsDir {
+				addIndexEntry(folderIndex, foldPath(child.Path), child.Path)
+				addIndexEntry(folderIndex, foldPath(child.Name), child.Path)
+				walk(child)
+			}
+		}
+	}
+	walk(fileTree)
+}
+
+func addIndexEntry(index map[string]string, key, path string) {
+	if existing, ok := index[key]; ok && pathDepth(existing) <= pathDepth(path) {
+		return
+	}
+	index[key] = path
+}
+
+// 将路径统一为 / 分隔，文件树、笔记列表和索引中的路径都使用这种形式，
+// 与前端和静态文件服务的 URL 保持一致（Windows 上 filepath 使用 \）
+func slashPath(path string) string {
+	return filepath.ToSlash(path)
+}
+
+func pathDepth(path string) int {
+	return strings.Count(slashPath(path), "/")
+}
+
+// 路径是否超出 --max-depth，与 find -maxdepth 相同，根目录下的条目深度为 1
+func beyondMaxDepth(path string) bool {
+	return config.MaxDepth > 0 && pathDepth(path)+1 > config.MaxDepth
+}
+
+// 大小写折叠，用于名称/路径比较（磁盘上的实际大小写仍用于文件服务）
+func foldPath(path string) string {
+	return strings.ToLower(slashPath(path))
+}
+
+// 根据 wikilink 目标查找笔记，返回实际路径
+func resolveNote(target string) (string, bool) {
+	target = strings.TrimPrefix(strings.TrimSpace(target), "/")
+	if target == "" {
+		return "", false
+	}
+
+	mu.RLock()
+	defer mu.RUnlock()
+	path, ok := noteIndex[foldPath(target)]
+	return path, ok
+}
+
+// 根据 wikilink 目标查找文件夹，返回文件夹路径和文件夹笔记（没有时为空）
+func resolveFolder(target string) (string, string, bool) {
+	target = strings.Trim(strings.TrimSpace(target), "/")
+	if target == "" {
+		return "", "", false
+	}
+
+	mu.RLock()
+	defer mu.RUnlock()
+	path, ok := folderIndex[foldPath(target)]
+	if !ok {
+		return "", "", false
+	}
+	folderNote := ""
+	if node := findTreeNode(path); node != nil {
+		folderNote = node.FolderNote
+	}
+	return path, folderNote, true
+}
+
+// 查找附件：先按相对于当前笔记的路径，再按库内路径，最后按文件名
+func resolveAsset(target, mdDir string) (string, bool) {
+	target = strings.TrimSpace(target)
+	if target == "" {
+		return "", false
+	}
+
+	mu.RLock()
+	defer mu.RUnlock()
+	if mdDir != "" {
+		if path, ok := assetIndex[foldPath(filepath.Join(mdDir, target))]; ok {
+			return path, true
+		}
+	}
+	if candidate := attachmentPath(target, mdDir); candidate != "" {
+		if path, ok := assetIndex[foldPath(candidate)]; ok {
+			return path, true
+		}
+	}
+	if path, ok := assetIndex[foldPath(filepath.Clean(strings.TrimPrefix(target, "/")))]; ok {
+		return path, true
+	}
+	path, ok := assetIndex[foldPath(filepath.Base(target))]
+	return path, ok
+}
+
+// 附件文件夹中对应的路径，规则与 Obsidian 的 attachmentFolderPath 一致：
+// "./" 开头相对于笔记所在目录，其他值相对于库根目录
+// 未配置、库根目录（"/"）和笔记所在目录（"./"）已由常规查找覆盖，返回空
+func attachmentPath(target, mdDir string) string {
+	dir := strings.TrimSuffix(config.AttachmentDir, "/")
+	switch {
+	case dir == "" || dir == ".":
+		return ""
+	case strings.HasPrefix(dir, "./"):
+		return filepath.Join(mdDir, dir[2:], target)
+	default:
+		return filepath.Join(dir, target)
+	}
+}
+
+// 将库内路径转换为静态文件服务的 URL
+func assetURL(path string) string {
+	return config.BasePath + "/" + escapeURLPath(path)
+}
+
+// 逐段转义路径，用作 URL 中的路径部分
+func escapeURLPath(path string) string {
+	segments := strings.Split(slashPath(path), "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	return strings.Join(segments, "/")
+}
+
+func scanDirectory(dir string, parent *FileNode) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	// 排序：目录在前，然后按名称排序
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].IsDir() != entries[j].IsDir() {
+			return entries[i].IsDir()
+		}
+		return entries[i].Name() < entries[j].Name()
+	})
+
+	for _, entry := range entries {
+		name := entry.Name()
+
+		// 跳过隐藏文件和目录
+		if isHidden(name) {
+			continue
+		}
+
+		// 跳过 node_modules 等配置的目录
+		if entry.IsDir() && isIgnoredDir(name) {
+			continue
+		}
+
+		// 跳过 --exclude-pattern 匹配的文件
+		if !entry.IsDir() && isExcludedFile(name) {
+			continue
+		}
+
+		path := slashPath(filepath.Join(dir, name))
+
+		if isGitIgnored(path, entry.IsDir()) {
+			continue
+		}
+
+		// 超出 --max-depth 的文件和目录不显示
+		if beyondMaxDepth(path) {
+			continue
+		}
+
+		node := &FileNode{
+			Name:  name,
+			Path:  path,
+			IsDir: entry.IsDir(),
+		}
+
+		if entry.IsDir() {
+			err := scanDirectory(path, node)
+			if err != nil {
+				continue
+			}
+			// 不含笔记的目录（包括只有空子目录的目录）默认不显示，
+			// 子目录在递归中已被剔除，因此只需检查直接子项
+			if len(node.Children) > 0 || config.ShowEmptyDirs {
+				node.FolderNote = findFolderNote(node)
+				// 文件夹按其文件夹笔记的排序值排序
+				for _, child := range node.Children {
+					if child.Path == node.FolderNote {
+						node.Weight = child.Weight
+					}
+				}
+				parent.Children = append(parent.Children, node)
+				parent.Count += node.Count
+				addNodeStats(parent, node)
+			}
+		} else if isNoteFile(name) {
+			if info, err := entry.Info(); err == nil {
+				node.Size = info.Size()
+				node.ModTime = info.ModTime()
+			}
+			meta := readNoteMetadata(path)
+			node.Aliases, node.Tags, node.Words, node.Index, node.Type, node.Weight = meta.Aliases, meta.Tags, meta.Words, meta.Index, meta.Type, meta.Weight
+			if len(node.Aliases) > 0 {
+				noteAliases[path] = node.Aliases
+			}
+			mdFiles = append(mdFiles, path)
+			parent.Children = append(parent.Children, node)
+			parent.Count++
+			addNodeStats(parent, node)
+		} else if imageExtensions[strings.ToLower(filepath.Ext(name))] {
+			assetFiles = append(assetFiles, path)
+		}
+	}
+
+	applyOrderFile(dir, parent.Children)
+	return nil
+}
+
+// 读取目录中的 .order 文件：每行一个文件或文件夹名，笔记可以省略扩展名，空行忽略
+// 列出的子项按列出的顺序排在最前面，并记录位置供页面排序时使用；
+// 未列出的子项排在其后，仍按页面中选择的方式排序
+func applyOrderFile(dir string, children []*FileNode) {
+	data, err := os.ReadFile(filepath.Join(dir, ".order"))
+	if err != nil {
+		return
+	}
+	position := make(map[string]int)
+	for _, line := range strings.Split(string(data), "\n") {
+		name := strings.TrimSpace(line)
+		if _, ok := position[name]; name != "" && !ok {
+			position[name] = len(position) + 1
+		}
+	}
+	for _, child := range children {
+		if pos, ok := position[child.Name]; ok {
+			child.Order = pos
+		} else if pos, ok := position[strings.TrimSuffix(child.Name, filepath.Ext(child.Name))]; ok && !child.IsDir {
+			child.Order = pos
+		}
+	}
+	sort.SliceStable(children, func(i, j int) bool {
+		a, b := children[i].Order, children[j].Order
+		switch {
+		case a == 0:
+			return false
+		case b == 0:
+			return true
+		default:
+			return a < b
+		}
+	})
+}
+
+// 按配置的命名规则查找目录中的文件夹笔记，规则按顺序匹配，文件名不区分大小写
+func findFolderNote(dir *FileNode) string {
+	for _, pattern := range config.FolderNotes {
+		want := strings.ReplaceAll(pattern, "{name}", dir.Name)
+		for _, child := range dir.Children {
+			if child.IsDir {
+				continue
+			}
+			base := strings.TrimSuffix(child.Name, filepath.Ext(child.Name))
+			if strings.EqualFold(base, want) || strings.EqualFold(child.Name, want) {
+				return child.Path
+			}
+		}
+	}
+	return ""
+}
+
+// 目录的大小为子项之和，修改时间取最新的子项
+func addNodeStats(parent, child *FileNode) {
+	parent.Size += child.Size
+	if !child.Index {
+		parent.Words += child.Words
+	}
+	if child.ModTime.After(parent.ModTime) {
+		parent.ModTime = child.ModTime
+	}
+}
+
+func watchFiles() {
+	if config.Poll > 0 {
+		pollFiles(config.Poll)
+		return
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		slog.Error("创建文件监听器错误", "error", err)
+		return
+	}
+	defer watcher.Close()
+
+	// 递归添加所有目录到监听器
+	err = filepath.Walk(rootDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if info.IsDir() {
+			if skipWatchDir(path) {
+				return filepath.SkipDir
+			}
+			return watcher.Add(path)
+		}
+		return nil
+	})
+
+	if err != nil {
+		slog.Error("添加监听路径错误", "error", err)
+		return
+	}
+
+	// 防抖：避免频繁更新，期间变化的文件合并为一次更新
+	// --debounce-immediate 时空闲后的第一个变化立即更新，防抖窗口内随后的变化在窗口结束时再合并更新一次
+	var debounceTimer *time.Timer
+	debounceDelay := 500 * time.Millisecond
+	var pendingMu sync.Mutex
+	pending := make(map[string]bool)
+	inWindow := false
+	// 立即更新和窗口结束时的更新可能重叠，依次执行
+	var reloadMu sync.Mutex
+	flush := func() {
+		pendingMu.Lock()
+		paths := make([]string, 0, len(pending))
+		for path := range pending {
+			paths = append(paths, path)
+		}
+		pending = make(map[string]bool)
+		pendingMu.Unlock()
+		if len(paths) > 0 {
+			sort.Strings(paths)
+			reloadMu.Lock()
+			reloadAfterChange(paths)
+			reloadMu.Unlock()
+		}
+	}
+
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			if shouldRescan(event) {
+				pendingMu.Lock()
+				pending[slashPath(filepath.Clean(event.Name))] = true
+				immediate := config.DebounceImmediate && !inWindow
+				inWindow = true
+				pendingMu.Unlock()
+				if immediate {
+					go flush()
+				}
+				// 重置防抖定时器
+				if debounceTimer != nil {
+					debounceTimer.Stop()
+				}
+				debounceTimer = time.AfterFunc(debounceDelay, func() {
+					pendingMu.Lock()
+					inWindow = false
+					pendingMu.Unlock()
+					flush()
+				})
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			slog.Error("文件监听错误", "error", err)
+		}
+	}
+}
+
+// 监听和轮询时跳过的目录：隐藏目录、忽略列表中的目录和 .gitignore 忽略的目录
+func skipWatchDir(path string) bool {
+	base := filepath.Base(path)
+	if isHidden(base) {
+		return true
+	}
+	if isIgnoredDir(base) {
+		return true
+	}
+	if path == rootDir {
+		return false
+	}
+	// 目录中的条目都超出 --max-depth 时不再监听
+	return beyondMaxDepth(filepath.Join(path, "_")) || isGitIgnored(path, true)
+}
+
+// 变化时需要刷新预览的文件：笔记、资源文件、忽略规则和 .order 排序文件
+// 隐藏的笔记和资源文件（如编辑器保存时的 .笔记.md.tmp）不算在内，--show-hidden 时除外
+func isWatchedFile(name string) bool {
+	if isExcludedFile(name) || isTreeStateFile(name) {
+		return false
+	}
+	base := filepath.Base(name)
+	if base == ".order" || (config.FollowGitignore && base == ".gitignore") {
+		return true
+	}
+	return !isHidden(base) && (isNoteFile(name) || isWatchedAsset(name))
+}
+
+// 文件监听事件是否需要重新扫描：需要监听的文件的任何变化，以及目录的创建、删除和重命名。
+// 其他文件（编辑器的交换文件、保存时的临时文件等）的创建、删除和重命名不触发刷新
+func shouldRescan(event fsnotify.Event) bool {
+	if isGitIgnored(event.Name, false) || isTreeStateFile(event.Name) {
+		return false
+	}
+	if isWatchedFile(event.Name) {
+		return true
+	}
+	if event.Op&(fsnotify.Create|fsnotify.Remove|fsnotify.Rename) == 0 {
+		return false
+	}
+	if info, err := os.Stat(event.Name); err == nil {
+		return info.IsDir() && !skipWatchDir(event.Name)
+	}
+	// 已删除或移走的路径无法判断类型，按文件树中是否为文件夹判断
+	mu.RLock()
+	defer mu.RUnlock()
+	node := findTreeNode(slashPath(filepath.Clean(event.Name)))
+	return node != nil && node.IsDir
+}
+
+// 文件变化后重新扫描、生成页面并通知浏览器
+// 只有笔记内容变化时推送 update 和变化的笔记，页面只更新这些笔记；其他变化推送 reload，页面整体刷新
+func reloadAfterChange(paths []string) {
+	slog.Info("检测到文件变化，重新扫描", "paths", paths)
+	before := treeSignature()
+	mu.RLock()
+	previous := renderedNotes
+	mu.RUnlock()
+	err := rescanDirectory()
+	if err != nil {
+		slog.Error("重新扫描错误", "error", err)
+		return
+	}
+	err = generateHTML("index.html")
+	if err != nil {
+		slog.Error("重新生成 HTML 错误", "error", err)
+		return
+	}
+	slog.Info("已更新", "files", len(mdFiles))
+
+	event := sseEvent{Type: "reload"}
+	if onlyNotesChanged(paths, before, treeSignature()) {
+		event = sseEvent{Type: "update", Paths: changedNotes(previous)}
+	}
+	event.Changed = latestNote(paths)
+	msg, _ := json.Marshal(event)
+	broadcastEvent(string(msg))
+}
+
+// 推送给页面的文件变化通知
+type sseEvent struct {
+	Type    string   `json:"type"`              // update：只有 paths 中的笔记内容变化；reload：需要整体刷新
+	Paths   []string `json:"paths,omitempty"`   // 渲染结果变化的笔记
+	Changed string   `json:"changed,omitempty"` // 变化的文件中最近修改的笔记，--open-browser-on-change 时页面切换到该笔记
+}
+
+// 变化的文件中仍然存在且修改时间最新的笔记
+func latestNote(paths []string) string {
+	mu.RLock()
+	defer mu.RUnlock()
+	latest := ""
+	var latestTime time.Time
+	for _, path := range paths {
+		if !isNoteFile(path) || findTreeNode(path) == nil {
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		if latest == "" || info.ModTime().After(latestTime) {
+			latest, latestTime = path, info.ModTime()
+		}
+	}
+	return latest
+}
+
+// 文件树中影响侧边栏和链接解析的部分（不含大小、修改时间和字数），用于判断页面能否只更新笔记内容
+func treeSignature() map[string]string {
+	mu.RLock()
+	defer mu.RUnlock()
+	signature := make(map[string]string)
+	var walk func(node *FileNode)
+	walk = func(node *FileNode) {
+		for _, child := range node.Children {
+			weight := ""
+			if child.Weight != nil {
+				weight = strconv.FormatFloat(*child.Weight, 'g', -1, 64)
+			}
+			signature[child.Path] = fmt.Sprint(child.IsDir, child.FolderNote, child.Aliases, child.Tags, child.Index, child.Order, child.Type, weight)
+			walk(child)
+		}
+	}
+	if fileTree != nil {
+		walk(fileTree)
+	}
+	return signature
+}
+
+// 与上一次渲染结果相比内容有变化的笔记，包括嵌入了变化笔记的笔记
+func changedNotes(previous map[string]*RenderedFile) []string {
+	mu.RLock()
+	defer mu.RUnlock()
+	var changed []string
+	for path, rf := range renderedNotes {
+		old, ok := previous[path]
+		if !ok || old.HTML != rf.HTML || old.Size != rf.Size || !old.ModTime.Equal(rf.ModTime) {
+			changed = append(changed, path)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+// 变化的都是已有笔记，且文件树没有其他变化
+func onlyNotesChanged(paths []string, before, after map[string]string) bool {
+	if !maps.Equal(before, after) {
+		return false
+	}
+	for _, path := range paths {
+		if _, ok := after[path]; !ok || !isNoteFile(path) {
+			return false
+		}
+	}
+	return len(paths) > 0
+}
+
+// 轮询时记录的文件状态，目录只记录是否存在
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+// 轮询模式：网络文件系统上 fsnotify 收不到事件，按间隔比较文件的修改时间和大小
+func pollFiles(interval time.Duration) {
+	slog.Info("使用轮询检查文件变化", "interval", interval)
+	previous := snapshotFiles()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		current := snapshotFiles()
+		if changed := diffSnapshots(previous, current); len(changed) > 0 {
+			reloadAfterChange(changed)
+		}
+		previous = current
+	}
+}
+
+// 遍历笔记库，记录所有需要监听的文件和目录的状态
+func snapshotFiles() map[string]fileStamp {
+	stamps := make(map[string]fileStamp)
+	filepath.Walk(rootDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if info.IsDir() {
+			if skipWatchDir(path) {
+				return filepath.SkipDir
+			}
+			// 目录的修改时间随内容变化，只记录存在与否，新增或删除目录时刷新
+			stamps[path] = fileStamp{}
+			return nil
+		}
+		if isWatchedFile(path) && !isGitIgnored(path, false) {
+			stamps[path] = fileStamp{modTime: info.ModTime(), size: info.Size()}
+		}
+		return nil
+	})
+	return stamps
+}
+
+// 比较两次快照，返回所有新增、删除或修改的路径
+func diffSnapshots(previous, current map[string]fileStamp) []string {
+	var changed []string
+	for path, stamp := range current {
+		old, ok := previous[path]
+		if !ok || !old.modTime.Equal(stamp.modTime) || old.size != stamp.size {
+			changed = append(changed, slashPath(path))
+		}
+	}
+	for path := range previous {
+		if _, ok := current[path]; !ok {
+			changed = append(changed, slashPath(path))
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+// SSE 事件流：文件变化后推送 JSON 格式的通知（见 sseEvent）
+func handleEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeJSONError(w, r, http.StatusInternalServerError, "不支持 SSE")
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+
+	ch := make(chan string, 4)
+	sseMu.Lock()
+	sseClients[ch] = true
+	sseMu.Unlock()
+	defer func() {
+		sseMu.Lock()
+		delete(sseClients, ch)
+		sseMu.Unlock()
+	}()
+
+	fmt.Fprint(w, ": connected\n\n")
+	flusher.Flush()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case msg := <-ch:
+			fmt.Fprintf(w, "data: %s\n\n", msg)
+			flusher.Flush()
+		}
+	}
+}
+
+// 向所有 SSE 客户端广播消息，慢客户端直接丢弃
+func broadcastEvent(msg string) {
+	sseMu.Lock()
+	defer sseMu.Unlock()
+	for ch := range sseClients {
+		select {
+		case ch <- msg:
+		default:
+		}
+	}
+}
+
+// 渲染进度，供初始生成期间的加载页面显示
+var renderProgress struct {
+	sync.Mutex
+	done, total int
+}
+
+var staticFiles = http.FileServer(http.Dir("."))
+
+// 直接提供库中的文件（http.FileServer 会把 /index.html 重定向到目录）
+func serveVaultFile(w http.ResponseWriter, r *http.Request, path string) {
+	file, err := os.Open(path)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil || info.IsDir() {
+		http.NotFound(w, r)
+		return
+	}
+	http.ServeContent(w, r, info.Name(), info.ModTime(), file)
+}
+
+// URL 路径中是否有隐藏的文件或目录，--show-hidden 时不算隐藏
+func hasHiddenSegment(urlPath string) bool {
+	for _, segment := range strings.Split(urlPath, "/") {
+		if segment != ".." && isHidden(segment) {
+			return true
+		}
+	}
+	return false
+}
+
+// 笔记库中常见文件的 Content-Type。http.FileServer 依赖系统的 MIME 表，精简的系统中可能缺少 .webp、.mmd 等类型，
+// 而 SVG 无法通过内容识别，缺少类型时会被当作 text/xml，浏览器无法作为图片显示
+var assetContentTypes = map[string]string{
+	".png":    "image/png",
+	".jpg":    "image/jpeg",
+	".jpeg":   "image/jpeg",
+	".gif":    "image/gif",
+	".svg":    "image/svg+xml",
+	".webp":   "image/webp",
+	".avif":   "image/avif",
+	".bmp":    "image/bmp",
+	".ico":    "image/x-icon",
+	".pdf":    "application/pdf",
+	".mp3":    "audio/mpeg",
+	".m4a":    "audio/mp4",
+	".ogg":    "audio/ogg",
+	".wav":    "audio/wav",
+	".flac":   "audio/flac",
+	".mp4":    "video/mp4",
+	".webm":   "video/webm",
+	".mov":    "video/quicktime",
+	".css":    "text/css; charset=utf-8",
+	".js":     "text/javascript; charset=utf-8",
+	".md":     "text/markdown; charset=utf-8",
+	".mmd":    "text/plain; charset=utf-8",
+	".txt":    "text/plain; charset=utf-8",
+	".csv":    "text/csv; charset=utf-8",
+	".tsv":    "text/tab-separated-values; charset=utf-8",
+	".canvas": "application/json",
+	".json":   "application/json",
+}
+
+// 静态文件服务；首页直接提供内存中的预览页面，初始生成完成前返回加载页面
+// 库中用户自己的 index.html 不会被预览页面遮挡，仍可通过 /index.html 访问
+func handleStatic(w http.ResponseWriter, r *http.Request) {
+	// 不提供隐藏文件（如 .obsidian、.git 中的内容）和文件树状态文件
+	if hasHiddenSegment(r.URL.Path) || isTreeStateFile(strings.TrimPrefix(path.Clean(r.URL.Path), "/")) {
+		http.NotFound(w, r)
+		return
+	}
+	if r.URL.Path == "/index.html" && !isGeneratedPage("index.html") {
+		serveVaultFile(w, r, "index.html")
+		return
+	}
+	if r.URL.Path == "/" || r.URL.Path == "/index.html" {
+		mu.RLock()
+		isReady := ready
+		page, modTime := generatedPage, generatedAt
+		mu.RUnlock()
+		if !isReady || page == nil {
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.Header().Set("Cache-Control", "no-store")
+			loadingTemplate.Execute(w, struct {
+				Theme
+				BasePath string
+			}{themes[config.Theme], config.BasePath})
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-cache")
+		http.ServeContent(w, r, "index.html", modTime, bytes.NewReader(page))
+		return
+	}
+	// 明确设置常见附件的类型，并禁止浏览器根据内容猜测
+	if contentType, ok := assetContentTypes[strings.ToLower(path.Ext(r.URL.Path))]; ok {
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+	}
+	staticFiles.ServeHTTP(w, r)
+}
+
+// 按文件夹分组列出所有笔记的索引页，链接打开预览页面中的对应笔记
+func handleSitemap(w http.ResponseWriter, r *http.Request) {
+	mu.RLock()
+	isReady := ready
+	mu.RUnlock()
+	if !isReady {
+		http.Error(w, "正在扫描笔记库", http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	sitemapTemplate.Execute(w, struct {
+		Theme
+		Sitemap template.HTML
+	}{themes[config.Theme], template.HTML(sitemapHTML())})
+}
+
+// 每行一个笔记路径（相对于库根目录），便于在命令行中配合 fzf、grep 等工具使用
+func handleFilesText(w http.ResponseWriter, r *http.Request) {
+	mu.RLock()
+	isReady := ready
+	files := append([]string(nil), mdFiles...)
+	mu.RUnlock()
+	if !isReady {
+		writeJSONError(w, r, http.StatusServiceUnavailable, "正在扫描笔记库")
+		return
+	}
+	sort.Strings(files)
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	for _, file := range files {
+		fmt.Fprintln(w, file)
+	}
+}
+
+// 将当前的文件树渲染为嵌套列表，用于 /sitemap 和页面未打开笔记时的空状态
+// 链接为 ./?note=路径，预览页面加载时打开该笔记
+func sitemapHTML() string {
+	mu.RLock()
+	defer mu.RUnlock()
+	if fileTree == nil || len(fileTree.Children) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	writeSitemapList(&b, fileTree.Children, sitemapLink)
+	return b.String()
+}
+
+// link 生成指向笔记的链接，预览页面和静态站点（--site-out）的链接形式不同
+func writeSitemapList(b *strings.Builder, nodes []*FileNode, link func(path, title string) string) {
+	b.WriteString(`<ul class="sitemap">`)
+	for _, node := range nodes {
+		if !node.IsDir {
+			title := node.Name
+			if isMarkdownNote(node.Path) {
+				title = strings.TrimSuffix(title, filepath.Ext(title))
+			}
+			b.WriteString("<li>" + link(node.Path, title) + "</li>")
+			continue
+		}
+		// 有文件夹笔记的文件夹名称链接到该笔记
+		b.WriteString(`<li class="sitemap-folder">📁 `)
+		if node.FolderNote != "" {
+			b.WriteString(link(node.FolderNote, node.Name))
+		} else {
+			b.WriteString("<span>" + gohtml.EscapeString(node.Name) + "</span>")
+		}
+		if len(node.Children) > 0 {
+			writeSitemapList(b, node.Children, link)
+		}
+		b.WriteString("</li>")
+	}
+	b.WriteString("</ul>")
+}
+
+func sitemapLink(path, title string) string {
+	return `<a href="./?note=` + gohtml.EscapeString(url.QueryEscape(path)) + `" class="wikilink" data-path="` +
+		gohtml.EscapeString(path) + `" data-heading="">` + gohtml.EscapeString(title) + `</a>`
+}
+
+var sitemapTemplate = template.Must(template.New("sitemap").Parse(`<!DOCTYPE html>
+<html lang="zh-CN">
+<head>
+    <meta charset="UTF-8">
+    <meta name="viewport" content="width=device-width, initial-scale=1.0">
+    <title>Obsidian 笔记预览 - 笔记索引</title>
+    <style>
+        body {
+            margin: 0 auto;
+            max-width: 800px;
+            padding: 30px 20px;
+            font-family: -apple-system, BlinkMacSystemFont, "Segoe UI", Roboto, "Helvetica Neue", Arial, sans-serif;
+            background: {{.Background}};
+            color: {{.Text}};
+        }
+
+        h1 {
+            font-size: 22px;
+            color: {{.TextStrong}};
+            border-bottom: 1px solid {{.Border}};
+            padding-bottom: 10px;
+        }
+
+        ul {
+            list-style: none;
+            padding-left: 20px;
+            line-height: 1.8;
+        }
+
+        body > ul {
+            padding-left: 0;
+        }
+
+        .sitemap-folder {
+            color: {{.TextMuted}};
+        }
+
+        .sitemap-folder > span,
+        .sitemap-folder > a {
+            font-weight: 600;
+        }
+
+        a {
+            color: {{.TextFile}};
+            text-decoration: none;
+        }
+
+        a:hover {
+            text-decoration: underline;
+        }
+    </style>
+</head>
+<body>
+    <h1>笔记索引</h1>
+    {{.Sitemap}}
+</body>
+</html>
+`))
+
+// 笔记库统计页面，数据在每次请求时按当前的扫描结果计算，页面在笔记库变化时自动刷新
+func handleStats(w http.ResponseWriter, r *http.Request) {
+	mu.RLock()
+	isReady := ready
+	mu.RUnlock()
+	if !isReady {
+		http.Error(w, "正在扫描笔记库", http.StatusServiceUnavailable)
+		return
+	}
+	stats, err := collectVaultStats()
+	if err != nil {
+		slog.Error("统计笔记库失败", "error", err)
+		http.Error(w, "统计笔记库失败", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	statsTemplate.Execute(w, struct {
+		Theme
+		vaultStats
+	}{themes[config.Theme], stats})
+}
+
+// 笔记库的整体统计，只包含 markdown 笔记
+type vaultStats struct {
+	Notes    int
+	Words    int // 不含索引类笔记，与文件树中的字数一致
+	Links    int // 指向其他笔记的 wikilink 数量，--count-embeds 时包含嵌入
+	Tags     []tagCount
+	Orphans  []statsNote // 既没有链接也没有被链接的笔记
+	Unlinked []statsNote // 链接了其他笔记，但没有被其他笔记链接的笔记
+	Largest  []statsNote
+}
+
+type tagCount struct {
+	Tag   string
+	Count int
+}
+
+type statsNote struct {
+	Path  string
+	Title string
+	Words int
+	Size  string
+}
+
+// 统计页面列出的最大笔记数量
+const largestNotesLimit = 10
+
+func collectVaultStats() (vaultStats, error) {
+	var notes []FileNode
+	mu.RLock()
+	var walk func(node *FileNode)
+	walk = func(node *FileNode) {
+		for _, child := range node.Children {
+			if child.IsDir {
+				walk(child)
+			} else if isMarkdownNote(child.Path) {
+				notes = append(notes, *child)
+			}
+		}
+	}
+	if fileTree != nil {
+		walk(fileTree)
+	}
+	mu.RUnlock()
+
+	stats := vaultStats{Notes: len(notes)}
+	tagIndex := make(map[string]int)
+	for _, note := range notes {
+		if !note.Index {
+			stats.Words += note.Words
+		}
+		for _, tag := range note.Tags {
+			key := strings.ToLower(tag)
+			if i, ok := tagIndex[key]; ok {
+				stats.Tags[i].Count++
+				continue
+			}
+			tagIndex[key] = len(stats.Tags)
+			stats.Tags = append(stats.Tags, tagCount{Tag: tag, Count: 1})
+		}
+	}
+	sort.SliceStable(stats.Tags, func(i, j int) bool {
+		if stats.Tags[i].Count != stats.Tags[j].Count {
+			return stats.Tags[i].Count > stats.Tags[j].Count
+		}
+		return strings.ToLower(stats.Tags[i].Tag) < strings.ToLower(stats.Tags[j].Tag)
+	})
+
+	sort.Slice(notes, func(i, j int) bool { return notes[i].Path < notes[j].Path })
+	paths := make([]string, len(notes))
+	for i, note := range notes {
+		paths[i] = note.Path
+	}
+	links, err := collectNoteLinks(paths)
+	if err != nil {
+		return stats, err
+	}
+	incoming := make(map[string]int)
+	for _, targets := range links {
+		stats.Links += len(targets)
+		for _, target := range targets {
+			incoming[target]++
+		}
+	}
+	for _, note := range notes {
+		switch {
+		case incoming[note.Path] > 0:
+		case len(links[note.Path]) == 0:
+			stats.Orphans = append(stats.Orphans, newStatsNote(note))
+		default:
+			stats.Unlinked = append(stats.Unlinked, newStatsNote(note))
+		}
+	}
+	sort.SliceStable(notes, func(i, j int) bool { return notes[i].Size > notes[j].Size })
+	for _, note := range notes[:min(len(notes), largestNotesLimit)] {
+		stats.Largest = append(stats.Largest, newStatsNote(note))
+	}
+	return stats, nil
+}
+
+// 笔记之间的链接：键为笔记路径，值为其链接到的其他笔记（按出现次数重复）
+// 只统计 wikilink，--count-embeds 时包含嵌入 ![[笔记]]，附件和指向笔记自身的链接不计入
+func collectNoteLinks(notes []string) (map[string][]string, error) {
+	links := make(map[string][]string)
+	for _, path := range notes {
+		content, _, err := readNoteFile(path)
+		if err != nil {
+			return nil, err
+		}
+		scanWikiLinks(content, func(_ int, match []string) {
+			if strings.HasPrefix(match[0], "!") && !config.CountEmbeds {
+				return
+			}
+			if target, ok := linkedNote(match[1], path); ok && target != path {
+				links[path] = append(links[path], target)
+			}
+		})
+	}
+	return links, nil
+}
+
+// 所有 markdown 笔记中的孤立笔记，按路径排序
+func findOrphans() ([]string, error) {
+	mu.RLock()
+	var notes []string
+	for _, path := range mdFiles {
+		if isMarkdownNote(path) {
+			notes = append(notes, path)
+		}
+	}
+	mu.RUnlock()
+	sort.Strings(notes)
+
+	links, err := collectNoteLinks(notes)
+	if err != nil {
+		return nil, err
+	}
+	linked := make(map[string]bool)
+	for from, targets := range links {
+		linked[from] = true
+		for _, target := range targets {
+			linked[target] = true
+		}
+	}
+	var orphans []string
+	for _, path := range notes {
+		if !linked[path] {
+			orphans = append(orphans, path)
+		}
+	}
+	return orphans, nil
+}
+
+func newStatsNote(node FileNode) statsNote {
+	return statsNote{
+		Path:  node.Path,
+		Title: strings.TrimSuffix(node.Name, filepath.Ext(node.Name)),
+		Words: node.Words,
+		Size:  formatSize(node.Size),
+	}
+}
+
+// 以 B、KB、MB 为单位显示文件大小
+func formatSize(size int64) string {
+	switch {
+	case size < 1024:
+		return fmt.Sprintf("%d B", size)
+	case size < 1024*1024:
+		return fmt.Sprintf("%.1f KB", float64(size)/1024)
+	default:
+		return fmt.Sprintf("%.1f MB", float64(size)/(1024*1024))
+	}
+}
+
+var statsTemplate = template.Must(template.New("stats").Parse(`<!DOCTYPE html>
+<html lang="zh-CN">
+<head>
+    <meta charset="UTF-8">
+    <meta name="viewport" content="width=device-width, initial-scale=1.0">
+    <title>Obsidian 笔记预览 - 笔记库统计</title>
+    <style>
+        body {
+            margin: 0 auto;
+            max-width: 800px;
+            padding: 30px 20px;
+            font-family: -apple-system, BlinkMacSystemFont, "Segoe UI", Roboto, "Helvetica Neue", Arial, sans-serif;
+            background: {{.Background}};
+            color: {{.Text}};
+        }
+
+        h1 {
+            font-size: 22px;
+            color: {{.TextStrong}};
+            border-bottom: 1px solid {{.Border}};
+            padding-bottom: 10px;
+        }
+
+        h2 {
+            font-size: 17px;
+            color: {{.TextStrong}};
+            margin-top: 32px;
+        }
+
+        .summary {
+            display: grid;
+            grid-template-columns: repeat(auto-fit, minmax(140px, 1fr));
+            gap: 12px;
+        }
+
+        .summary div {
+            border: 1px solid {{.Border}};
+            border-radius: 6px;
+            padding: 12px 16px;
+        }
+
+        .summary strong {
+            display: block;
+            font-size: 24px;
+            color: {{.TextStrong}};
+        }
+
+        .summary span,
+        .muted {
+            color: {{.TextMuted}};
+        }
+
+        table {
+            border-collapse: collapse;
+            width: 100%;
+        }
+
+        th, td {
+            text-align: left;
+            padding: 6px 10px;
+            border-bottom: 1px solid {{.Border}};
+        }
+
+        th {
+            color: {{.TextMuted}};
+            font-weight: 600;
+        }
+
+        td.number {
+            text-align: right;
+            font-variant-numeric: tabular-nums;
+        }
+
+        ul {
+            padding-left: 20px;
+            line-height: 1.8;
+        }
+
+        .tags {
+            display: flex;
+            flex-wrap: wrap;
+            gap: 6px 14px;
+            line-height: 1.8;
+        }
+
+        a {
+            color: {{.TextFile}};
+            text-decoration: none;
+        }
+
+        a:hover {
+            text-decoration: underline;
+        }
+    </style>
+</head>
+<body>
+    <h1>笔记库统计</h1>
+    <div class="summary">
+        <div><strong>{{.Notes}}</strong><span>笔记</span></div>
+        <div><strong>{{.Words}}</strong><span>字数</span></div>
+        <div><strong>{{.Links}}</strong><span>链接</span></div>
+        <div><strong>{{len .Tags}}</strong><span>标签</span></div>
+        <div><strong>{{len .Orphans}}</strong><span>孤立笔记</span></div>
+        <div><strong>{{len .Unlinked}}</strong><span>没有反向链接</span></div>
+    </div>
+
+    <h2>最大的笔记</h2>
+    {{if .Largest}}<table>
+        <tr><th>笔记</th><th>字数</th><th>大小</th></tr>
+        {{range .Largest}}<tr><td><a href="./?note={{.Path}}" title="{{.Path}}">{{.Title}}</a></td><td class="number">{{.Words}}</td><td class="number">{{.Size}}</td></tr>
+        {{end}}
+    </table>{{else}}<p class="muted">没有笔记</p>{{end}}
+
+    <h2>标签</h2>
+    {{if .Tags}}<div class="tags">{{range .Tags}}<span>#{{.Tag}} <span class="muted">{{.Count}}</span></span>{{end}}</div>{{else}}<p class="muted">没有标签</p>{{end}}
+
+    <h2>孤立笔记 <span class="muted">（没有链接到其他笔记，也没有被其他笔记链接）</span></h2>
+    {{if .Orphans}}<ul>{{range .Orphans}}<li><a href="./?note={{.Path}}">{{.Path}}</a></li>{{end}}</ul>{{else}}<p class="muted">没有孤立笔记</p>{{end}}
+
+    <h2>没有反向链接的笔记 <span class="muted">（链接了其他笔记，但没有被其他笔记链接）</span></h2>
+    {{if .Unlinked}}<ul>{{range .Unlinked}}<li><a href="./?note={{.Path}}">{{.Path}}</a></li>{{end}}</ul>{{else}}<p class="muted">没有这样的笔记</p>{{end}}
+
+    <script>
+        // 笔记库变化时刷新统计
+        new EventSource('events').onmessage = () => location.reload();
+    </script>
+</body>
+</html>
+`))
+
+// 加载页面：轮询 /healthz 显示进度，就绪后刷新
+var loadingTemplate = template.Must(template.New("loading").Parse(`<!DOCTYPE html>
+<html lang="zh-CN">
+<head>
+    <meta charset="UTF-8">
+    <title>Obsidian 笔记预览 - 正在生成</title>
+    <style>
+        body {
+            margin: 0;
+            height: 100vh;
+            display: flex;
+            flex-direction: column;
+            align-items: center;
+            justify-content: center;
+            font-family: -apple-system, BlinkMacSystemFont, "Segoe UI", Roboto, "Helvetica Neue", Arial, sans-serif;
+            background: {{.Background}};
+            color: {{.TextMuted}};
+        }
+
+        .spinner {
+            width: 36px;
+            height: 36px;
+            border: 3px solid {{.Border}};
+            border-top-color: {{.Accent}};
+            border-radius: 50%;
+            animation: spin 0.8s linear infinite;
+            margin-bottom: 16px;
+        }
+
+        @keyframes spin {
+            to { transform: rotate(360deg); }
+        }
+    </style>
+</head>
+<body>
+    <div class="spinner"></div>
+    <div id="status">正在扫描笔记库...</div>
+    <script>
+        function poll() {
+            fetch({{.BasePath}} + '/healthz', { cache: 'no-store' }).then(resp => resp.json()).then(status => {
+                if (status.status === 'ok') {
+                    location.reload();
+                    return;
+                }
+                if (status.progress) {
+                    document.getElementById('status').textContent = '正在渲染笔记 ' + status.progress;
+                }
+                setTimeout(poll, 500);
+            }).catch(() => setTimeout(poll, 1000));
+        }
+        poll();
+    </script>
+</body>
+</html>`))
+
+// 健康检查：初始扫描完成前返回 503
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	mu.RLock()
+	isReady := ready
+	files := len(mdFiles)
+	mu.RUnlock()
+
+	status := struct {
+		Status   string `json:"status"`
+		Files    int    `json:"files"`
+		Uptime   int64  `json:"uptime"`             // 秒
+		Progress string `json:"progress,omitempty"` // 初始生成期间的渲染进度
+	}{
+		Status: "ok",
+		Files:  files,
+		Uptime: int64(time.Since(startTime).Seconds()),
+	}
+	code := http.StatusOK
+	if !isReady {
+		status.Status = "starting"
+		code = http.StatusServiceUnavailable
+		renderProgress.Lock()
+		if renderProgress.total > 0 {
+			status.Progress = fmt.Sprintf("%d/%d", renderProgress.done, renderProgress.total)
+		}
+		renderProgress.Unlock()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(status)
+}
+
+// 运行指标，通过 /metrics 以 Prometheus 文本格式导出
+var metrics = &metricsRegistry{
+	requests:      make(map[string]uint64),
+	renderBuckets: []float64{0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5},
+	renderCounts:  make([]uint64, 8),
+}
+
+type metricsRegistry struct {
+	mu            sync.Mutex
+	rescans       uint64
+	requests      map[string]uint64 // 按路由统计的请求数
+	renders       uint64
+	renderErrors  uint64
+	renderBuckets []float64 // 渲染耗时直方图的上界（秒）
+	renderCounts  []uint64  // 每个上界内的渲染次数（累计）
+	renderSum     float64
+}
+
+// 记录一次笔记渲染的耗时和结果
+func (m *metricsRegistry) observeRender(d time.Duration, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.renders++
+	if err != nil {
+		m.renderErrors++
+	}
+	seconds := d.Seconds()
+	m.renderSum += seconds
+	for i, bound := range m.renderBuckets {
+		if seconds <= bound {
+			m.renderCounts[i]++
+		}
+	}
+}
+
+// 包装处理函数，统计各路由的请求数
+func countRequests(name string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		metrics.mu.Lock()
+		metrics.requests[name]++
+		metrics.mu.Unlock()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// 以 Prometheus 文本格式输出运行指标
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	mu.RLock()
+	files := len(mdFiles)
+	mu.RUnlock()
+
+	sseMu.Lock()
+	clients := len(sseClients)
+	sseMu.Unlock()
+
+	var b strings.Builder
+	writeMetric := func(name, kind, help string, value any) {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n%s %v\n", name, help, name, kind, name, value)
+	}
+
+	writeMetric("obsidian_preview_notes", "gauge", "Number of scanned notes.", files)
+	writeMetric("obsidian_preview_sse_clients", "gauge", "Number of connected SSE clients.", clients)
+	writeMetric("obsidian_preview_uptime_seconds", "gauge", "Seconds since the process started.", int64(time.Since(startTime).Seconds()))
+
+	metrics.mu.Lock()
+	writeMetric("obsidian_preview_rescans_total", "counter", "Number of directory rescans.", metrics.rescans)
+	writeMetric("obsidian_preview_renders_total", "counter", "Number of rendered notes.", metrics.renders)
+	writeMetric("obsidian_preview_render_errors_total", "counter", "Number of notes that failed to render.", metrics.renderErrors)
+
+	b.WriteString("# HELP obsidian_preview_render_duration_seconds Time spent rendering a single note.\n")
+	b.WriteString("# TYPE obsidian_preview_render_duration_seconds histogram\n")
+	for i, bound := range metrics.renderBuckets {
+		fmt.Fprintf(&b, "obsidian_preview_render_duration_seconds_bucket{le=\"%g\"} %d\n", bound, metrics.renderCounts[i])
+	}
+	fmt.Fprintf(&b, "obsidian_preview_render_duration_seconds_bucket{le=\"+Inf\"} %d\n", metrics.renders)
+	fmt.Fprintf(&b, "obsidian_preview_render_duration_seconds_sum %g\n", metrics.renderSum)
+	fmt.Fprintf(&b, "obsidian_preview_render_duration_seconds_count %d\n", metrics.renders)
+
+	names := make([]string, 0, len(metrics.requests))
+	for name := range metrics.requests {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	b.WriteString("# HELP obsidian_preview_http_requests_total Number of HTTP requests by handler.\n")
+	b.WriteString("# TYPE obsidian_preview_http_requests_total counter\n")
+	for _, name := range names {
+		fmt.Fprintf(&b, "obsidian_preview_http_requests_total{handler=\"%s\"} %d\n", name, metrics.requests[name])
+	}
+	metrics.mu.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	io.WriteString(w, b.String())
+}
+
+// 服务端保存的文件树状态：会话 ID -> 展开的文件夹路径
+var treeStates = make(map[string][]string)
+var treeStateMu sync.Mutex
+
+const sessionCookieName = "obsidian-preview-session"
+
+// 状态文件的绝对路径：相对路径位于用户缓存目录下的 obsidian-preview 目录（如 ~/.cache/obsidian-preview），
+// 避免状态文件及其临时文件出现在笔记库中，被当作库中的文件监听或通过静态文件服务读取
+func treeStatePath(name string) (string, error) {
+	if filepath.IsAbs(name) {
+		return name, nil
+	}
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "obsidian-preview", name), nil
+}
+
+// 是否为状态文件或保存时的临时文件；指定的绝对路径在笔记库中时，这些文件不监听也不提供下载
+func isTreeStateFile(name string) bool {
+	if config.TreeState == "" {
+		return false
+	}
+	abs, err := filepath.Abs(name)
+	if err != nil {
+		return false
+	}
+	return abs == config.TreeState || abs == config.TreeState+".tmp"
+}
+
+func loadTreeStates() error {
+	data, err := os.ReadFile(config.TreeState)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	treeStateMu.Lock()
+	defer treeStateMu.Unlock()
+	return json.Unmarshal(data, &treeStates)
+}
+
+// 写入状态文件（需持有 treeStateMu），先写临时文件再重命名，避免写到一半的文件
+func saveTreeStates() error {
+	data, err := json.Marshal(treeStates)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(config.TreeState), 0755); err != nil {
+		return err
+	}
+	tmp := config.TreeState + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, config.TreeState)
+}
+
+// 读取或分配会话 ID，通过 cookie 区分不同的浏览器
+func sessionID(w http.ResponseWriter, r *http.Request) (string, error) {
+	if cookie, err := r.Cookie(sessionCookieName); err == nil && len(cookie.Value) == 32 {
+		if _, err := hex.DecodeString(cookie.Value); err == nil {
+			return cookie.Value, nil
+		}
+	}
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	id := hex.EncodeToString(buf)
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    id,
+		Path:     config.BasePath + "/",
+		MaxAge:   365 * 24 * 60 * 60,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return id, nil
+}
+
+// GET 返回当前会话的文件树状态，PUT 保存
+func handleTreeState(w http.ResponseWriter, r *http.Request) {
+	id, err := sessionID(w, r)
+	if err != nil {
+		writeJSONError(w, r, http.StatusInternalServerError, "无法创建会话")
+		return
+	}
+
+	var state struct {
+		Expanded []string `json:"expanded"`
+	}
+	switch r.Method {
+	case http.MethodGet:
+		treeStateMu.Lock()
+		state.Expanded = treeStates[id]
+		treeStateMu.Unlock()
+		if state.Expanded == nil {
+			state.Expanded = []string{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(state)
+	case http.MethodPut:
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&state); err != nil {
+			writeJSONError(w, r, http.StatusBadRequest, "无效的状态")
+			return
+		}
+		treeStateMu.Lock()
+		treeStates[id] = state.Expanded
+		err := saveTreeStates()
+		treeStateMu.Unlock()
+		if err != nil {
+			slog.Error("保存文件树状态失败", "path", config.TreeState, "error", err)
+			writeJSONError(w, r, http.StatusInternalServerError, "保存失败")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "GET, PUT")
+		writeJSONError(w, r, http.StatusMethodNotAllowed, "不支持的请求方法")
+	}
+}
+
+// 判断路径是否为扫描到的 markdown 文件，用于 API 的路径校验
+func isKnownNote(path string) bool {
+	mu.RLock()
+	defer mu.RUnlock()
+	for _, p := range mdFiles {
+		if p == path {
+			return true
+		}
+	}
+	return false
+}
+
+// 返回笔记的原始 markdown 内容，支持 HEAD 和条件请求
+func handleRaw(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		writeJSONError(w, r, http.StatusMethodNotAllowed, "不支持的请求方法")
+		return
+	}
+	path := r.URL.Query().Get("path")
+	if path == "" {
+		writeJSONError(w, r, http.StatusBadRequest, "缺少 path 参数")
+		return
+	}
+	if !isKnownNote(path) {
+		writeJSONError(w, r, http.StatusNotFound, "文件未找到")
+		return
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		writeJSONError(w, r, http.StatusInternalServerError, fmt.Sprintf("读取文件错误: %v", err))
+		return
+	}
+	// 非 UTF-8 的笔记转换后返回，与预览中显示的内容一致
+	content, _, err := readNoteFile(path)
+	if err != nil {
+		writeJSONError(w, r, http.StatusInternalServerError, fmt.Sprintf("读取文件错误: %v", err))
+		return
+	}
+	// ETag 取内容的哈希，配合 Last-Modified 支持条件请求，内容未变化时返回 304；
+	// no-cache 让浏览器每次都重新验证，笔记修改后不会读到旧的缓存
+	w.Header().Set("ETag", noteETag(content))
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Content-Type", "text/markdown; charset=utf-8")
+	http.ServeContent(w, r, "", info.ModTime(), bytes.NewReader(content))
+}
+
+// 内容的 ETag：/api/raw 中为笔记内容（转换为 UTF-8 后）的哈希，/api/save 用它判断文件是否在编辑期间被修改；
+// /api/note 中为返回的渲染结果的哈希
+func noteETag(content []byte) string {
+	sum := sha256.Sum256(content)
+	return `"` + hex.EncodeToString(sum[:8]) + `"`
+}
+
+// 页面中保存的笔记的大小上限
+const maxSaveSize = 10 << 20
+
+// 保存页面中编辑的笔记（--allow-edit），只能写入文件树中已有的笔记，之后由文件监听重新渲染
+// 请求头 If-Match 为编辑开始时 /api/raw 返回的 ETag，文件在编辑期间被其他程序修改时返回 412，避免覆盖这些修改
+func handleSave(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		writeJSONError(w, r, http.StatusMethodNotAllowed, "不支持的请求方法")
+		return
+	}
+	// 拒绝其他网站的页面发起的请求；要求 text/markdown 使跨站请求必须先经过（不会通过的）CORS 预检
+	if origin := r.Header.Get("Origin"); origin != "" {
+		if u, err := url.Parse(origin); err != nil || u.Host != r.Host {
+			writeJSONError(w, r, http.StatusForbidden, "不允许跨站保存")
+			return
+		}
+	}
+	if mediaType, _, _ := strings.Cut(r.Header.Get("Content-Type"), ";"); strings.TrimSpace(mediaType) != "text/markdown" {
+		writeJSONError(w, r, http.StatusUnsupportedMediaType, "内容类型应为 text/markdown")
+		return
+	}
+	path := r.URL.Query().Get("path")
+	if path == "" {
+		writeJSONError(w, r, http.StatusBadRequest, "缺少 path 参数")
+		return
+	}
+	if !isKnownNote(path) {
+		writeJSONError(w, r, http.StatusNotFound, "文件未找到")
+		return
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		writeJSONError(w, r, http.StatusInternalServerError, fmt.Sprintf("读取文件错误: %v", err))
+		return
+	}
+	original, err := os.ReadFile(path)
+	if err != nil {
+		writeJSONError(w, r, http.StatusInternalServerError, fmt.Sprintf("读取文件错误: %v", err))
+		return
+	}
+	// 保存的内容总是 UTF-8，写回其他编码的文件会改变它的编码
+	current, encoding := decodeText(original)
+	if encoding != "" {
+		writeJSONError(w, r, http.StatusConflict, "该笔记不是 UTF-8 编码，不能在页面中编辑")
+		return
+	}
+	if match := r.Header.Get("If-Match"); match != "" && match != noteETag(current) {
+		writeJSONError(w, r, http.StatusPreconditionFailed, "笔记已被其他程序修改，请重新打开编辑")
+		return
+	}
+	content, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxSaveSize))
+	if err != nil {
+		writeJSONError(w, r, http.StatusRequestEntityTooLarge, "内容过大")
+		return
+	}
+
+	// 保留原文件的 BOM 和 CRLF 换行
+	data := bytes.ReplaceAll(content, []byte("\r\n"), []byte("\n"))
+	if bytes.Contains(original, []byte("\r\n")) {
+		data = bytes.ReplaceAll(data, []byte("\n"), []byte("\r\n"))
+	}
+	if bom := []byte{0xEF, 0xBB, 0xBF}; bytes.HasPrefix(original, bom) {
+		data = append(bom, data...)
+	}
+	if err := os.WriteFile(path, data, info.Mode().Perm()); err != nil {
+		writeJSONError(w, r, http.StatusInternalServerError, fmt.Sprintf("保存失败: %v", err))
+		return
+	}
+	slog.Info("已保存页面中编辑的笔记", "path", path)
+	saved, _ := decodeText(data)
+	w.Header().Set("ETag", noteETag(saved))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// 返回笔记最近一次渲染的结果和字数，页面收到 update 通知后通过它更新变化的笔记
+// 与 /api/raw 一样支持 HEAD 和条件请求
+func handleNote(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		writeJSONError(w, r, http.StatusMethodNotAllowed, "不支持的请求方法")
+		return
+	}
+	path := r.URL.Query().Get("path")
+	mu.RLock()
+	rf, ok := renderedNotes[path]
+	words := 0
+	if node := findTreeNode(path); node != nil {
+		words = node.Words
+	}
+	mu.RUnlock()
+	if !ok {
+		writeJSONError(w, r, http.StatusNotFound, "文件未找到")
+		return
+	}
+	body, err := json.Marshal(struct {
+		*RenderedFile
+		Words int `json:"words"`
+	}{rf, words})
+	if err != nil {
+		writeJSONError(w, r, http.StatusInternalServerError, fmt.Sprintf("编码错误: %v", err))
+		return
+	}
+	// 其他笔记变化（如被嵌入的笔记）时渲染结果也会改变而修改时间不变，
+	// 因此 ETag 取返回内容（渲染结果和字数）的哈希，Last-Modified 取笔记的修改时间。
+	// 响应可能经 withGzip 压缩，压缩与未压缩的内容字节不同，只能使用弱 ETag
+	w.Header().Set("ETag", "W/"+noteETag(body))
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Content-Type", "application/json")
+	http.ServeContent(w, r, "", rf.ModTime, bytes.NewReader(body))
+}
+
+// 在文件树中按路径查找节点（需持有锁）
+func findTreeNode(path string) *FileNode {
+	node := fileTree
+	for node != nil && node.Path != path {
+		var next *FileNode
+		for _, child := range node.Children {
+			if child.Path == path || (child.IsDir && strings.HasPrefix(path, child.Path+"/")) {
+				next = child
+				break
+			}
+		}
+		node = next
+	}
+	return node
+}
+
+// 渲染请求体中的 markdown（如编辑器中尚未保存的内容），path 参数为笔记在库中的路径，
+// 用于解析相对的图片和链接，可以是尚不存在的笔记
+// /api/render 同时进行的渲染数量上限
+const renderAPIConcurrency = 4
+
+var renderAPISlots = make(chan struct{}, renderAPIConcurrency)
+
+func handleRender(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		writeJSONError(w, r, http.StatusMethodNotAllowed, "不支持的请求方法")
+		return
+	}
+	mu.RLock()
+	isReady := ready
+	mu.RUnlock()
+	if !isReady {
+		writeJSONError(w, r, http.StatusServiceUnavailable, "正在扫描笔记库，请稍后重试")
+		return
+	}
+
+	path := r.URL.Query().Get("path")
+	if path != "" {
+		path = slashPath(filepath.Clean(path))
+		if filepath.IsAbs(path) || path == ".." || strings.HasPrefix(path, "../") {
+			writeJSONError(w, r, http.StatusBadRequest, "path 必须是笔记库内的相对路径")
+			return
+		}
+	}
+	content, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 10<<20))
+	if err != nil {
+		writeJSONError(w, r, http.StatusBadRequest, "读取请求内容错误")
+		return
+	}
+	content, _ = decodeText(content)
+
+	// 超时后渲染仍在后台继续，名额在渲染真正结束时才释放，避免超时的请求不断堆积
+	select {
+	case renderAPISlots <- struct{}{}:
+	default:
+		w.Header().Set("Retry-After", "1")
+		writeJSONError(w, r, http.StatusTooManyRequests, "同时进行的渲染过多，请稍后重试")
+		return
+	}
+	start := time.Now()
+	htmlContent, err := withRenderTimeout(func() (string, error) {
+		defer func() { <-renderAPISlots }()
+		return renderMarkdown(content, path, nil)
+	})
+	metrics.observeRender(time.Since(start), err)
+	if err != nil {
+		writeJSONError(w, r, http.StatusInternalServerError, fmt.Sprintf("渲染错误: %v", err))
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	io.WriteString(w, htmlContent)
+}
+
+// 读取并渲染 markdown 文件
+func renderMarkdownFile(filePath string) (string, error) {
+	return renderNote(filePath, nil)
+}
+
+// 在 --render-timeout 限制内执行渲染，避免异常的笔记拖住整个生成过程或请求
+// goroutine 无法被强制结束，超时后只是不再等待，渲染会在后台继续直到完成
+func withRenderTimeout(render func() (string, error)) (string, error) {
+	if config.RenderTimeout <= 0 {
+		return render()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), config.RenderTimeout)
+	defer cancel()
+
+	type result struct {
+		html string
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		htmlContent, err := render()
+		done <- result{htmlContent, err}
+	}()
+	select {
+	case r := <-done:
+		return r.html, r.err
+	case <-ctx.Done():
+		return "", fmt.Errorf("渲染超时（超过 %s）", config.RenderTimeout)
+	}
+}
+
+// 读取并渲染笔记，embedding 为正在嵌入的笔记链（用于检测循环嵌入），为空表示顶层笔记
+func renderNote(filePath string, embedding []string) (string, error) {
+	content, encoding, err := readNoteFile(filePath)
+	if err != nil {
+		return "", err
+	}
+	var htmlContent string
+	switch {
+	case isTableFile(filePath):
+		htmlContent, err = renderTable(content, filePath)
+	case isCanvasFile(filePath):
+		htmlContent, err = renderCanvas(content, filePath, embedding)
+	default:
+		htmlContent, err = renderMarkdown(content, filePath, embedding)
+	}
+	// 非 UTF-8 的笔记在顶部注明按哪种编码解码，解码结果不对时便于发现
+	if err == nil && encoding != "" && len(embedding) == 0 {
+		htmlContent = `<p class="encoding-notice">⚠️ 该文件不是 UTF-8 编码，已按 ` + encoding + ` 解码显示</p>` + htmlContent
+	}
+	return htmlContent, err
+}
+
+// 读取笔记并转换为 UTF-8，同时返回文件的原始编码（UTF-8 时为空）
+func readNoteFile(path string) ([]byte, string, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, "", err
+	}
+	content, encoding := decodeText(content)
+	return content, encoding, nil
+}
+
+// 将文本转换为 UTF-8：去掉 UTF-8 BOM，按 BOM 解码 UTF-16；
+// 其他无效的 UTF-8 先尝试 GB18030（兼容 GBK），能完整解码且含有汉字时采用，
+// 否则按 Windows-1252（Latin-1 的超集）解码
+func decodeText(content []byte) ([]byte, string) {
+	switch {
+	case bytes.HasPrefix(content, []byte{0xEF, 0xBB, 0xBF}):
+		content = content[3:]
+	case bytes.HasPrefix(content, []byte{0xFF, 0xFE}):
+		if decoded, err := textunicode.UTF16(textunicode.LittleEndian, textunicode.IgnoreBOM).NewDecoder().Bytes(content[2:]); err == nil {
+			return decoded, "UTF-16LE"
+		}
+	case bytes.HasPrefix(content, []byte{0xFE, 0xFF}):
+		if decoded, err := textunicode.UTF16(textunicode.BigEndian, textunicode.IgnoreBOM).NewDecoder().Bytes(content[2:]); err == nil {
+			return decoded, "UTF-16BE"
+		}
+	}
+	if utf8.Valid(content) {
+		return content, ""
+	}
+	if decoded, err := simplifiedchinese.GB18030.NewDecoder().Bytes(content); err == nil &&
+		!bytes.ContainsRune(decoded, utf8.RuneError) && bytes.ContainsFunc(decoded, isHan) {
+		return decoded, "GB18030"
+	}
+	// Windows-1252 中未定义的字节解码为替换字符，不会返回错误
+	decoded, _ := charmap.Windows1252.NewDecoder().Bytes(content)
+	return decoded, "Windows-1252"
+}
+
+func isHan(r rune) bool {
+	return unicode.Is(unicode.Han, r)
+}
+
+// 表格文件最多显示的数据行数，超出部分只显示总行数
+const maxTableRows = 1000
+
+// 将 CSV/TSV 渲染为 HTML 表格，第一行作为表头
+// 各行的列数可以不同，引号不规范时尽量按原样读取
+func renderTable(content []byte, filePath string) (string, error) {
+	reader := csv.NewReader(bytes.NewReader(bytes.TrimPrefix(content, []byte("\ufeff"))))
+	if strings.EqualFold(filepath.Ext(filePath), ".tsv") {
+		reader.Comma = '\t'
+	}
+	reader.FieldsPerRecord = -1
+	reader.LazyQuotes = true
+
+	var b strings.Builder
+	b.WriteString(`<table class="data-table">`)
+	rows := 0
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+		if rows == 0 {
+			b.WriteString("<thead><tr>")
+			for _, field := range record {
+				b.WriteString("<th>" + gohtml.EscapeString(field) + "</th>")
+			}
+			b.WriteString("</tr></thead><tbody>")
+		} else if rows <= maxTableRows {
+			b.WriteString("<tr>")
+			for _, field := range record {
+				b.WriteString("<td>" + gohtml.EscapeString(field) + "</td>")
+			}
+			b.WriteString("</tr>")
+		}
+		rows++
+	}
+	if rows == 0 {
+		return `<p class="data-table-info">空文件</p>`, nil
+	}
+	b.WriteString("</tbody></table>")
+	if rows-1 > maxTableRows {
+		b.WriteString(fmt.Sprintf(`<p class="data-table-info">共 %d 行，仅显示前 %d 行</p>`, rows-1, maxTableRows))
+	}
+	return `<div class="data-table-wrapper">` + b.String() + `</div>`, nil
+}
+
+// Obsidian 画布文件（JSON Canvas 格式）中的卡片和连线
+type canvasData struct {
+	Nodes []canvasNode `json:"nodes"`
+	Edges []canvasEdge `json:"edges"`
+}
+
+type canvasNode struct {
+	ID      string  `json:"id"`
+	Type    string  `json:"type"` // text、file、link 或 group
+	X       float64 `json:"x"`
+	Y       float64 `json:"y"`
+	Width   float64 `json:"width"`
+	Height  float64 `json:"height"`
+	Color   string  `json:"color"`
+	Text    string  `json:"text"`
+	File    string  `json:"file"`
+	Subpath string  `json:"subpath"` // 笔记中的标题，如 #标题
+	URL     string  `json:"url"`
+	Label   string  `json:"label"`
+}
+
+type canvasEdge struct {
+	FromNode string `json:"fromNode"`
+	FromSide string `json:"fromSide"`
+	FromEnd  string `json:"fromEnd"` // none 或 arrow，默认 none
+	ToNode   string `json:"toNode"`
+	ToSide   string `json:"toSide"`
+	ToEnd    string `json:"toEnd"` // 默认 arrow
+	Color    string `json:"color"`
+	Label    string `json:"label"`
+}
+
+// 画布的预设颜色 1-6：红、橙、黄、绿、青、紫
+var canvasPresetColors = map[string]string{
+	"1": "#e03e3e", "2": "#e8843a", "3": "#e0c341", "4": "#44b36b", "5": "#3aa7c7", "6": "#a066d3",
+}
+
+var hexColorPattern = regexp.MustCompile(`^#[0-9a-fA-F]{3,8}$`)
+
+// 画布颜色转换为 CSS 颜色，无法识别时返回空
+func canvasColor(color string) string {
+	if preset, ok := canvasPresetColors[color]; ok {
+		return preset
+	}
+	if hexColorPattern.MatchString(color) {
+		return color
+	}
+	return ""
+}
+
+// 画布四周留白
+const canvasPadding = 40
+
+// 按画布中的位置和大小用绝对定位渲染卡片，连线绘制为 SVG 曲线
+// 文本卡片按 markdown 渲染，笔记卡片嵌入该笔记（可指定标题），图片卡片显示图片
+func renderCanvas(content []byte, filePath string, embedding []string) (string, error) {
+	var data canvasData
+	if err := json.Unmarshal(content, &data); err != nil {
+		return "", fmt.Errorf("解析画布错误: %w", err)
+	}
+	if len(data.Nodes) == 0 {
+		return `<p class="data-table-info">空画布</p>`, nil
+	}
+
+	minX, minY := data.Nodes[0].X, data.Nodes[0].Y
+	maxX, maxY := minX, minY
+	nodes := make(map[string]canvasNode, len(data.Nodes))
+	for _, node := range data.Nodes {
+		minX, minY = min(minX, node.X), min(minY, node.Y)
+		maxX, maxY = max(maxX, node.X+node.Width), max(maxY, node.Y+node.Height)
+		nodes[node.ID] = node
+	}
+	offsetX, offsetY := minX-canvasPadding, minY-canvasPadding
+	width, height := maxX-minX+2*canvasPadding, maxY-minY+2*canvasPadding
+
+	chain := append(append([]string(nil), embedding...), filePath)
+	embedded := make(map[string]int)
+	var b strings.Builder
+	fmt.Fprintf(&b, `<div class="canvas-wrapper"><div class="canvas" style="width: %.0fpx; height: %.0fpx">`, width, height)
+
+	// 分组在最下层，其上是连线，最上层是卡片
+	for _, node := range data.Nodes {
+		if node.Type == "group" {
+			writeCanvasNode(&b, node, offsetX, offsetY, filePath, chain, embedded)
+		}
+	}
+	writeCanvasEdges(&b, data.Edges, nodes, offsetX, offsetY, width, height)
+	for _, node := range data.Nodes {
+		if node.Type != "group" {
+			writeCanvasNode(&b, node, offsetX, offsetY, filePath, chain, embedded)
+		}
+	}
+	b.WriteString("</div></div>")
+	return b.String(), nil
+}
+
+func writeCanvasNode(b *strings.Builder, node canvasNode, offsetX, offsetY float64, filePath string, chain []string, embedded map[string]int) {
+	style := fmt.Sprintf("left: %.0fpx; top: %.0fpx; width: %.0fpx; height: %.0fpx;", node.X-offsetX, node.Y-offsetY, node.Width, node.Height)
+	if color := canvasColor(node.Color); color != "" {
+		style += " border-color: " + color + ";"
+		if node.Type == "group" {
+			style += " background: color-mix(in srgb, " + color + " 8%, transparent);"
+		}
+	}
+	fmt.Fprintf(b, `<div class="canvas-node canvas-%s" style="%s">`, gohtml.EscapeString(node.Type), style)
+
+	switch node.Type {
+	case "group":
+		if node.Label != "" {
+			b.WriteString(`<div class="canvas-group-label">` + gohtml.EscapeString(node.Label) + `</div>`)
+		}
+	case "text":
+		body, err := renderMarkdown([]byte(node.Text), filePath, chain[:len(chain)-1])
+		if err != nil {
+			body = gohtml.EscapeString(node.Text)
+		}
+		b.WriteString(body)
+	case "file":
+		target := node.File + node.Subpath
+		if _, ok := resolveAsset(node.File, ""); ok {
+			b.WriteString(fixImagePaths(renderWikiLink(node.File, true, filePath), filePath))
+		} else if html, ok := renderNoteEmbed(target, filePath, chain, embedded); ok {
+			b.WriteString(html)
+		} else {
+			b.WriteString(renderWikiLink(target, false, filePath))
+		}
+	case "link":
+		if strings.HasPrefix(node.URL, "http://") || strings.HasPrefix(node.URL, "https://") {
+			b.WriteString(`<a href="` + gohtml.EscapeString(node.URL) + `" target="_blank" rel="noopener">` + gohtml.EscapeString(node.URL) + `</a>`)
+		} else {
+			b.WriteString(gohtml.EscapeString(node.URL))
+		}
+	}
+	b.WriteString("</div>")
+}
+
+// 连线端点所在边的中点和该边的外法线方向
+func canvasAnchor(node canvasNode, side string, offsetX, offsetY float64) (x, y, nx, ny float64) {
+	x, y = node.X-offsetX+node.Width/2, node.Y-offsetY+node.Height/2
+	switch side {
+	case "top":
+		return x, y - node.Height/2, 0, -1
+	case "bottom":
+		return x, y + node.Height/2, 0, 1
+	case "left":
+		return x - node.Width/2, y, -1, 0
+	default:
+		return x + node.Width/2, y, 1, 0
+	}
+}
+
+// 未指定连接边时按两张卡片的相对位置选择
+func canvasSides(from, to canvasNode) (string, string) {
+	dx := (to.X + to.Width/2) - (from.X + from.Width/2)
+	dy := (to.Y + to.Height/2) - (from.Y + from.Height/2)
+	switch {
+	case math.Abs(dx) >= math.Abs(dy) && dx >= 0:
+		return "right", "left"
+	case math.Abs(dx) >= math.Abs(dy):
+		return "left", "right"
+	case dy >= 0:
+		return "bottom", "top"
+	default:
+		return "top", "bottom"
+	}
+}
+
+func writeCanvasEdges(b *strings.Builder, edges []canvasEdge, nodes map[string]canvasNode, offsetX, offsetY, width, height float64) {
+	if len(edges) == 0 {
+		return
+	}
+	fmt.Fprintf(b, `<svg class="canvas-edges" width="%.0f" height="%.0f">`, width, height)
+
+	// 每种颜色一个箭头，箭头颜色与连线一致
+	markers := make(map[string]string)
+	marker := func(color string) string {
+		if id, ok := markers[color]; ok {
+			return id
+		}
+		id := fmt.Sprintf("canvas-arrow-%d", len(markers))
+		markers[color] = id
+		fill := "var(--text-muted)"
+		if color != "" {
+			fill = color
+		}
+		fmt.Fprintf(b, `<defs><marker id="%s" viewBox="0 0 10 10" refX="9" refY="5" markerWidth="8" markerHeight="8" orient="auto-start-reverse"><path d="M0,0 L10,5 L0,10 z" style="fill: %s"></path></marker></defs>`, id, fill)
+		return id
+	}
+
+	for _, edge := range edges {
+		from, ok1 := nodes[edge.FromNode]
+		to, ok2 := nodes[edge.ToNode]
+		if !ok1 || !ok2 {
+			continue
+		}
+		fromSide, toSide := canvasSides(from, to)
+		if edge.FromSide != "" {
+			fromSide = edge.FromSide
+		}
+		if edge.ToSide != "" {
+			toSide = edge.ToSide
+		}
+		x1, y1, nx1, ny1 := canvasAnchor(from, fromSide, offsetX, offsetY)
+		x2, y2, nx2, ny2 := canvasAnchor(to, toSide, offsetX, offsetY)
+		// 控制点沿端点所在边的法线方向伸出，距离随连线长度变化
+		k := max(40, min(150, math.Hypot(x2-x1, y2-y1)/2))
+		cx1, cy1, cx2, cy2 := x1+nx1*k, y1+ny1*k, x2+nx2*k, y2+ny2*k
+
+		color := canvasColor(edge.Color)
+		attrs := ""
+		if color != "" {
+			attrs += ` style="stroke: ` + color + `"`
+		}
+		if edge.ToEnd != "none" {
+			attrs += ` marker-end="url(#` + marker(color) + `)"`
+		}
+		if edge.FromEnd == "arrow" {
+			attrs += ` marker-start="url(#` + marker(color) + `)"`
+		}
+		fmt.Fprintf(b, `<path class="canvas-edge" d="M %.0f %.0f C %.0f %.0f, %.0f %.0f, %.0f %.0f"%s></path>`, x1, y1, cx1, cy1, cx2, cy2, x2, y2, attrs)
+		if edge.Label != "" {
+			// 标签位于曲线的中点
+			mx, my := (x1+3*cx1+3*cx2+x2)/8, (y1+3*cy1+3*cy2+y2)/8
+			fmt.Fprintf(b, `<text class="canvas-edge-label" x="%.0f" y="%.0f">%s</text>`, mx, my, gohtml.EscapeString(edge.Label))
+		}
+	}
+	b.WriteString("</svg>")
+}
+
+// 渲染 markdown 内容，filePath 为笔记在库中的路径，用于解析相对的图片、附件和链接
+func renderMarkdown(content []byte, filePath string, embedding []string) (string, error) {
+	// 使用 goldmark 渲染 markdown
+	var buf bytes.Buffer
+	rendererOptions := []renderer.Option{
+		html.WithXHTML(),
+	}
+	// 与 Obsidian 默认一致，段落内的单个换行显示为换行；关闭后按 CommonMark 合并为一行
+	if config.HardWraps {
+		rendererOptions = append(rendererOptions, html.WithHardWraps())
+	}
+	// 允许笔记中的 HTML 时保留原始标签，随后按白名单过滤
+	if config.AllowHTML {
+		rendererOptions = append(rendererOptions, html.WithUnsafe())
+	}
+	// 分别启用 GFM 的表格、删除线、任务列表和自动链接，相当于 extension.GFM
+	extensions := []goldmark.Extender{extension.DefinitionList}
+	if config.GFM {
+		extensions = append(extensions, extension.Table, extension.Strikethrough, extension.TaskList)
+	}
+	if config.Autolink {
+		extensions = append(extensions, extension.Linkify)
+	}
+	// emoji 短代码在语法树中替换，代码块和行内代码不受影响
+	if config.Emoji {
+		extensions = append(extensions, emoji.Emoji)
+	}
+	if config.Highlight {
+		extensions = append(extensions, codeHighlighting)
+	}
+	if config.Math {
+		extensions = append(extensions, mathExtension)
+	}
+	md := goldmark.New(
+		goldmark.WithExtensions(extensions...),
+		goldmark.WithParserOptions(
+			parser.WithAutoHeadingID(),
+		),
+		goldmark.WithRendererOptions(rendererOptions...),
+	)
+
+	// 笔记开头的 frontmatter 单独解析，显示为属性面板
+	fields, body := parseFrontmatter(content)
+
+	var parseOptions []parser.ParseOption
+	if config.HeadingIDs != "goldmark" {
+		ids := &headingIDs{style: config.HeadingIDs, used: make(map[string]bool)}
+		parseOptions = append(parseOptions, parser.WithContext(parser.NewContext(parser.WithIDs(ids))))
+	}
+	if err := md.Convert(body, &buf, parseOptions...); err != nil {
+		return "", err
+	}
+
+	// 过滤笔记内容中不安全的 HTML，之后的处理只添加程序自身生成的标记
+	htmlContent := buf.String()
+	if config.AllowHTML {
+		htmlContent = allowHTMLPolicy().Sanitize(htmlContent)
+	}
+	if config.Sanitize {
+		htmlContent = sanitizePolicy().Sanitize(htmlContent)
+	}
+
+	// 处理 Obsidian callout
+	htmlContent = processCallouts(htmlContent)
+
+	// 宽表格横向滚动
+	htmlContent = wrapTables(htmlContent)
+
+	// 行内代码的语言前缀
+	if config.InlineCodeLang {
+		htmlContent = processInlineCodeLang(htmlContent)
+	}
+
+	// 嵌入其他笔记，嵌入内容已完整渲染，暂时用占位符代替，避免后续步骤重复处理
+	htmlContent, embeds := processNoteEmbeds(htmlContent, filePath, embedding)
+
+	// 将 [TOC] 标记替换为目录，嵌入的笔记此时是占位符，不计入目录
+	htmlContent = processTOC(htmlContent)
+
+	// 处理 wikilink 和附件嵌入
+	htmlContent = processWikiLinks(htmlContent, filePath)
+
+	// 处理下标和上标
+	if config.SubSup {
+		htmlContent = processSubSup(htmlContent)
+	}
+
+	// 处理 #标签
+	htmlContent = processTags(htmlContent)
+
+	// 处理图片路径
+	htmlContent = fixImagePaths(htmlContent, filePath)
+
+	// 处理 Mermaid 代码块，--no-mermaid 时保留为普通代码块
+	if config.Mermaid != "none" {
+		htmlContent = processMermaidBlocks(htmlContent)
+	}
+
+	htmlContent = restoreNoteEmbeds(htmlContent, embeds)
+
+	// 被嵌入的笔记不显示题图和属性面板
+	if len(embedding) > 0 {
+		return htmlContent, nil
+	}
+	return noteBanner(fields, filePath) + renderFrontmatter(fields) + htmlContent, nil
+}
+
+// 代码高亮：输出 class 而不是内联样式，配色由 themeCSS 按配色方案提供
+// 没有对应词法分析器的语言（包括 mermaid）保持原来的 <pre><code class="language-xxx"> 输出
+var codeHighlighting = highlighting.NewHighlighting(
+	highlighting.WithFormatOptions(
+		chromahtml.WithClasses(true),
+		chromahtml.PreventSurroundingPre(true),
+	),
+	highlighting.WithWrapperRenderer(func(w util.BufWriter, c highlighting.CodeBlockContext, entering bool) {
+		if !entering {
+			w.WriteString("</code></pre>\n")
+			return
+		}
+		if c.Highlighted() {
+			w.WriteString(`<pre class="chroma">`)
+		} else {
+			w.WriteString("<pre>")
+		}
+		w.WriteString("<code")
+		if lang, ok := c.Language(); ok {
+			w.WriteString(` class="language-` + gohtml.EscapeString(string(lang)) + `"`)
+		}
+		w.WriteString(">")
+	}),
+)
+
+// 数学公式（--math）：$...$ 为行内公式，单独成行的 $$ 之间为公式块，在 callout、列表和表格中同样有效
+// 公式内容按原样输出为 <code class="language-math">（公式块外面再包一层 <pre>，与 ```math 代码块相同），
+// 之后的 wikilink、标签等处理会跳过代码；页面中由 KaTeX 排版，加载失败时显示为代码
+var mathExtension = &mathExtender{}
+
+type mathExtender struct{}
+
+func (e *mathExtender) Extend(m goldmark.Markdown) {
+	m.Parser().AddOptions(
+		parser.WithBlockParsers(util.Prioritized(mathBlockParser{}, 700)),
+		parser.WithInlineParsers(util.Prioritized(mathInlineParser{}, 500)),
+	)
+	m.Renderer().AddOptions(renderer.WithNodeRenderers(util.Prioritized(mathRenderer{}, 500)))
+}
+
+var (
+	kindMathInline = ast.NewNodeKind("MathInline")
+	kindMathBlock  = ast.NewNodeKind("MathBlock")
+)
+
+type mathInline struct {
+	ast.BaseInline
+	value []byte
+}
+
+func (n *mathInline) Kind() ast.NodeKind { return kindMathInline }
+
+func (n *mathInline) Dump(source []byte, level int) {
+	ast.DumpHelper(n, source, level, map[string]string{"Value": string(n.value)}, nil)
+}
+
+type mathBlock struct {
+	ast.BaseBlock
+	closed bool // 已读到结束的 $$
+}
+
+func (n *mathBlock) Kind() ast.NodeKind { return kindMathBlock }
+
+func (n *mathBlock) IsRaw() bool { return true }
+
+func (n *mathBlock) Dump(source []byte, level int) {
+	ast.DumpHelper(n, source, level, nil, nil)
+}
+
+type mathInlineParser struct{}
+
+func (mathInlineParser) Trigger() []byte {
+	return []byte{'$'}
+}
+
+// $...$ 与 Pandoc 的规则相同：开头的 $ 后面和结尾的 $ 前面不能是空白，结尾的 $ 后面不能紧跟数字，
+// 因此「$20 和 $30」这样的金额不会被当作公式；公式不跨越行内代码的 `，段落中的 $$...$$ 同样按行内公式显示
+func (mathInlineParser) Parse(parent ast.Node, block text.Reader, pc parser.Context) ast.Node {
+	line, _ := block.PeekLine()
+	delim := 1
+	if len(line) > 1 && line[1] == '$' {
+		delim = 2
+	}
+	body := line[delim:]
+	if len(body) == 0 || (delim == 1 && unicode.IsSpace(rune(body[0]))) {
+		return nil
+	}
+	for i := 0; i < len(body); i++ {
+		switch {
+		case body[i] == '\\':
+			i++
+		case body[i] == '`':
+			return nil
+		case body[i] != '$' || i == 0:
+		case delim == 2:
+			if i+1 < len(body) && body[i+1] == '$' {
+				block.Advance(delim + i + delim)
+				return &mathInline{value: append([]byte(nil), body[:i]...)}
+			}
+		case !unicode.IsSpace(rune(body[i-1])) && (i+1 == len(body) || body[i+1] < '0' || body[i+1] > '9'):
+			block.Advance(delim + i + delim)
+			return &mathInline{value: append([]byte(nil), body[:i]...)}
+		}
+	}
+	return nil
+}
+
+type mathBlockParser struct{}
+
+func (mathBlockParser) Trigger() []byte {
+	return []byte{'$'}
+}
+
+func (mathBlockParser) Open(parent ast.Node, reader text.Reader, pc parser.Context) (ast.Node, parser.State) {
+	line, segment := reader.PeekLine()
+	pos := pc.BlockOffset()
+	if pos < 0 || !bytes.HasPrefix(line[pos:], []byte("$$")) {
+		return nil, parser.NoChildren
+	}
+	node := &mathBlock{}
+	start := segment.Start + pos + 2
+	rest := line[pos+2:]
+	// $$ 公式 $$ 写在同一行，结束的 $$ 后面还有内容时按段落中的行内公式处理
+	if i := bytes.Index(rest, []byte("$$")); i >= 0 {
+		if !util.IsBlank(rest[i+2:]) {
+			return nil, parser.NoChildren
+		}
+		node.Lines().Append(text.NewSegment(start, start+i))
+		node.closed = true
+	} else if !util.IsBlank(rest) {
+		node.Lines().Append(text.NewSegment(start, segment.Stop))
+	}
+	reader.Advance(segment.Len() - 1)
+	return node, parser.NoChildren
+}
+
+func (mathBlockParser) Continue(node ast.Node, reader text.Reader, pc parser.Context) parser.State {
+	if node.(*mathBlock).closed {
+		return parser.Close
+	}
+	line, segment := reader.PeekLine()
+	if i := bytes.Index(line, []byte("$$")); i >= 0 && util.IsBlank(line[i+2:]) {
+		if !util.IsBlank(line[:i]) {
+			node.Lines().Append(text.NewSegment(segment.Start, segment.Start+i))
+		}
+		reader.Advance(segment.Len() - 1)
+		return parser.Close
+	}
+	node.Lines().Append(segment)
+	reader.Advance(segment.Len() - 1)
+	return parser.Continue | parser.NoChildren
+}
+
+func (mathBlockParser) Close(node ast.Node, reader text.Reader, pc parser.Context) {}
+
+func (mathBlockParser) CanInterruptParagraph() bool {
+	return true
+}
+
+func (mathBlockParser) CanAcceptIndentedLine() bool {
+	return false
+}
+
+type mathRenderer struct{}
+
+func (mathRenderer) RegisterFuncs(reg renderer.NodeRendererFuncRegisterer) {
+	reg.Register(kindMathInline, func(w util.BufWriter, source []byte, n ast.Node, entering bool) (ast.WalkStatus, error) {
+		if entering {
+			w.WriteString(`<code class="language-math">`)
+			w.Write(util.EscapeHTML(n.(*mathInline).value))
+			w.WriteString(`</code>`)
+		}
+		return ast.WalkSkipChildren, nil
+	})
+	reg.Register(kindMathBlock, func(w util.BufWriter, source []byte, n ast.Node, entering bool) (ast.WalkStatus, error) {
+		if entering {
+			w.WriteString(`<pre><code class="language-math">`)
+			lines := n.Lines()
+			for i := 0; i < lines.Len(); i++ {
+				segment := lines.At(i)
+				w.Write(util.EscapeHTML(segment.Value(source)))
+			}
+			w.WriteString("</code></pre>\n")
+		}
+		return ast.WalkSkipChildren, nil
+	})
+}
+
+// 单独成段的笔记嵌入 ![[笔记]] 或 ![[笔记#标题]]
+var noteEmbedPattern = regexp.MustCompile(`<p>!\[\[([^\[\]]+)\]\]</p>`)
+
+// 嵌入内容的占位符，使用私有区字符，不会出现在渲染结果中
+const embedPlaceholder = "\ue000embed:%d\ue000"
+
+// 笔记嵌套嵌入的最大层数
+const maxEmbedDepth = 4
+
+// 将单独成段的 ![[笔记]] 替换为该笔记渲染后的内容，返回带占位符的 HTML 和各嵌入的内容
+// 附件、不存在的笔记、循环嵌入和超过层数的嵌入保持原样，由 processWikiLinks 渲染为图片或链接
+func processNoteEmbeds(htmlContent, mdFilePath string, embedding []string) (string, []string) {
+	if len(embedding) >= maxEmbedDepth {
+		return htmlContent, nil
+	}
+	chain := append(append([]string(nil), embedding...), mdFilePath)
+
+	var embeds []string
+	embeddedNotes := make(map[string]int)
+	htmlContent = noteEmbedPattern.ReplaceAllStringFunc(htmlContent, func(match string) string {
+		inner := gohtml.UnescapeString(noteEmbedPattern.FindStringSubmatch(match)[1])
+		embedded, ok := renderNoteEmbed(inner, mdFilePath, chain, embeddedNotes)
+		if !ok {
+			return match
+		}
+		embeds = append(embeds, embedded)
+		return fmt.Sprintf(embedPlaceholder, len(embeds)-1)
+	})
+	return htmlContent, embeds
+}
+
+// 渲染一个笔记嵌入，inner 为 ![[ ]] 内的原始文本
+// embedded 记录同一页面中各笔记已嵌入的次数，用于区分多次嵌入同一笔记时的 id
+func renderNoteEmbed(inner, mdFilePath string, chain []string, embedded map[string]int) (string, bool) {
+	target, _, _ := strings.Cut(inner, "|")
+	notePart, heading, _ := strings.Cut(strings.TrimSpace(target), "#")
+	notePart = strings.TrimSpace(notePart)
+	heading = strings.TrimSpace(heading)
+	// 块引用 #^id 暂不支持嵌入
+	if strings.HasPrefix(heading, "^") {
+		return "", false
+	}
+	if _, ok := resolveAsset(notePart, noteDir(mdFilePath)); ok {
+		return "", false
+	}
+
+	notePath := mdFilePath
+	if notePart != "" {
+		var found bool
+		if notePath, found = resolveNote(notePart); !found {
+			return "", false
+		}
+	}
+	// 已在嵌入链中的笔记（包括自身）不再展开，避免循环嵌入
+	for _, p := range chain {
+		if p == notePath {
+			return "", false
+		}
+	}
+
+	body, err := renderNote(notePath, chain)
+	if err != nil {
+		slog.Warn("渲染嵌入笔记失败", "path", notePath, "error", err)
+		return "", false
+	}
+	title := strings.TrimSuffix(filepath.Base(notePath), filepath.Ext(notePath))
+	if heading != "" {
+		// 找不到标题时嵌入整篇笔记并给出提示
+		if section, ok := headingSection(body, heading); ok {
+			body = section
+			title += " > " + heading
+		} else {
+			slog.Warn("嵌入的标题不存在，已嵌入整篇笔记", "note", mdFilePath, "target", notePath, "heading", heading)
+			body = `<p class="embed-warning">⚠️ 未找到标题「` + gohtml.EscapeString(heading) + `」，已嵌入整篇笔记</p>` + body
+			heading = ""
+		}
+	}
+	embedded[notePath]++
+	body = prefixEmbedIDs(body, notePath, embedded[notePath])
+	return `<div class="note-embed" data-path="` + gohtml.EscapeString(notePath) + `">` +
+		`<div class="note-embed-title"><a href="#" class="wikilink" data-path="` + gohtml.EscapeString(notePath) +
+		`" data-heading="` + gohtml.EscapeString(heading) + `" title="打开原笔记">` + gohtml.EscapeString(title) + `</a></div>` +
+		`<div class="note-embed-content">` + body + `</div></div>`, true
+}
+
+// 匹配元素的 id 属性和页内锚点链接
+var (
+	idAttrPattern     = regexp.MustCompile(`\sid="([^"]*)"`)
+	anchorHrefPattern = regexp.MustCompile(`\shref="#([^"]*)"`)
+)
+
+// 给嵌入内容中的 id 加上 embed-<笔记名>- 前缀，避免嵌入笔记的标题与宿主笔记中的标题 id 重复，
+// 同一笔记第 n 次（n > 1）嵌入时前缀为 embed-<笔记名>-<n>-；嵌入内容中指向这些 id 的页内链接（如目录）随之修改
+func prefixEmbedIDs(body, notePath string, n int) string {
+	name := strings.TrimSuffix(filepath.Base(notePath), filepath.Ext(notePath))
+	prefix := "embed-" + strings.Join(strings.Fields(name), "-") + "-"
+	if n > 1 {
+		prefix += strconv.Itoa(n) + "-"
+	}
+	ids := make(map[string]bool)
+	body = idAttrPattern.ReplaceAllStringFunc(body, func(attr string) string {
+		id := gohtml.UnescapeString(idAttrPattern.FindStringSubmatch(attr)[1])
+		ids[id] = true
+		return ` id="` + gohtml.EscapeString(prefix+id) + `"`
+	})
+	return anchorHrefPattern.ReplaceAllStringFunc(body, func(attr string) string {
+		id := gohtml.UnescapeString(anchorHrefPattern.FindStringSubmatch(attr)[1])
+		if unescaped, err := url.PathUnescape(id); err == nil {
+			id = unescaped
+		}
+		if !ids[id] {
+			return attr
+		}
+		return ` href="#` + gohtml.EscapeString(url.PathEscape(prefix+id)) + `"`
+	})
+}
+
+// 单独成段的目录标记 [TOC] 或 [[TOC]]，不区分大小写
+var tocMarkerPattern = regexp.MustCompile(`(?i)<p>(\[toc\]|\[\[toc\]\])</p>`)
+
+// 将目录标记替换为由笔记标题生成的嵌套列表，链接到各标题的 id
+// 存在名为 TOC 的笔记时，[[TOC]] 仍作为指向该笔记的链接
+func processTOC(htmlContent string) string {
+	if !tocMarkerPattern.MatchString(htmlContent) {
+		return htmlContent
+	}
+	_, tocNote := resolveNote("TOC")
+	var toc string
+	return tocMarkerPattern.ReplaceAllStringFunc(htmlContent, func(marker string) string {
+		if tocNote && strings.Contains(marker, "[[") {
+			return marker
+		}
+		if toc == "" {
+			toc = tableOfContents(htmlContent)
+		}
+		return toc
+	})
+}
+
+// 按标题层级生成嵌套的目录列表，跳过的层级不产生空的列表项
+func tableOfContents(htmlContent string) string {
+	var b strings.Builder
+	b.WriteString(`<nav class="toc" aria-label="目录">`)
+	var levels []int
+	for _, m := range headingPattern.FindAllStringSubmatch(htmlContent, -1) {
+		level := int(m[1][0] - '0')
+		for len(levels) > 0 && levels[len(levels)-1] > level {
+			b.WriteString("</li></ul>")
+			levels = levels[:len(levels)-1]
+		}
+		if len(levels) > 0 && levels[len(levels)-1] == level {
+			b.WriteString("</li>")
+		} else {
+			b.WriteString("<ul>")
+			levels = append(levels, level)
+		}
+
+		text := strings.TrimSpace(tagPattern.ReplaceAllString(m[2], ""))
+		if id := headingAnchorID(m[0]); id != "" {
+			b.WriteString(`<li><a href="#` + gohtml.EscapeString(url.PathEscape(id)) + `">` + text + `</a>`)
+		} else {
+			b.WriteString("<li>" + text)
+		}
+	}
+	for range levels {
+		b.WriteString("</li></ul>")
+	}
+	b.WriteString("</nav>")
+	return b.String()
+}
+
+// 按 --heading-ids 指定的方式生成标题 id，实现 goldmark 的 parser.IDs，每篇笔记使用一个
+type headingIDs struct {
+	style string
+	used  map[string]bool
+}
+
+func (ids *headingIDs) Generate(value []byte, kind ast.NodeKind) []byte {
+	id := headingID(string(value), ids.style)
+	if id == "" {
+		id = "heading"
+	}
+	// 重复的标题依次加上 -1、-2 后缀
+	unique := id
+	for i := 1; ids.used[unique]; i++ {
+		unique = fmt.Sprintf("%s-%d", id, i)
+	}
+	ids.used[unique] = true
+	return []byte(unique)
+}
+
+func (ids *headingIDs) Put(value []byte) {
+	ids.used[string(value)] = true
+}
+
+// 由标题文本生成 id（不处理重复）
+// github：转为小写，保留字母（包括中文）、数字、- 和 _，空格替换为 -，其他符号去掉
+// obsidian：保留标题原文，Obsidian 链接中不能使用的 # ^ [ ] | \ : 替换为空格，连续空白合并
+func headingID(text, style string) string {
+	text = strings.TrimSpace(text)
+	var b strings.Builder
+	switch style {
+	case "github":
+		for _, r := range strings.ToLower(text) {
+			switch {
+			case r == ' ':
+				b.WriteByte('-')
+			case r == '-' || r == '_' || unicode.IsLetter(r) || unicode.IsNumber(r) || unicode.IsMark(r):
+				b.WriteRune(r)
+			}
+		}
+	case "obsidian":
+		text = strings.Map(func(r rune) rune {
+			if strings.ContainsRune(`#^[]|\:`, r) {
+				return ' '
+			}
+			return r
+		}, text)
+		b.WriteString(strings.Join(strings.Fields(text), " "))
+	}
+	return b.String()
+}
+
+// 匹配标题标签
+var headingPattern = regexp.MustCompile(`(?s)<h([1-6])[^>]*>(.*?)</h[1-6]>`)
+
+// 匹配标题标签上的 id
+var headingIDPattern = regexp.MustCompile(`^<h[1-6][^>]*\sid="([^"]*)"`)
+
+// 匹配任意标签，用于取出标题文本
+var tagPattern = regexp.MustCompile(`<[^>]*>`)
+
+// 截取指定标题下的章节，直到下一个同级或更高级的标题
+// 标题按文本（不区分大小写）或生成的 id 匹配
+func headingSection(htmlContent, heading string) (string, bool) {
+	matches := headingPattern.FindAllStringSubmatchIndex(htmlContent, -1)
+	i := findHeading(htmlContent, matches, heading)
+	if i == -1 {
+		return "", false
+	}
+	m := matches[i]
+	level := htmlContent[m[2]:m[3]]
+	end := len(htmlContent)
+	for _, next := range matches[i+1:] {
+		if htmlContent[next[2]:next[3]] <= level {
+			end = next[0]
+			break
+		}
+	}
+	return htmlContent[m[0]:end], true
+}
+
+// 在 headingPattern 的匹配结果中查找指定标题，返回序号，找不到时返回 -1
+func findHeading(htmlContent string, matches [][]int, heading string) int {
+	wanted := strings.ToLower(heading)
+	for i, m := range matches {
+		text := gohtml.UnescapeString(tagPattern.ReplaceAllString(htmlContent[m[4]:m[5]], ""))
+		if strings.ToLower(strings.TrimSpace(text)) == wanted || headingAnchorID(htmlContent[m[0]:m[5]]) == heading {
+			return i
+		}
+	}
+	return -1
+}
+
+// 标题标签上的 id，没有时返回空字符串
+func headingAnchorID(headingTag string) string {
+	if id := headingIDPattern.FindStringSubmatch(headingTag); id != nil {
+		return gohtml.UnescapeString(id[1])
+	}
+	return ""
+}
+
+// 将占位符替换回嵌入的内容
+func restoreNoteEmbeds(htmlContent string, embeds []string) string {
+	for i, embedded := range embeds {
+		htmlContent = strings.Replace(htmlContent, fmt.Sprintf(embedPlaceholder, i), embedded, 1)
+	}
+	return htmlContent
+}
+
+// frontmatter 中的一个属性，保持文件中的顺序
+type frontmatterField struct {
+	Key   string
+	Value any
+}
+
+// 解析笔记开头的 frontmatter：--- 为 YAML，+++ 为 TOML（Hugo 风格），{ 为 JSON
+// 返回属性和去掉 frontmatter 后的正文；无法识别或解析失败时原样保留在正文中
+func parseFrontmatter(content []byte) ([]frontmatterField, []byte) {
+	content = bytes.TrimPrefix(content, []byte("\ufeff"))
+
+	var fields []frontmatterField
+	var rest []byte
+	var err error
+	switch {
+	case bytes.HasPrefix(content, []byte("---")):
+		block, after, ok := splitFrontmatter(content, "---")
+		if !ok {
+			return nil, content
+		}
+		fields, err = parseYAMLFrontmatter(block)
+		rest = after
+	case bytes.HasPrefix(content, []byte("+++")):
+		block, after, ok := splitFrontmatter(content, "+++")
+		if !ok {
+			return nil, content
+		}
+		fields, err = parseTOMLFrontmatter(block)
+		rest = after
+	case bytes.HasPrefix(content, []byte("{")):
+		fields, rest, err = parseJSONFrontmatter(content)
+	default:
+		return nil, content
+	}
+	if err != nil {
+		slog.Debug("frontmatter 解析失败，按正文处理", "error", err)
+		return nil, content
+	}
+	return fields, rest
+}
+
+// 按分隔行拆出 frontmatter 块，分隔行必须单独成行
+func splitFrontmatter(content []byte, delim string) (block, rest []byte, ok bool) {
+	lines := bytes.SplitAfter(content, []byte("\n"))
+	if string(bytes.TrimRight(lines[0], " \t\r\n")) != delim {
+		return nil, nil, false
+	}
+	offset := len(lines[0])
+	for _, line := range lines[1:] {
+		if string(bytes.TrimRight(line, " \t\r\n")) == delim {
+			return content[len(lines[0]):offset], content[offset+len(line):], true
+		}
+		offset += len(line)
+	}
+	return nil, nil, false
+}
+
+func parseYAMLFrontmatter(block []byte) ([]frontmatterField, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(block, &doc); err != nil {
+		return nil, err
+	}
+	if len(doc.Content) == 0 {
+		return nil, nil
+	}
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("frontmatter 不是键值对")
+	}
+	var fields []frontmatterField
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		var value any
+		if err := root.Content[i+1].Decode(&value); err != nil {
+			return nil, err
+		}
+		fields = append(fields, frontmatterField{Key: root.Content[i].Value, Value: value})
+	}
+	return fields, nil
+}
+
+func parseTOMLFrontmatter(block []byte) ([]frontmatterField, error) {
+	values := make(map[string]any)
+	meta, err := toml.Decode(string(block), &values)
+	if err != nil {
+		return nil, err
+	}
+	var fields []frontmatterField
+	for _, key := range meta.Keys() {
+		if len(key) == 1 {
+			fields = append(fields, frontmatterField{Key: key[0], Value: values[key[0]]})
+		}
+	}
+	return fields, nil
+}
+
+// 解析笔记开头的 JSON 对象，对象之后必须换行或结束
+func parseJSONFrontmatter(content []byte) ([]frontmatterField, []byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(content))
+	if _, err := dec.Token(); err != nil {
+		return nil, nil, err
+	}
+	var fields []frontmatterField
+	for dec.More() {
+		token, err := dec.Token()
+		if err != nil {
+			return nil, nil, err
+		}
+		var value any
+		if err := dec.Decode(&value); err != nil {
+			return nil, nil, err
+		}
+		fields = append(fields, frontmatterField{Key: token.(string), Value: value})
+	}
+	if _, err := dec.Token(); err != nil {
+		return nil, nil, err
+	}
+
+	rest := content[dec.InputOffset():]
+	trimmed := bytes.TrimLeft(rest, " \t\r")
+	if len(trimmed) > 0 && trimmed[0] != '\n' {
+		return nil, nil, fmt.Errorf("JSON frontmatter 之后缺少换行")
+	}
+	return fields, trimmed, nil
+}
+
+// 扫描时从笔记内容中读取的信息
+type noteMetadata struct {
+	Aliases []string
+	Tags    []string
+	Words   int
+	Index   bool
+	Type    string
+	Weight  *float64
+}
+
+// 读取笔记 frontmatter 中的别名（aliases 或 alias）、标签（tags 或 tag）、类型（type）、排序字段和索引标记，以及正文中的 #标签 和字数
+func readNoteMetadata(path string) noteMetadata {
+	var meta noteMetadata
+	if !isMarkdownNote(path) {
+		return meta
+	}
+	content, _, err := readNoteFile(path)
+	if err != nil {
+		return meta
+	}
+	fields, body := parseFrontmatter(content)
+	weightField := sortField()
+
+	seen := make(map[string]bool)
+	addTag := func(tag string) {
+		if !seen[strings.ToLower(tag)] {
+			seen[strings.ToLower(tag)] = true
+			meta.Tags = append(meta.Tags, tag)
+		}
+	}
+	for _, field := range fields {
+		switch field.Key {
+		case "aliases", "alias":
+			for _, value := range frontmatterList(field.Value) {
+				if alias, ok := value.(string); ok && strings.TrimSpace(alias) != "" {
+					meta.Aliases = append(meta.Aliases, strings.TrimSpace(alias))
+				}
+			}
+		case "tags", "tag":
+			for _, value := range frontmatterList(field.Value) {
+				if tag, ok := value.(string); ok {
+					for _, item := range splitTags(tag) {
+						addTag(item)
+					}
+				}
+			}
+		case "type":
+			// 列表取第一项
+			if list := frontmatterList(field.Value); len(list) > 0 {
+				if noteType, ok := list[0].(string); ok {
+					meta.Type = strings.TrimSpace(noteType)
+				}
+			}
+		}
+		if matchIndexMarker(field) {
+			meta.Index = true
+		}
+		if weightField != "" && field.Key == weightField {
+			meta.Weight = frontmatterNumber(field.Value)
+		}
+	}
+	for _, tag := range inlineTags(body) {
+		addTag(tag)
+	}
+	meta.Words = countWords(body)
+	return meta
+}
+
+// --sort frontmatter:字段 中的字段名，按其他方式排序时为空
+func sortField() string {
+	field, _ := strings.CutPrefix(config.Sort, "frontmatter:")
+	if field == config.Sort {
+		return ""
+	}
+	return strings.TrimSpace(field)
+}
+
+// 将 frontmatter 属性值转换为数字，YAML、TOML、JSON 中的整数、小数和数字字符串都可以，其他值返回 nil
+func frontmatterNumber(value any) *float64 {
+	var n float64
+	switch v := value.(type) {
+	case int:
+		n = float64(v)
+	case int64:
+		n = float64(v)
+	case uint64:
+		n = float64(v)
+	case float64:
+		n = v
+	case string:
+		f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		if err != nil {
+			return nil
+		}
+		n = f
+	default:
+		return nil
+	}
+	return &n
+}
+
+// 判断 frontmatter 属性是否为 --index-marker 指定的索引标记
+// 标记为 key=value 时属性值（或列表中的某一项）等于 value 即匹配，只有 key 时属性值为 true 即匹配
+func matchIndexMarker(field frontmatterField) bool {
+	if config.IndexMarker == "" {
+		return false
+	}
+	key, value, hasValue := strings.Cut(config.IndexMarker, "=")
+	if field.Key != strings.TrimSpace(key) {
+		return false
+	}
+	if !hasValue {
+		return field.Value == true
+	}
+	for _, item := range frontmatterList(field.Value) {
+		if strings.EqualFold(fmt.Sprint(item), strings.TrimSpace(value)) {
+			return true
+		}
+	}
+	return false
+}
+
+// 统计字数：中日韩文字每个字计一个，其他文字按连续的字母和数字计为一个词，标点和 markdown 符号不计
+func countWords(body []byte) int {
+	count := 0
+	inWord := false
+	for _, r := range string(body) {
+		switch {
+		case unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul):
+			count++
+			inWord = false
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			if !inWord {
+				count++
+				inWord = true
+			}
+		default:
+			inWord = false
+		}
+	}
+	return count
+}
+
+// 拆分 frontmatter 中字符串形式的标签，与 Obsidian 一致可以用逗号或空格分隔，# 前缀可省略
+func splitTags(value string) []string {
+	var tags []string
+	for _, tag := range strings.FieldsFunc(value, func(r rune) bool { return r == ',' || r == ' ' }) {
+		if tag = strings.TrimPrefix(tag, "#"); tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+// frontmatter 中的列表值按元素返回，单个值视为只有一个元素的列表
+func frontmatterList(value any) []any {
+	if list, ok := value.([]any); ok {
+		return list
+	}
+	return []any{value}
+}
+
+// 匹配正文中的 #标签：# 前为行首或空白，标签由字母、数字、_、-、/ 组成，且不能全是数字
+var hashtagPattern = regexp.MustCompile(`(^|\s)#([\p{L}\p{N}_/-]*[\p{L}_/-][\p{L}\p{N}_/-]*)`)
+
+// markdown 行内链接 [文字](地址)
+var markdownLinkPattern = regexp.MustCompile(`\[[^\]]*\]\([^)]*\)`)
+
+// 提取 markdown 正文中的标签，跳过代码块和行内代码
+func inlineTags(body []byte) []string {
+	var tags []string
+	fence := ""
+	for _, line := range strings.Split(string(body), "\n") {
+		trimmed := strings.TrimSpace(line)
+		if fence != "" {
+			if strings.HasPrefix(trimmed, fence) {
+				fence = ""
+			}
+			continue
+		}
+		if strings.HasPrefix(trimmed, "```") || strings.HasPrefix(trimmed, "~~~") {
+			fence = trimmed[:3]
+			continue
+		}
+		// 链接文字中的 # 不是标签，与渲染时跳过 <a> 一致
+		line = inlineCodePattern.ReplaceAllString(line, "")
+		line = markdownLinkPattern.ReplaceAllString(line, "")
+		for _, match := range hashtagPattern.FindAllStringSubmatch(line, -1) {
+			tags = append(tags, match[2])
+		}
+	}
+	return tags
+}
+
+// 将正文中的 #标签 渲染为可点击的标签，点击后在侧边栏中按标签筛选
+// 代码和链接中的内容不处理
+func processTags(htmlContent string) string {
+	return replaceInTextSkipping(htmlContent, tagSkippedTextTags, func(text string) string {
+		return hashtagPattern.ReplaceAllStringFunc(text, func(match string) string {
+			sub := hashtagPattern.FindStringSubmatch(match)
+			return sub[1] + renderTag(sub[2])
+		})
+	})
+}
+
+var tagSkippedTextTags = append([]string{"a"}, skippedTextTags...)
+
+func renderTag(tag string) string {
+	return `<a href="#" class="tag" data-tag="` + gohtml.EscapeString(tag) + `">#` + gohtml.EscapeString(tag) + `</a>`
+}
+
+// 将 frontmatter 渲染为属性面板
+// frontmatter 中 banner 或 cover 属性指定的题图，显示在笔记顶部
+// 值可以是相对于笔记或库根目录的路径、网址，或 Obsidian 属性中的 "[[图片.png]]"，图片地址的处理与正文中的图片相同
+func noteBanner(fields []frontmatterField, filePath string) string {
+	for _, field := range fields {
+		if field.Key != "banner" && field.Key != "cover" {
+			continue
+		}
+		src := frontmatterImage(field.Value, filePath)
+		if src == "" {
+			continue
+		}
+		tag := fixImagePaths(`<img src="`+gohtml.EscapeString(src)+`" alt="">`, filePath)
+		return strings.Replace(tag, ` class="preview-image"`, ` class="banner preview-image"`, 1)
+	}
+	return ""
+}
+
+// 题图属性的图片地址，路径和 [[图片]] 都按 wikilink 的规则查找附件（相对于笔记、库内路径、文件名）
+func frontmatterImage(value any, filePath string) string {
+	var target string
+	switch v := value.(type) {
+	case string:
+		target = strings.TrimSpace(v)
+	case []any:
+		// 未加引号的 [[图片.png]] 被 YAML 解析为嵌套列表
+		if len(v) == 1 {
+			if inner, ok := v[0].([]any); ok && len(inner) == 1 {
+				if name, ok := inner[0].(string); ok {
+					target = "[[" + strings.TrimSpace(name) + "]]"
+				}
+			}
+		}
+	}
+
+	if inner := strings.TrimPrefix(target, "!"); strings.HasPrefix(inner, "[[") && strings.HasSuffix(inner, "]]") {
+		target, _, _ = strings.Cut(strings.TrimSuffix(strings.TrimPrefix(inner, "[["), "]]"), "|")
+		target = strings.TrimSpace(target)
+	}
+	if target == "" || strings.Contains(target, "://") || strings.HasPrefix(target, "data:") {
+		return target
+	}
+	if path, ok := resolveAsset(target, noteDir(filePath)); ok {
+		return assetURL(path)
+	}
+	return target
+}
+
+func renderFrontmatter(fields []frontmatterField) string {
+	if len(fields) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteString(`<table class="frontmatter">`)
+	for _, field := range fields {
+		b.WriteString(`<tr><th>` + gohtml.EscapeString(field.Key) + `</th><td>`)
+		if field.Key == "tags" || field.Key == "tag" {
+			b.WriteString(formatFrontmatterTags(field.Value))
+		} else {
+			b.WriteString(formatFrontmatterValue(field.Value))
+		}
+		b.WriteString(`</td></tr>`)
+	}
+	b.WriteString(`</table>`)
+	return b.String()
+}
+
+// frontmatter 中的标签同样渲染为可点击的标签
+func formatFrontmatterTags(value any) string {
+	var items []string
+	for _, item := range frontmatterList(value) {
+		tag, ok := item.(string)
+		if !ok {
+			items = append(items, formatFrontmatterValue(item))
+			continue
+		}
+		for _, t := range splitTags(tag) {
+			items = append(items, renderTag(t))
+		}
+	}
+	return strings.Join(items, " ")
+}
+
+func formatFrontmatterValue(value any) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case []any:
+		var items []string
+		for _, item := range v {
+			items = append(items, `<span class="frontmatter-item">`+formatFrontmatterValue(item)+`</span>`)
+		}
+		return strings.Join(items, " ")
+	case []map[string]any:
+		items := make([]any, len(v))
+		for i, item := range v {
+			items[i] = item
+		}
+		return formatFrontmatterValue(items)
+	case map[string]any:
+		data, _ := json.Marshal(v)
+		return `<code>` + gohtml.EscapeString(string(data)) + `</code>`
+	case time.Time:
+		if v.Hour() == 0 && v.Minute() == 0 && v.Second() == 0 {
+			return v.Format("2006-01-02")
+		}
+		return v.Format("2006-01-02 15:04:05")
+	default:
+		return gohtml.EscapeString(fmt.Sprint(v))
+	}
+}
+
+var sanitizer *bluemonday.Policy
+var sanitizerOnce sync.Once
+
+// 笔记 HTML 的安全策略：在 UGC 策略基础上保留 markdown 渲染需要的属性
+func sanitizePolicy() *bluemonday.Policy {
+	sanitizerOnce.Do(func() {
+		p := bluemonday.UGCPolicy()
+		allowMarkdownAttrs(p)
+		sanitizer = p
+	})
+	return sanitizer
+}
+
+// markdown 渲染结果中需要保留的属性
+func allowMarkdownAttrs(p *bluemonday.Policy) {
+	p.AllowAttrs("class").Matching(regexp.MustCompile(`^language-[\w+#.-]+$`)).OnElements("code")
+	// 代码高亮生成的 class
+	p.AllowAttrs("class").Matching(regexp.MustCompile(`^chroma$`)).OnElements("pre")
+	p.AllowAttrs("class").Matching(regexp.MustCompile(`^[a-z0-9]+$`)).OnElements("span")
+	p.AllowAttrs("id").OnElements("h1", "h2", "h3", "h4", "h5", "h6")
+	p.AllowAttrs("type").Matching(regexp.MustCompile(`^checkbox$`)).OnElements("input")
+	p.AllowAttrs("checked", "disabled").OnElements("input")
+	p.AllowAttrs("align").Matching(regexp.MustCompile(`^(left|center|right)$`)).OnElements("th", "td")
+	p.AllowAttrs("style").Matching(regexp.MustCompile(`^text-align:\s*(left|center|right);?$`)).OnElements("th", "td")
+}
+
+var allowHTMLSanitizer *bluemonday.Policy
+var allowHTMLOnce sync.Once
+
+// --allow-html 的过滤策略：保留 markdown 本身会生成的元素，以及白名单中的标签
+func allowHTMLPolicy() *bluemonday.Policy {
+	allowHTMLOnce.Do(func() {
+		p := bluemonday.NewPolicy()
+		p.AllowStandardURLs()
+		p.AllowElements("p", "br", "hr", "h1", "h2", "h3", "h4", "h5", "h6", "blockquote", "pre", "code",
+			"em", "strong", "del", "ul", "ol", "li", "dl", "dt", "dd", "input",
+			"table", "thead", "tbody", "tr", "th", "td")
+		p.AllowAttrs("href", "title").OnElements("a")
+		p.AllowAttrs("src", "alt", "title", "width", "height").OnElements("img")
+		p.AllowAttrs("start").OnElements("ol")
+		allowMarkdownAttrs(p)
+
+		p.AllowElements(config.HTMLTags...)
+		p.AllowAttrs("title").OnElements(config.HTMLTags...)
+		p.AllowAttrs("open").OnElements("details")
+		allowHTMLSanitizer = p
+	})
+	return allowHTMLSanitizer
+}
+
+// 为库内图片的 URL 加上修改时间作为版本参数，图片修改后浏览器会重新请求而不是使用缓存
+// path 是 URL 中对应的库内路径（可能经过转义），文件不存在时原样返回
+func versionedImageURL(src, path string) string {
+	if unescaped, err := url.PathUnescape(path); err == nil {
+		path = unescaped
+	}
+	info, err := os.Stat(filepath.FromSlash(path))
+	if err != nil || info.IsDir() || strings.Contains(src, "?") {
+		return src
+	}
+	return fmt.Sprintf("%s?v=%d", src, info.ModTime().UnixNano())
+}
+
+// 修复 markdown 中的图片路径
+func fixImagePaths(htmlContent, mdFilePath string) string {
+	// 获取 markdown 文件所在目录（相对于根目录）
+	mdDir := filepath.Dir(mdFilePath)
+	if mdDir == "." {
+		mdDir = ""
+	}
+
+	// 使用更安全的方式处理图片标签
+	var result strings.Builder
+	content := htmlContent
+	processed := 0
+	maxIterations := 1000
+
+	for processed < maxIterations {
+		start := strings.Index(content, `<img src="`)
+		if start == -1 {
+			result.WriteString(content)
+			break
+		}
+
+		result.WriteString(content[:start])
+
+		start += len(`<img src="`)
+		end := strings.Index(content[start:], `"`)
+		if end == -1 {
+			result.WriteString(content[start-len(`<img src="`):])
+			break
+		}
+
+		imgPath := content[start : start+end]
+		tagEnd := strings.Index(content[start+end:], `>`)
+		if tagEnd == -1 {
+			result.WriteString(content[start-len(`<img src="`):])
+			break
+		}
+
+		originalImgTag := content[start-len(`<img src="`) : start+end+tagEnd+1]
+
+		// 检查是否已经处理过
+		if strings.Contains(originalImgTag, `onclick="openImageModal`) {
+			result.WriteString(originalImgTag)
+			content = content[start+end+tagEnd+1:]
+			continue
+		}
+
+		// 处理相对路径，笔记中 Windows 风格的 \ 分隔符同样支持
+		if linkPath := strings.ReplaceAll(imgPath, "\\", "/"); !strings.HasPrefix(linkPath, "/") && !strings.HasPrefix(imgPath, "http://") && !strings.HasPrefix(imgPath, "https://") && !strings.HasPrefix(imgPath, "data:") {
+			var fullPath string
+			if strings.HasPrefix(linkPath, "../") || strings.HasPrefix(linkPath, "./") {
+				fullPath = filepath.Join(mdDir, linkPath)
+			} else if mdDir != "" {
+				fullPath = filepath.Join(mdDir, linkPath)
+			} else {
+				fullPath = linkPath
+			}
+
+			fullPath = slashPath(filepath.Clean(fullPath))
+			if strings.HasPrefix(fullPath, "/") {
+				fullPath = fullPath[1:]
+			}
+
+			// 大小写不敏感的文件系统上链接可能与实际大小写不一致，使用磁盘上的路径
+			// 相对路径找不到时再到附件文件夹中查找
+			if _, err := os.Stat(fullPath); err != nil {
+				if path, ok := resolveAsset(fullPath, ""); ok && foldPath(path) == foldPath(fullPath) {
+					fullPath = slashPath(path)
+				} else if candidate := attachmentPath(linkPath, mdDir); candidate != "" {
+					if path, ok := resolveAsset(candidate, ""); ok && foldPath(path) == foldPath(candidate) {
+						fullPath = slashPath(path)
+					}
+				}
+			}
+
+			// 转换为相对路径（用于静态文件服务）
+			newTag := strings.Replace(originalImgTag, `src="`+imgPath+`"`, `src="`+versionedImageURL(fullPath, fullPath)+`" class="preview-image" onclick="openImageModal(this.src)"`, 1)
+			result.WriteString(newTag)
+		} else {
+			// 以 / 开头的路径指向库根目录，部署在子路径下时加上前缀（assetURL 生成的地址已经带有前缀）
+			if strings.HasPrefix(imgPath, "/") && !strings.HasPrefix(imgPath, "//") {
+				src := imgPath
+				if config.BasePath == "" || !strings.HasPrefix(imgPath, config.BasePath+"/") {
+					src = config.BasePath + imgPath
+				}
+				vaultPath := strings.TrimPrefix(strings.TrimPrefix(src, config.BasePath), "/")
+				originalImgTag = strings.Replace(originalImgTag, `src="`+imgPath+`"`, `src="`+versionedImageURL(src, vaultPath)+`"`, 1)
+			}
+			beforeClose := originalImgTag[:len(originalImgTag)-1]
+			newTag := beforeClose + ` class="preview-image" onclick="openImageModal(this.src)">`
+			result.WriteString(newTag)
+		}
+
+		content = content[start+end+tagEnd+1:]
+		processed++
+	}
+
+	if processed >= maxIterations {
+		return htmlContent
+	}
+
+	return result.String()
+}
+
+// 对 HTML 中的文本内容应用替换函数，跳过标签本身以及 code/pre 等元素内部
+func replaceInText(htmlContent string, fn func(string) string) string {
+	return replaceInTextSkipping(htmlContent, skippedTextTags, fn)
+}
+
+// 同 replaceInText，skipped 为内部文本不做替换的元素
+func replaceInTextSkipping(htmlContent string, skipped []string, fn func(string) string) string {
+	var result strings.Builder
+	i := 0
+	for i < len(htmlContent) {
+		lt := strings.IndexByte(htmlContent[i:], '<')
+		if lt == -1 {
+			result.WriteString(fn(htmlContent[i:]))
+			break
+		}
+		result.WriteString(fn(htmlContent[i : i+lt]))
+		i += lt
+
+		gt := strings.IndexByte(htmlContent[i:], '>')
+		if gt == -1 {
+			result.WriteString(htmlContent[i:])
+			break
+		}
+		tag := htmlContent[i : i+gt+1]
+		result.WriteString(tag)
+		i += gt + 1
+
+		if name := skippedTagName(tag, skipped); name != "" {
+			end := strings.Index(htmlContent[i:], "</"+name+">")
+			if end == -1 {
+				result.WriteString(htmlContent[i:])
+				break
+			}
+			result.WriteString(htmlContent[i : i+end])
+			i += end
+		}
+	}
+	return result.String()
+}
+
+// 内部文本不做替换的元素
+var skippedTextTags = []string{"code", "pre", "script", "style"}
+
+func skippedTagName(tag string, skipped []string) string {
+	for _, name := range skipped {
+		if strings.HasPrefix(tag, "<"+name+">") || strings.HasPrefix(tag, "<"+name+" ") {
+			return name
+		}
+	}
+	return ""
+}
+
+// 处理 [[wikilink]] 和 ![[附件嵌入]]
+func processWikiLinks(htmlContent, mdFilePath string) string {
+	return replaceInText(htmlContent, func(text string) string {
+		var result strings.Builder
+		for {
+			start := strings.Index(text, "[[")
+			if start == -1 {
+				result.WriteString(text)
+				break
+			}
+			end := strings.Index(text[start+2:], "]]")
+			if end == -1 {
+				result.WriteString(text)
+				break
+			}
+
+			inner := gohtml.UnescapeString(text[start+2 : start+2+end])
+			embed := start > 0 && text[start-1] == '!'
+			if embed {
+				result.WriteString(text[:start-1])
+			} else {
+				result.WriteString(text[:start])
+			}
+			result.WriteString(renderWikiLink(inner, embed, mdFilePath))
+			text = text[start+2+end+2:]
+		}
+		return result.String()
+	})
+}
+
+// 渲染单个 wikilink，inner 为 [[ ]] 内的原始文本
+func renderWikiLink(inner string, embed bool, mdFilePath string) string {
+	target, alias, hasAlias := strings.Cut(inner, "|")
+	target = strings.TrimSpace(target)
+	alias = strings.TrimSpace(alias)
+	notePart, heading, _ := strings.Cut(target, "#")
+	mdDir := noteDir(mdFilePath)
+
+	// 附件（图片）
+	if path, ok := resolveAsset(notePart, mdDir); ok {
+		src := gohtml.EscapeString(assetURL(path))
+		if embed {
+			attrs := ` alt="` + gohtml.EscapeString(filepath.Base(path)) + `"`
+			// ![[image.png|300]] 指定宽度，![[image.png|300x200]] 同时指定高度，
+			// 省略的一边不输出属性
+			if hasAlias && alias != "" && strings.Trim(alias, "0123456789x") == "" {
+				width, height, _ := strings.Cut(alias, "x")
+				if width != "" {
+					attrs += ` width="` + width + `"`
+				}
+				if height != "" && !strings.Contains(height, "x") {
+					attrs += ` height="` + height + `"`
+				}
+			}
+			return `<img src="` + src + `"` + attrs + `>`
+		}
+		display := target
+		if hasAlias && alias != "" {
+			display = alias
+		}
+		return `<a href="` + src + `">` + gohtml.EscapeString(display) + `</a>`
+	}
+
+	display := target
+	if hasAlias && alias != "" {
+		display = alias
+	} else if heading != "" && notePart != "" {
+		display = notePart + " > " + heading
+	} else if heading != "" {
+		display = heading
+	}
+
+	notePath := mdFilePath
+	found := true
+	if notePart != "" {
+		notePath, found = resolveNote(notePart)
+	}
+	// 没有同名笔记时匹配文件夹：有文件夹笔记时打开该笔记，否则在文件树中展开文件夹
+	if !found {
+		if folder, folderNote, ok := resolveFolder(notePart); ok {
+			if folderNote == "" {
+				return `<a href="#" class="wikilink folder-link" data-folder="` + gohtml.EscapeString(folder) +
+					`" title="在文件树中显示文件夹">` + gohtml.EscapeString(display) + `</a>`
+			}
+			notePath, found = folderNote, true
+		}
+	}
+	if !found {
+		return `<a class="wikilink broken" title="笔记不存在">` + gohtml.EscapeString(display) + `</a>`
+	}
+
+	return `<a href="#" class="wikilink" data-path="` + gohtml.EscapeString(notePath) +
+		`" data-heading="` + gohtml.EscapeString(heading) + `">` + gohtml.EscapeString(display) + `</a>`
+}
+
+// 匹配 callout 引用块的第一行：> [!type]+/- 标题
+var calloutPattern = regexp.MustCompile(`<blockquote>\s*<p>\[!([\w-]+)\]([+-]?)[ \t]*`)
+
+var lineBreakPattern = regexp.MustCompile(`<br\s*/?>`)
+
+// 内置的 callout 图标，类型与 Obsidian 一致，default 用于未知类型
+var defaultCalloutIcons = map[string]string{
+	"note":      "📝",
+	"abstract":  "📋",
+	"summary":   "📋",
+	"tldr":      "📋",
+	"info":      "ℹ️",
+	"todo":      "☑️",
+	"tip":       "💡",
+	"hint":      "💡",
+	"important": "💡",
+	"success":   "✅",
+	"check":     "✅",
+	"done":      "✅",
+	"question":  "❓",
+	"help":      "❓",
+	"faq":       "❓",
+	"warning":   "⚠️",
+	"caution":   "⚠️",
+	"attention": "⚠️",
+	"failure":   "❌",
+	"fail":      "❌",
+	"missing":   "❌",
+	"danger":    "⚡",
+	"error":     "⚡",
+	"bug":       "🐞",
+	"example":   "📑",
+	"quote":     "💬",
+	"cite":      "💬",
+	"default":   "📌",
+}
+
+// 返回 callout 标题前的图标 HTML，配置中的图标优先于内置图标，图标为空时不显示
+func calloutIcon(kind string) string {
+	icon, ok := config.CalloutIcons[kind]
+	if !ok {
+		icon, ok = defaultCalloutIcons[kind]
+	}
+	if !ok {
+		if icon, ok = config.CalloutIcons["default"]; !ok {
+			icon = defaultCalloutIcons["default"]
+		}
+	}
+	if icon == "" {
+		return ""
+	}
+	// SVG 来自用户自己的配置，原样插入；其他内容按文本处理
+	if !strings.HasPrefix(strings.ToLower(icon), "<svg") {
+		icon = gohtml.EscapeString(icon)
+	}
+	return `<span class="callout-icon" aria-hidden="true">` + icon + `</span>`
+}
+
+// 将 Obsidian callout（以 [!type] 开头的引用块）转换为带标题的提示块
+// 标记了 + 或 - 的 callout 使用 <details> 渲染，可以折叠，- 表示默认折叠
+func processCallouts(htmlContent string) string {
+	var result strings.Builder
+	content := htmlContent
+	for {
+		loc := calloutPattern.FindStringSubmatchIndex(content)
+		if loc == nil {
+			break
+		}
+		end := matchingTagEnd(content, loc[0], "blockquote")
+		if end == -1 {
+			break
+		}
+
+		kind := strings.ToLower(content[loc[2]:loc[3]])
+		fold := content[loc[4]:loc[5]]
+		inner := content[loc[1] : end-len("</blockquote>")]
+
+		// 第一行剩余部分是标题，之后的内容是正文
+		var title, body string
+		if i := strings.Index(inner, "</p>"); i != -1 {
+			title = inner[:i]
+			body = inner[i+len("</p>"):]
+			// 经过 HTML 过滤后换行标签为 <br/>
+			if loc := lineBreakPattern.FindStringIndex(title); loc != nil {
+				body = "<p>" + strings.TrimLeft(title[loc[1]:], "\n") + "</p>" + body
+				title = title[:loc[0]]
+			}
+		}
+		title = strings.TrimSpace(title)
+		if title == "" {
+			title = strings.ToUpper(kind[:1]) + kind[1:]
+		}
+		title = calloutIcon(kind) + title
+		body = strings.TrimSpace(processCallouts(body))
+
+		result.WriteString(content[:loc[0]])
+		attrs := ` class="callout" data-callout="` + gohtml.EscapeString(kind) + `"`
+		if fold == "" {
+			result.WriteString(`<div` + attrs + `><div class="callout-title">` + title + `</div>`)
+			result.WriteString(`<div class="callout-content">` + body + `</div></div>`)
+		} else {
+			if fold == "+" {
+				attrs += ` open="open"`
+			}
+			result.WriteString(`<details` + attrs + `><summary class="callout-title">` + title + `</summary>`)
+			result.WriteString(`<div class="callout-content">` + body + `</div></details>`)
+		}
+		content = content[end:]
+	}
+	result.WriteString(content)
+	return result.String()
+}
+
+// 返回从 start 处开始的 <tag> 对应的结束标签之后的位置，支持嵌套
+func matchingTagEnd(content string, start int, tag string) int {
+	open, end := "<"+tag, "</"+tag+">"
+	depth := 0
+	for i := start; i < len(content); {
+		next := strings.IndexByte(content[i:], '<')
+		if next == -1 {
+			return -1
+		}
+		i += next
+		switch {
+		case strings.HasPrefix(content[i:], open) && len(content) > i+len(open) && strings.ContainsRune("> ", rune(content[i+len(open)])):
+			depth++
+		case strings.HasPrefix(content[i:], end):
+			depth--
+			if depth == 0 {
+				return i + len(end)
+			}
+		}
+		i++
+	}
+	return -1
+}
+
+// 将表格放进可以横向滚动的容器中，表头在容器内纵向滚动时保持可见
+func wrapTables(htmlContent string) string {
+	var result strings.Builder
+	content := htmlContent
+	for {
+		start := strings.Index(content, "<table>")
+		if start == -1 {
+			break
+		}
+		end := matchingTagEnd(content, start, "table")
+		if end == -1 {
+			break
+		}
+		result.WriteString(content[:start])
+		result.WriteString(`<div class="table-wrapper">` + content[start:end] + `</div>`)
+		content = content[end:]
+	}
+	result.WriteString(content)
+	return result.String()
+}
+
+// 行内代码可以使用的语言前缀，值为显示名称和标记颜色
+type inlineCodeLanguage struct {
+	name  string
+	color string
+}
+
+var inlineCodeLanguages = map[string]inlineCodeLanguage{
+	"js":     {"JavaScript", "#f1e05a"},
+	"ts":     {"TypeScript", "#3178c6"},
+	"py":     {"Python", "#3572a5"},
+	"go":     {"Go", "#00add8"},
+	"rust":   {"Rust", "#dea584"},
+	"java":   {"Java", "#b07219"},
+	"c":      {"C", "#555555"},
+	"cpp":    {"C++", "#f34b7d"},
+	"cs":     {"C#", "#178600"},
+	"rb":     {"Ruby", "#701516"},
+	"php":    {"PHP", "#4f5d95"},
+	"swift":  {"Swift", "#f05138"},
+	"kotlin": {"Kotlin", "#a97bff"},
+	"lua":    {"Lua", "#000080"},
+	"sh":     {"Shell", "#89e051"},
+	"sql":    {"SQL", "#e38c00"},
+	"html":   {"HTML", "#e34c26"},
+	"css":    {"CSS", "#663399"},
+	"json":   {"JSON", "#292929"},
+	"yaml":   {"YAML", "#cb171e"},
+}
+
+// 语言前缀的别名
+var inlineCodeLanguageAliases = map[string]string{
+	"javascript": "js",
+	"typescript": "ts",
+	"python":     "py",
+	"golang":     "go",
+	"rs":         "rust",
+	"c++":        "cpp",
+	"csharp":     "cs",
+	"ruby":       "rb",
+	"bash":       "sh",
+	"shell":      "sh",
+	"zsh":        "sh",
+	"yml":        "yaml",
+}
+
+// 开头带有语言前缀的行内代码，如 <code>js:foo()</code>
+var inlineCodeLangPattern = regexp.MustCompile(`<code>([A-Za-z][A-Za-z0-9+#]*):([^<]*)</code>`)
+
+// 去掉行内代码开头的 lang: 前缀，添加对应语言的 class 和颜色
+// 只处理已知的语言，http: 等其他前缀、路径和代码块保持原样
+func processInlineCodeLang(htmlContent string) string {
+	var result strings.Builder
+	last := 0
+	for _, m := range inlineCodeLangPattern.FindAllStringSubmatchIndex(htmlContent, -1) {
+		if strings.HasSuffix(htmlContent[:m[0]], "<pre>") {
+			continue
+		}
+		key := strings.ToLower(htmlContent[m[2]:m[3]])
+		if alias, ok := inlineCodeLanguageAliases[key]; ok {
+			key = alias
+		}
+		lang, ok := inlineCodeLanguages[key]
+		code := strings.TrimLeft(htmlContent[m[4]:m[5]], " ")
+		// C:\Windows 这样的路径不是语言前缀
+		if !ok || code == "" || strings.HasPrefix(code, "\\") || strings.HasPrefix(code, "/") {
+			continue
+		}
+		result.WriteString(htmlContent[last:m[0]])
+		fmt.Fprintf(&result, `<code class="inline-lang lang-%s" style="--code-lang: %s" title="%s">%s</code>`, key, lang.color, lang.name, code)
+		last = m[1]
+	}
+	result.WriteString(htmlContent[last:])
+	return result.String()
+}
+
+// 笔记所在目录，位于库根目录时为空，用于解析相对路径的附件
+func noteDir(mdFilePath string) string {
+	mdDir := filepath.Dir(mdFilePath)
+	if mdDir == "." {
+		return ""
+	}
+	return mdDir
+}
+
+// 判断 wikilink 能否解析到附件或笔记，规则与 renderWikiLink 相同
+func wikiLinkResolves(inner, mdFilePath string) bool {
+	target, _, _ := strings.Cut(inner, "|")
+	notePart, _, _ := strings.Cut(strings.TrimSpace(target), "#")
+	if notePart == "" {
+		return true
+	}
+	if _, ok := resolveAsset(notePart, noteDir(mdFilePath)); ok {
+		return true
+	}
+	if _, ok := resolveNote(notePart); ok {
+		return true
+	}
+	_, _, ok := resolveFolder(notePart)
+	return ok
+}
+
+// 无法解析的 wikilink
+type brokenLink struct {
+	Source string `json:"source"`
+	Line   int    `json:"line"`
+	Link   string `json:"link"`
+}
+
+// 匹配 wikilink 和附件嵌入
+var wikiLinkPattern = regexp.MustCompile(`!?\[\[([^\[\]]+)\]\]`)
+
+// 行内代码，其中的 [[...]] 不是链接
+var inlineCodePattern = regexp.MustCompile("`+[^`]*`+")
+
+// 检查所有笔记中的 wikilink，跳过代码块和行内代码
+func findBrokenLinks() ([]brokenLink, error) {
+	mu.RLock()
+	files := append([]string(nil), mdFiles...)
+	mu.RUnlock()
+
+	var broken []brokenLink
+	for _, filePath := range files {
+		if !isMarkdownNote(filePath) {
+			continue
+		}
+		content, _, err := readNoteFile(filePath)
+		if err != nil {
+			return nil, err
+		}
+		scanWikiLinks(content, func(line int, match []string) {
+			if !wikiLinkResolves(match[1], filePath) {
+				broken = append(broken, brokenLink{Source: filePath, Line: line, Link: match[0]})
+			}
+		})
+	}
+	return broken, nil
+}
+
+// 逐行查找笔记源码中的 wikilink 和嵌入，跳过代码块和行内代码
+// fn 的参数为行号（从 1 开始）和 wikiLinkPattern 的匹配结果
+func scanWikiLinks(content []byte, fn func(line int, match []string)) {
+	fence := ""
+	for i, line := range strings.Split(string(content), "\n") {
+		trimmed := strings.TrimSpace(line)
+		if fence != "" {
+			if strings.HasPrefix(trimmed, fence) {
+				fence = ""
+			}
+			continue
+		}
+		if strings.HasPrefix(trimmed, "```") || strings.HasPrefix(trimmed, "~~~") {
+			fence = trimmed[:3]
+			continue
+		}
+
+		line = inlineCodePattern.ReplaceAllString(line, "")
+		for _, match := range wikiLinkPattern.FindAllStringSubmatch(line, -1) {
+			fn(i+1, match)
+		}
+	}
+}
+
+// wikilink 指向的笔记，附件、无法解析的链接和只有标题的链接返回 false，规则与 renderWikiLink 相同
+func linkedNote(inner, mdFilePath string) (string, bool) {
+	target, _, _ := strings.Cut(inner, "|")
+	notePart, _, _ := strings.Cut(strings.TrimSpace(target), "#")
+	if notePart == "" {
+		return "", false
+	}
+	if _, ok := resolveAsset(notePart, noteDir(mdFilePath)); ok {
+		return "", false
+	}
+	return resolveNote(notePart)
+}
+
+// 输出链接检查报告：文本格式每行一个 "笔记:行号: 链接"，JSON 格式为数组
+func reportBrokenLinks(w io.Writer, broken []brokenLink, asJSON bool) error {
+	if asJSON {
+		if broken == nil {
+			broken = []brokenLink{}
+		}
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(broken)
+	}
+	for _, link := range broken {
+		if _, err := fmt.Fprintf(w, "%s:%d: %s\n", link.Source, link.Line, link.Link); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 处理 H~2~O 下标和 x^2^ 上标，代码和链接文字（如自动链接的网址中的 ~）不处理
+func processSubSup(htmlContent string) string {
+	return replaceInTextSkipping(htmlContent, tagSkippedTextTags, func(text string) string {
+		text = replaceDelimited(text, '~', "sub")
+		return replaceDelimited(text, '^', "sup")
+	})
+}
+
+// 将单个分隔符包围的内容替换为指定标签
+// 内容不能为空或包含空白，连续的分隔符（如删除线的 ~~）保持原样
+func replaceDelimited(text string, delim byte, tag string) string {
+	var result strings.Builder
+	for {
+		start := strings.IndexByte(text, delim)
+		if start == -1 {
+			break
+		}
+		if start+1 < len(text) && text[start+1] == delim {
+			run := start
+			for run < len(text) && text[run] == delim {
+				run++
+			}
+			result.WriteString(text[:run])
+			text = text[run:]
+			continue
+		}
+
+		end := strings.IndexByte(text[start+1:], delim)
+		if end == -1 {
+			break
+		}
+		inner := text[start+1 : start+1+end]
+		after := start + 1 + end + 1
+		if strings.ContainsAny(inner, " \t\r\n") || (after < len(text) && text[after] == delim) {
+			result.WriteString(text[:start+1])
+			text = text[start+1:]
+			continue
+		}
+
+		result.WriteString(text[:start])
+		result.WriteString("<" + tag + ">" + inner + "</" + tag + ">")
+		text = text[after:]
+	}
+	result.WriteString(text)
+	return result.String()
+}
+
+// 处理 Mermaid 代码块
+func processMermaidBlocks(htmlContent string) string {
+	content := htmlContent
+
+	// 匹配 <pre><code class="language-mermaid">...</code></pre>
+	for {
+		start := strings.Index(content, `<pre><code class="language-mermaid">`)
+		if start == -1 {
+			// 也尝试匹配不带 language- 的
+			start = strings.Index(content, `<pre><code class="mermaid">`)
+			if start == -1 {
+				break
+			}
+		}
+
+		// 找到代码块的结束位置
+		endTag := `</code></pre>`
+		end := strings.Index(content[start:], endTag)
+		if end == -1 {
+			break
+		}
+
+		end += start + len(endTag)
+
+		// 提取代码内容
+		codeStart := start + len(`<pre><code class="language-mermaid">`)
+		if strings.Contains(content[start:codeStart], `class="mermaid"`) {
+			codeStart = start + len(`<pre><code class="mermaid">`)
+		}
+		// 代码保持转义后的形式放入 div，Mermaid 读取时会自行解码实体；
+		// 在这里还原成 HTML 会让图表代码中的标签绕过 --sanitize
+		codeContent := strings.TrimSpace(content[codeStart : end-len(endTag)])
+
+		// 服务端渲染为 SVG，失败时回退为浏览器渲染的 Mermaid div
+		mermaidDiv := `<div class="mermaid">` + codeContent + `</div>`
+		if config.Mermaid == "server" {
+			if svg, ok := renderMermaidSVG(gohtml.UnescapeString(codeContent)); ok {
+				mermaidDiv = `<div class="mermaid-svg">` + svg + `</div>`
+			}
+		}
+		content = content[:start] + mermaidDiv + content[end:]
+	}
+
+	return content
+}
+
+// 服务端 Mermaid 渲染结果缓存，避免每次重新生成时都调用 mmdc。
+// 按最近使用淘汰，编辑图表时产生的旧版本不会一直占用内存
+const mermaidCacheSize = 256
+
+type mermaidCacheEntry struct {
+	key string
+	svg string
+}
+
+var mermaidCache = list.New()
+var mermaidCacheIndex = make(map[string]*list.Element)
+var mermaidMu sync.Mutex
+var mermaidCLIPath string
+var mermaidCLIOnce sync.Once
+
+// 使用 mmdc 将 Mermaid 代码渲染为 SVG
+func renderMermaidSVG(code string) (string, bool) {
+	mermaidCLIOnce.Do(func() {
+		path, err := exec.LookPath(config.MermaidCLI)
+		if err != nil {
+			slog.Warn("未找到 mermaid-cli，使用浏览器渲染 Mermaid", "mmdc", config.MermaidCLI)
+			return
+		}
+		mermaidCLIPath = path
+	})
+	if mermaidCLIPath == "" {
+		return "", false
+	}
+
+	sum := sha256.Sum256([]byte(code))
+	key := hex.EncodeToString(sum[:])
+	if svg, ok := mermaidCacheGet(key); ok {
+		return svg, true
+	}
+
+	tmpDir, err := os.MkdirTemp("", "obsidian-preview-mermaid")
+	if err != nil {
+		slog.Error("创建临时目录错误", "error", err)
+		return "", false
+	}
+	defer os.RemoveAll(tmpDir)
+
+	input := filepath.Join(tmpDir, "diagram.mmd")
+	output := filepath.Join(tmpDir, "diagram.svg")
+	if err := os.WriteFile(input, []byte(code), 0644); err != nil {
+		slog.Error("写入 Mermaid 临时文件错误", "error", err)
+		return "", false
 	}
 
-	return result.String()
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	// 每个图表使用独立的 SVG id，避免多个内联 SVG 的样式互相影响
+	cmd := exec.CommandContext(ctx, mermaidCLIPath, "-i", input, "-o", output,
+		"-t", mermaidTheme(themes[config.Theme]), "-b", "transparent", "--svgId", "mermaid-"+key[:12])
+	if out, err := cmd.CombinedOutput(); err != nil {
+		slog.Warn("mmdc 渲染失败，使用浏览器渲染", "error", err, "output", strings.TrimSpace(string(out)))
+		return "", false
+	}
+
+	data, err := os.ReadFile(output)
+	if err != nil {
+		slog.Error("读取 Mermaid SVG 错误", "error", err)
+		return "", false
+	}
+	svg := string(data)
+	if i := strings.Index(svg, "<svg"); i > 0 {
+		svg = svg[i:]
+	}
+
+	mermaidCachePut(key, svg)
+	return svg, true
 }
 
-// 处理 Mermaid 代码块
-func processMermaidBlocks(htmlContent string) string {
-	content := htmlContent
+// 读取缓存的 SVG，并标记为最近使用
+func mermaidCacheGet(key string) (string, bool) {
+	mermaidMu.Lock()
+	defer mermaidMu.Unlock()
+	elem, ok := mermaidCacheIndex[key]
+	if !ok {
+		return "", false
+	}
+	mermaidCache.MoveToFront(elem)
+	return elem.Value.(*mermaidCacheEntry).svg, true
+}
 
-	// 匹配 <pre><code class="language-mermaid">...</code></pre>
-	for {
-		start := strings.Index(content, `<pre><code class="language-mermaid">`)
-		if start == -1 {
-			// 也尝试匹配不带 language- 的
-			start = strings.Index(content, `<pre><code class="mermaid">`)
-			if start == -1 {
-				break
-			}
-		}
+// 写入缓存，超出容量时淘汰最久未使用的条目
+func mermaidCachePut(key, svg string) {
+	mermaidMu.Lock()
+	defer mermaidMu.Unlock()
+	if elem, ok := mermaidCacheIndex[key]; ok {
+		elem.Value.(*mermaidCacheEntry).svg = svg
+		mermaidCache.MoveToFront(elem)
+		return
+	}
+	mermaidCacheIndex[key] = mermaidCache.PushFront(&mermaidCacheEntry{key: key, svg: svg})
+	for mermaidCache.Len() > mermaidCacheSize {
+		oldest := mermaidCache.Back()
+		mermaidCache.Remove(oldest)
+		delete(mermaidCacheIndex, oldest.Value.(*mermaidCacheEntry).key)
+	}
+}
 
-		// 找到代码块的结束位置
-		endTag := `</code></pre>`
-		end := strings.Index(content[start:], endTag)
-		if end == -1 {
-			break
-		}
+// 读取并渲染所有 markdown 文件
+func renderAllFiles() map[string]*RenderedFile {
+	mu.RLock()
+	files := append([]string(nil), mdFiles...)
+	mu.RUnlock()
 
-		end += start + len(endTag)
+	rendered := make(map[string]*RenderedFile, len(files))
+	total := len(files)
+	for i, filePath := range files {
+		if (i+1)%10 == 0 || i == 0 {
+			slog.Info("正在处理文件", "progress", fmt.Sprintf("%d/%d", i+1, total), "path", filePath)
+		}
+		renderProgress.Lock()
+		renderProgress.done, renderProgress.total = i, total
+		renderProgress.Unlock()
+
+		rf := &RenderedFile{}
+		if info, err := os.Stat(filePath); err == nil {
+			rf.Size = info.Size()
+			rf.ModTime = info.ModTime()
+		}
 
-		// 提取代码内容
-		codeStart := start + len(`<pre><code class="language-mermaid">`)
-		if strings.Contains(content[start:codeStart], `class="mermaid"`) {
-			codeStart = start + len(`<pre><code class="mermaid">`)
+		start := time.Now()
+		htmlContent, err := withRenderTimeout(func() (string, error) {
+			return renderMarkdownFile(filePath)
+		})
+		metrics.observeRender(time.Since(start), err)
+		if err != nil {
+			slog.Warn("渲染笔记失败", "path", filePath, "error", err)
+			rf.HTML = fmt.Sprintf("<p>渲染错误: %v</p>", err)
+			rf.Error = err.Error()
+		} else {
+			rf.HTML = htmlContent
 		}
-		codeContent := content[codeStart : end-len(endTag)]
+		rendered[filePath] = rf
+	}
+	return rendered
+}
 
-		// 清理代码内容（移除 HTML 实体）
-		codeContent = strings.ReplaceAll(codeContent, "&lt;", "<")
-		codeContent = strings.ReplaceAll(codeContent, "&gt;", ">")
-		codeContent = strings.ReplaceAll(codeContent, "&amp;", "&")
-		codeContent = strings.TrimSpace(codeContent)
+// 将文件树和所有渲染结果导出为 JSON 文件
+func dumpJSON(outputFile string, pretty bool) error {
+	files := renderAllFiles()
 
-		// 替换为 Mermaid div
-		mermaidDiv := `<div class="mermaid">` + codeContent + `</div>`
-		content = content[:start] + mermaidDiv + content[end:]
+	mu.RLock()
+	data := struct {
+		Tree  []*FileNode              `json:"tree"`
+		Files map[string]*RenderedFile `json:"files"`
+	}{
+		Tree:  fileTree.Children,
+		Files: files,
+	}
+	var out []byte
+	var err error
+	if pretty {
+		out, err = json.MarshalIndent(data, "", "  ")
+	} else {
+		out, err = json.Marshal(data)
+	}
+	mu.RUnlock()
+	if err != nil {
+		return err
 	}
 
-	return content
+	return os.WriteFile(outputFile, out, 0644)
 }
 
-func generateHTML(outputFile string) error {
+// 导出静态站点：预览页面、笔记库中的图片和离线缓存用的 service worker
+// 页面中的图片地址以 / 开头，站点需要部署在域名根路径，或通过 --base-path 指定部署的子路径
+func exportSite(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	page, err := renderPage(true)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(dir, "index.html"), page, 0644); err != nil {
+		return err
+	}
+
 	mu.RLock()
-	treeJSON, err := json.Marshal(fileTree.Children)
+	assets := append([]string(nil), assetFiles...)
 	mu.RUnlock()
+
+	// 缓存名称随页面和图片的内容变化，重新导出后浏览器会丢弃旧缓存
+	hash := sha256.New()
+	hash.Write(page)
+	urls := []string{"./", "index.html"}
+	for _, asset := range assets {
+		info, err := copyFile(asset, filepath.Join(dir, asset))
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(hash, "%s %d %d\n", asset, info.Size(), info.ModTime().UnixNano())
+		urls = append(urls, strings.TrimPrefix(assetURL(asset), config.BasePath+"/"))
+	}
+
+	urlsJSON, err := json.Marshal(urls)
 	if err != nil {
 		return err
 	}
+	script := fmt.Sprintf(serviceWorkerScript, hex.EncodeToString(hash.Sum(nil))[:16], urlsJSON, mermaidScript())
+	return os.WriteFile(filepath.Join(dir, "sw.js"), []byte(script), 0644)
+}
 
-	// 读取并渲染所有 markdown 文件
-	filesData := make(map[string]string)
-	total := len(mdFiles)
-	for i, filePath := range mdFiles {
-		if (i+1)%10 == 0 || i == 0 {
-			fmt.Printf("正在处理文件 %d/%d: %s\n", i+1, total, filePath)
-		}
+// 复制文件并保留修改时间，返回源文件的信息
+func copyFile(src, dst string) (os.FileInfo, error) {
+	info, err := os.Stat(src)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(src)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(dst, data, 0644); err != nil {
+		return nil, err
+	}
+	return info, os.Chtimes(dst, info.ModTime(), info.ModTime())
+}
 
-		htmlContent, err := renderMarkdownFile(filePath)
+// 生成静态站点：每篇笔记输出为单独的页面，wikilink 改为指向对应页面的相对链接，
+// 引用的图片等附件复制到站点中相同的位置
+func buildSite(dir string) error {
+	rendered := renderAllFiles()
+	assets := assetSet()
+
+	copied := make(map[string]bool)
+	for path, rf := range rendered {
+		page := sitePagePath(path)
+		content, err := rewriteAssetURLs(rf.HTML, assets, func(asset string) (string, error) {
+			if !copied[asset] {
+				if _, err := copyFile(filepath.FromSlash(asset), filepath.Join(dir, filepath.FromSlash(asset))); err != nil {
+					return "", err
+				}
+				copied[asset] = true
+			}
+			return siteRelativeURL(page, asset), nil
+		})
 		if err != nil {
-			filesData[filePath] = fmt.Sprintf("<p>渲染错误: %v</p>", err)
-			continue
+			return err
+		}
+		content = rewriteSiteLinks(content, page, rendered)
+		title := filepath.Base(path)
+		if isMarkdownNote(path) {
+			title = strings.TrimSuffix(title, filepath.Ext(title))
+		}
+		err = writeSitePage(filepath.Join(dir, filepath.FromSlash(page)), page, title, content, rf.ModTime)
+		if err != nil {
+			return err
 		}
-		filesData[filePath] = htmlContent
 	}
-	fmt.Printf("文件处理完成，正在生成 HTML...\n")
 
-	// 将文件数据转换为 JSON
-	filesJSON, err := json.Marshal(filesData)
+	// 索引页按文件夹列出所有笔记
+	var index strings.Builder
+	index.WriteString(`<h1>笔记索引</h1><nav class="sitemap-root">`)
+	mu.RLock()
+	if fileTree != nil {
+		writeSitemapList(&index, fileTree.Children, func(path, title string) string {
+			return `<a href="` + gohtml.EscapeString(siteRelativeURL("index.html", sitePagePath(path))) + `">` + gohtml.EscapeString(title) + `</a>`
+		})
+	}
+	mu.RUnlock()
+	index.WriteString(`</nav>`)
+	return writeSitePage(filepath.Join(dir, "index.html"), "index.html", "笔记索引", index.String(), time.Time{})
+}
+
+// 库中所有附件的路径集合
+func assetSet() map[string]bool {
+	mu.RLock()
+	defer mu.RUnlock()
+	assets := make(map[string]bool, len(assetFiles))
+	for _, asset := range assetFiles {
+		assets[slashPath(asset)] = true
+	}
+	return assets
+}
+
+// --render：渲染单个笔记并将 HTML 片段写到标准输出，附件地址为 base 加上附件在库中的路径
+func renderToStdout(file, base string) error {
+	wd, err := os.Getwd()
 	if err != nil {
 		return err
 	}
+	rel, err := filepath.Rel(wd, file)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("文件不在笔记库目录中: %s", file)
+	}
+	rel = slashPath(rel)
+	if !isNoteFile(rel) {
+		return fmt.Errorf("不是笔记文件: %s", file)
+	}
+	if _, err := os.Stat(rel); err != nil {
+		return err
+	}
 
-	// 生成 HTML
-	tmpl := `<!DOCTYPE html>
-<html lang="zh-CN">
+	htmlContent, err := withRenderTimeout(func() (string, error) {
+		return renderMarkdownFile(rel)
+	})
+	if err != nil {
+		return err
+	}
+	htmlContent, err = rewriteAssetURLs(htmlContent, assetSet(), func(asset string) (string, error) {
+		return base + escapeURLPath(asset), nil
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(os.Stdout, htmlContent)
+	return err
+}
+
+// 笔记在静态站点中的页面路径：markdown 笔记替换扩展名，表格和画布文件保留原扩展名再加 .html
+func sitePagePath(path string) string {
+	path = slashPath(path)
+	if isMarkdownNote(path) {
+		return strings.TrimSuffix(path, filepath.Ext(path)) + ".html"
+	}
+	return path + ".html"
+}
+
+// 从一个页面指向站点中另一个文件的相对 URL
+func siteRelativeURL(fromPage, target string) string {
+	rel, err := filepath.Rel(filepath.Dir(filepath.FromSlash(fromPage)), filepath.FromSlash(target))
+	if err != nil {
+		rel = target
+	}
+	return escapeURLPath(rel)
+}
+
+// 匹配 src 和 href 属性
+var siteURLPattern = regexp.MustCompile(`\b(src|href)="([^"]*)"`)
+
+// 将指向库中附件（assets 中的路径）的 src / href 替换为 rewrite 返回的 URL，用于静态站点和 --render
+func rewriteAssetURLs(htmlContent string, assets map[string]bool, rewrite func(asset string) (string, error)) (string, error) {
+	var rewriteErr error
+	htmlContent = siteURLPattern.ReplaceAllStringFunc(htmlContent, func(attr string) string {
+		m := siteURLPattern.FindStringSubmatch(attr)
+		value := gohtml.UnescapeString(m[2])
+		if value == "" || strings.HasPrefix(value, "#") || strings.Contains(value, ":") {
+			return attr
+		}
+		// 去掉 ?v= 版本号和路径前缀，得到库中的路径
+		value, _, _ = strings.Cut(value, "?")
+		value, _, _ = strings.Cut(value, "#")
+		if config.BasePath != "" {
+			value = strings.TrimPrefix(value, config.BasePath)
+		}
+		asset, err := url.PathUnescape(strings.TrimPrefix(value, "/"))
+		if err != nil || !assets[asset] {
+			return attr
+		}
+		rewritten, err := rewrite(asset)
+		if err != nil {
+			rewriteErr = err
+			return attr
+		}
+		return m[1] + `="` + gohtml.EscapeString(rewritten) + `"`
+	})
+	return htmlContent, rewriteErr
+}
+
+// 匹配 wikilink，包括嵌入笔记的标题
+var siteWikiLinkPattern = regexp.MustCompile(`<a href="[^"]*" class="wikilink" data-path="([^"]*)" data-heading="([^"]*)"`)
+
+// 将 wikilink 改为指向目标笔记页面的相对链接，带标题时链接到该标题的 id
+func rewriteSiteLinks(htmlContent, page string, rendered map[string]*RenderedFile) string {
+	return siteWikiLinkPattern.ReplaceAllStringFunc(htmlContent, func(link string) string {
+		m := siteWikiLinkPattern.FindStringSubmatch(link)
+		target := gohtml.UnescapeString(m[1])
+		heading := gohtml.UnescapeString(m[2])
+		rf, ok := rendered[target]
+		if !ok {
+			return link
+		}
+		href := siteRelativeURL(page, sitePagePath(target))
+		if heading != "" {
+			matches := headingPattern.FindAllStringSubmatchIndex(rf.HTML, -1)
+			if i := findHeading(rf.HTML, matches, heading); i != -1 {
+				if id := headingAnchorID(rf.HTML[matches[i][0]:matches[i][5]]); id != "" {
+					href += "#" + url.PathEscape(id)
+				}
+			}
+		}
+		return `<a href="` + gohtml.EscapeString(href) + `" class="wikilink" data-path="` + m[1] + `" data-heading="` + m[2] + `"`
+	})
+}
+
+// 写出静态站点中的一个页面
+func writeSitePage(outputFile, page, title, content string, modTime time.Time) error {
+	if err := os.MkdirAll(filepath.Dir(outputFile), 0755); err != nil {
+		return err
+	}
+	file, err := os.Create(outputFile)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	updated := ""
+	if !modTime.IsZero() {
+		updated = "更新于 " + modTime.Format("2006-01-02 15:04")
+	}
+	mermaid := ""
+	if strings.Contains(content, `<div class="mermaid">`) {
+		mermaid = mermaidScriptURL
+	}
+	katexScript, katexStyle := "", ""
+	if config.Math && strings.Contains(content, `<code class="language-math">`) {
+		katexScript, katexStyle = katexScriptURL, katexStyleURL
+	}
+	return sitePageTemplate.Execute(file, struct {
+		Title         string
+		Index         string
+		Updated       string
+		Content       template.HTML
+		Theme         string
+		Dark          bool
+		ThemeCSS      template.CSS
+		PageCSS       template.CSS
+		Banner        string
+		HeadingOffset int
+		MermaidScript string
+		KaTeXScript   string
+		KaTeXStyle    string
+	}{
+		Title:         title,
+		Index:         siteRelativeURL(page, "index.html"),
+		Updated:       updated,
+		Content:       template.HTML(content),
+		Theme:         config.Theme,
+		Dark:          themes[config.Theme].Dark,
+		ThemeCSS:      template.CSS(themeCSS()),
+		PageCSS:       template.CSS(pageCSS),
+		Banner:        bannerText(),
+		HeadingOffset: config.HeadingOffset,
+		MermaidScript: mermaid,
+		KaTeXScript:   katexScript,
+		KaTeXStyle:    katexStyle,
+	})
+}
+
+// 静态站点页面：沿用预览页面的样式，不含侧边栏，标题栏链接回索引页
+var sitePageTemplate = template.Must(template.New("site").Parse(`<!DOCTYPE html>
+<html lang="zh-CN" data-theme="{{.Theme}}">
 <head>
     <meta charset="UTF-8">
     <meta name="viewport" content="width=device-width, initial-scale=1.0">
-    <title>Obsidian 笔记预览</title>
+    <title>{{.Title}}</title>
     <style>
-        * {
+{{.ThemeCSS}}
+{{.PageCSS}}
+        :root {
+            --heading-offset: {{.HeadingOffset}}px;
+        }
+
+        .site-index {
+            text-decoration: none;
+        }
+    </style>
+    {{if .KaTeXScript}}<link rel="stylesheet" href="{{.KaTeXStyle}}">{{end}}
+</head>
+<body{{if .Banner}} class="has-banner"{{end}}>
+    {{if .Banner}}<div class="page-banner" role="note" title="{{.Banner}}">{{.Banner}}</div>{{end}}
+    <div class="content-area">
+        <div class="content-header">
+            <a class="sidebar-toggle site-index" href="{{.Index}}" title="笔记索引">☰</a>
+            <h2>{{.Title}}</h2>
+            <span class="last-updated">{{.Updated}}</span>
+        </div>
+        <div class="content-body">
+            <div class="markdown-body">{{.Content}}</div>
+        </div>
+    </div>
+    <script>
+        // 静态页面没有图片预览框，点击图片在新标签页中打开
+        function openImageModal(src) {
+            window.open(src, '_blank');
+        }
+    </script>
+    {{if .KaTeXScript}}
+    <script src="{{.KaTeXScript}}"></script>
+    <script>
+        document.querySelectorAll('.markdown-body code.language-math').forEach(code => {
+            const pre = code.parentElement.tagName === 'PRE' ? code.parentElement : null;
+            const math = document.createElement(pre ? 'div' : 'span');
+            math.className = pre ? 'math math-display' : 'math math-inline';
+            katex.render(code.textContent, math, { displayMode: pre !== null, throwOnError: false });
+            (pre || code).replaceWith(math);
+        });
+    </script>
+    {{end}}
+    {{if .MermaidScript}}
+    <script src="{{.MermaidScript}}"></script>
+    <script>
+        mermaid.initialize({
+            startOnLoad: true,
+            theme: {{if .Dark}}'dark'{{else}}'default'{{end}},
+            flowchart: { useMaxWidth: false },
+            sequence: { useMaxWidth: false },
+            gantt: { useMaxWidth: false },
+            timeline: { useMaxWidth: false }
+        });
+    </script>
+    {{end}}
+</body>
+</html>
+`))
+
+// 页面顶部的横幅文字（--banner），{time} 替换为当前时间，即页面的生成时间
+func bannerText() string {
+	return strings.ReplaceAll(strings.TrimSpace(config.Banner), "{time}", time.Now().Format("2006-01-02 15:04"))
+}
+
+// 文件树顶部显示的笔记库名称（--show-vault-name），未启用时为空
+func treeRootLabel() string {
+	if !config.ShowVaultName {
+		return ""
+	}
+	return config.VaultName
+}
+
+// 页面使用的 Mermaid 脚本
+const mermaidScriptURL = "https://cdnjs.cloudflare.com/ajax/libs/mermaid/11.12.0/mermaid.min.js"
+
+// 排版数学公式（--math）使用的 KaTeX
+const (
+	katexScriptURL = "https://cdnjs.cloudflare.com/ajax/libs/KaTeX/0.16.11/katex.min.js"
+	katexStyleURL  = "https://cdnjs.cloudflare.com/ajax/libs/KaTeX/0.16.11/katex.min.css"
+)
+
+// 预览页面加载的 Mermaid 脚本，--no-mermaid 时为空，页面不请求 CDN
+func mermaidScript() string {
+	if config.Mermaid == "none" {
+		return ""
+	}
+	return mermaidScriptURL
+}
+
+// 导出站点的 service worker：安装时缓存页面和所有图片，之后优先从缓存读取，
+// 其他请求（如 Mermaid 脚本）在联网时取得后加入缓存；离线打开任意页面地址时返回预览页面
+const serviceWorkerScript = `// 由 obsidian-preview --export 生成
+const CACHE = 'obsidian-preview-%s';
+const ASSETS = %s;
+const MERMAID = %q;
+
+self.addEventListener('install', event => {
+    event.waitUntil(caches.open(CACHE).then(cache => {
+        // Mermaid 脚本来自 CDN，获取失败时不影响安装；--no-mermaid 时为空
+        if (MERMAID) {
+            cache.add(new Request(MERMAID, { mode: 'no-cors' })).catch(() => {});
+        }
+        return cache.addAll(ASSETS);
+    }).then(() => self.skipWaiting()));
+});
+
+self.addEventListener('activate', event => {
+    event.waitUntil(caches.keys().then(keys => Promise.all(
+        keys.filter(key => key.startsWith('obsidian-preview-') && key !== CACHE).map(key => caches.delete(key))
+    )).then(() => self.clients.claim()));
+});
+
+self.addEventListener('fetch', event => {
+    if (event.request.method !== 'GET') return;
+    // 图片地址带有 ?v= 版本参数，匹配缓存时忽略查询字符串
+    event.respondWith(caches.match(event.request, { ignoreSearch: true }).then(cached => {
+        if (cached) return cached;
+        return fetch(event.request).then(resp => {
+            if (resp.ok || resp.type === 'opaque') {
+                const copy = resp.clone();
+                caches.open(CACHE).then(cache => cache.put(event.request, copy));
+            }
+            return resp;
+        }).catch(() => {
+            if (event.request.mode === 'navigate') {
+                return caches.match('index.html');
+            }
+            return Response.error();
+        });
+    }));
+});
+`
+
+// 配色方案对应的 Mermaid 基础主题
+func mermaidTheme(t Theme) string {
+	if t.Dark {
+		return "dark"
+	}
+	return "default"
+}
+
+// 解析启动参数中指定的笔记，支持笔记名和不区分大小写的路径
+// 找不到时原样返回，由页面显示空状态
+func resolveStartNote(name string) string {
+	if name == "" {
+		return ""
+	}
+	name = slashPath(filepath.Clean(name))
+	if path, ok := resolveNote(name); ok {
+		return path
+	}
+	return name
+}
+
+// 最近一次生成的预览页面，首页直接从内存提供（由 mu 保护）
+var generatedPage []byte
+var generatedAt time.Time
+
+// 已提示过库中存在用户自己的 index.html（由 mu 保护）
+var userIndexWarned bool
+
+// 生成预览页面并同时写入 outputFile，便于将笔记库直接复制到 web 服务器；
+// outputFile 是用户自己的文件（不是本程序生成的）时不覆盖
+func generateHTML(outputFile string) error {
+	page, err := renderPage(false)
+	if err != nil {
+		return err
+	}
+	generated := isGeneratedPage(outputFile)
+
+	mu.Lock()
+	generatedPage, generatedAt = page, time.Now()
+	warn := !generated && !userIndexWarned
+	if warn {
+		userIndexWarned = true
+	}
+	mu.Unlock()
+
+	if !generated {
+		if warn {
+			slog.Warn("笔记库中已有同名文件，不写入预览页面，该文件仍可通过原路径访问", "path", outputFile)
+		}
+		return nil
+	}
+	return os.WriteFile(outputFile, page, 0644)
+}
+
+// 标记由本程序生成的页面，与预览页面模板中的 meta 标签一致
+const generatorMeta = `<meta name="generator" content="obsidian-preview">`
+
+// 文件不存在或是本程序生成的页面（可以覆盖）
+func isGeneratedPage(path string) bool {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return true
+	}
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+	head := make([]byte, 4096)
+	n, _ := io.ReadFull(file, head)
+	// 旧版本生成的页面没有 generator 标记，按标题识别
+	return bytes.Contains(head[:n], []byte(generatorMeta)) || bytes.Contains(head[:n], []byte("<title>Obsidian 笔记预览</title>"))
+}
+
+// 预览页面的样式，颜色均使用 themeCSS 生成的 CSS 变量；--site-out 生成的静态页面共用这些样式
+const pageCSS = `        * {
             margin: 0;
             padding: 0;
             box-sizing: border-box;
@@ -415,47 +6113,122 @@ func generateHTML(outputFile string) error {
 
         body {
             font-family: -apple-system, BlinkMacSystemFont, "Segoe UI", Roboto, "Helvetica Neue", Arial, sans-serif;
-            background: #1e1e1e;
-            color: #d4d4d4;
+            background: var(--bg);
+            color: var(--text);
             display: flex;
             height: 100vh;
             overflow: hidden;
         }
 
+        /* --banner：固定在页面顶部的一行提示，其余内容下移 */
+        body.has-banner {
+            padding-top: 30px;
+        }
+
+        .page-banner {
+            position: fixed;
+            top: 0;
+            left: 0;
+            right: 0;
+            height: 30px;
+            line-height: 30px;
+            padding: 0 16px;
+            text-align: center;
+            font-size: 13px;
+            white-space: nowrap;
+            overflow: hidden;
+            text-overflow: ellipsis;
+            color: var(--text-strong);
+            background: color-mix(in srgb, var(--warning) 25%, var(--bg-header));
+            border-bottom: 1px solid var(--border);
+            z-index: 900;
+        }
+
         .sidebar {
             width: 300px;
-            background: #252526;
-            border-right: 1px solid #3e3e42;
+            background: var(--bg-sidebar);
+            border-right: 1px solid var(--border);
             display: flex;
             flex-direction: column;
             overflow: hidden;
         }
 
-        .sidebar-header {
-            padding: 15px;
-            background: #2d2d30;
-            border-bottom: 1px solid #3e3e42;
+        .sidebar-hidden .sidebar {
+            display: none;
+        }
+
+        .sidebar-header {
+            padding: 15px;
+            background: var(--bg-header);
+            border-bottom: 1px solid var(--border);
+        }
+
+        .sidebar-header h1 {
+            font-size: 18px;
+            color: var(--text-strong);
+            margin-bottom: 10px;
+        }
+
+        .sidebar-actions {
+            display: flex;
+            gap: 6px;
+            margin-top: 8px;
+        }
+
+        .sidebar-button {
+            background: var(--bg-input);
+            border: 1px solid var(--border);
+            color: var(--text);
+            padding: 3px 10px;
+            border-radius: 4px;
+            cursor: pointer;
+            font-size: 12px;
+            text-decoration: none;
+        }
+
+        .sidebar-button:hover {
+            background: var(--bg-button-hover);
+            border-color: var(--accent);
+        }
+
+        .sidebar-button:disabled {
+            opacity: 0.5;
+            cursor: default;
+            background: var(--bg-input);
+            border-color: var(--border);
         }
 
-        .sidebar-header h1 {
-            font-size: 18px;
-            color: #ffffff;
-            margin-bottom: 10px;
+        .sidebar-select {
+            background: var(--bg-input);
+            border: 1px solid var(--border);
+            color: var(--text);
+            padding: 2px 6px;
+            border-radius: 4px;
+            font-size: 12px;
+        }
+
+        .sidebar-option {
+            display: flex;
+            align-items: center;
+            gap: 4px;
+            font-size: 12px;
+            color: var(--text-muted);
+            cursor: pointer;
         }
 
         .search-box {
             width: 100%;
             padding: 8px 12px;
-            background: #3c3c3c;
-            border: 1px solid #3e3e42;
+            background: var(--bg-input);
+            border: 1px solid var(--border);
             border-radius: 4px;
-            color: #d4d4d4;
+            color: var(--text);
             font-size: 14px;
         }
 
         .search-box:focus {
             outline: none;
-            border-color: #007acc;
+            border-color: var(--accent);
         }
 
         .file-tree {
@@ -469,16 +6242,16 @@ func generateHTML(outputFile string) error {
         }
 
         .file-tree::-webkit-scrollbar-track {
-            background: #1e1e1e;
+            background: var(--bg);
         }
 
         .file-tree::-webkit-scrollbar-thumb {
-            background: #424242;
+            background: var(--scrollbar);
             border-radius: 4px;
         }
 
         .file-tree::-webkit-scrollbar-thumb:hover {
-            background: #4e4e4e;
+            background: var(--scrollbar-hover);
         }
 
         .tree-item {
@@ -491,22 +6264,40 @@ func generateHTML(outputFile string) error {
             font-size: 14px;
         }
 
+        .tree-compact .tree-item {
+            padding-top: 1px;
+            padding-bottom: 1px;
+            font-size: 13px;
+        }
+
+        .tree-comfortable .tree-item {
+            padding-top: 8px;
+            padding-bottom: 8px;
+            font-size: 15px;
+        }
+
         .tree-item:hover {
-            background: #2a2d2e;
+            background: var(--bg-item-hover);
+        }
+
+        .tree-item:focus-visible {
+            outline: 2px solid var(--accent);
+            outline-offset: -2px;
         }
 
-        .tree-item.active {
-            background: #37373d;
-            color: #ffffff;
+        .tree-item.active,
+        .tag-item.current {
+            background: var(--bg-item-active);
+            color: var(--text-strong);
         }
 
         .tree-item.folder {
             font-weight: 500;
-            color: #4ec9b0;
+            color: var(--accent-alt);
         }
 
         .tree-item.file {
-            color: #9cdcfe;
+            color: var(--text-file);
         }
 
         .tree-item-icon {
@@ -517,10 +6308,102 @@ func generateHTML(outputFile string) error {
             cursor: pointer;
         }
 
+        .note-type-dot {
+            width: 8px;
+            height: 8px;
+            border-radius: 50%;
+            background: var(--text-muted);
+            margin-right: 6px;
+            flex-shrink: 0;
+        }
+
+        .tree-item.has-folder-note .tree-item-name {
+            text-decoration: underline dotted var(--text-muted);
+            text-underline-offset: 3px;
+        }
+
+        .tree-item-alias {
+            margin-left: 8px;
+            font-size: 12px;
+            color: var(--text-muted);
+            white-space: nowrap;
+            overflow: hidden;
+            text-overflow: ellipsis;
+        }
+
         .tree-item-icon.expandable {
             cursor: pointer;
         }
 
+        .tree-item-count {
+            margin-left: auto;
+            padding: 0 6px;
+            border-radius: 8px;
+            background: var(--bg-input);
+            color: var(--text-muted);
+            font-size: 11px;
+            font-weight: normal;
+        }
+
+        .pin-button {
+            margin-left: auto;
+            padding: 0 4px;
+            font-size: 11px;
+            opacity: 0;
+            cursor: pointer;
+        }
+
+        .tree-item:hover .pin-button,
+        .tree-item.pinned .pin-button {
+            opacity: 1;
+        }
+
+        .pinned-section {
+            padding: 10px 10px 6px;
+            border-bottom: 1px solid var(--border);
+        }
+
+        .tree-root {
+            padding: 10px 18px 0;
+            font-weight: 600;
+            color: var(--text-strong);
+            white-space: nowrap;
+            overflow: hidden;
+            text-overflow: ellipsis;
+        }
+
+        .section-title {
+            padding: 0 8px 4px;
+            font-size: 12px;
+            color: var(--text-muted);
+        }
+
+        summary.section-title {
+            cursor: pointer;
+            list-style: none;
+        }
+
+        summary.section-title::-webkit-details-marker {
+            display: none;
+        }
+
+        summary.section-title::before {
+            content: '▶';
+            display: inline-block;
+            margin-right: 4px;
+            font-size: 9px;
+            transition: transform 0.2s;
+        }
+
+        details[open] > summary.section-title::before {
+            transform: rotate(90deg);
+        }
+
+        .tag-tree {
+            max-height: 30vh;
+            overflow-y: auto;
+        }
+
         .tree-children {
             display: block;
         }
@@ -536,22 +6419,167 @@ func generateHTML(outputFile string) error {
             overflow: hidden;
         }
 
+        .content-panes {
+            flex: 1;
+            display: flex;
+            min-height: 0;
+            position: relative;
+        }
+
+        .scroll-top-button {
+            position: absolute;
+            right: 28px;
+            bottom: 24px;
+            width: 36px;
+            height: 36px;
+            border-radius: 50%;
+            border: 1px solid var(--border);
+            background: var(--bg-header);
+            color: var(--text);
+            font-size: 16px;
+            cursor: pointer;
+            opacity: 0;
+            pointer-events: none;
+            transition: opacity 0.2s;
+        }
+
+        .scroll-top-button.visible {
+            opacity: 0.85;
+            pointer-events: auto;
+        }
+
+        .scroll-top-button:hover {
+            opacity: 1;
+            background: var(--bg-button-hover);
+            border-color: var(--accent);
+        }
+
+        .content-panes .content-body {
+            min-width: 0;
+        }
+
+        .raw-pane {
+            flex: 1;
+            min-width: 0;
+            overflow: auto;
+            margin: 0;
+            padding: 30px;
+            background: var(--bg-sidebar);
+            border-right: 1px solid var(--border);
+            color: var(--text);
+            font-family: "Consolas", "Monaco", "Courier New", monospace;
+            font-size: 13px;
+            line-height: 1.6;
+            white-space: pre-wrap;
+            word-break: break-word;
+        }
+
+        .spinner {
+            display: inline-block;
+            width: 12px;
+            height: 12px;
+            border: 2px solid var(--border);
+            border-top-color: var(--accent);
+            border-radius: 50%;
+            animation: spin 0.8s linear infinite;
+            margin-right: 8px;
+            vertical-align: middle;
+        }
+
+        @keyframes spin {
+            to { transform: rotate(360deg); }
+        }
+
+        .copy-button.active {
+            border-color: var(--accent);
+            color: var(--accent);
+        }
+
+        .note-editor {
+            display: none;
+            flex-direction: column;
+            height: 100%;
+        }
+
+        .content-body.editing .note-editor {
+            display: flex;
+        }
+
+        .content-body.editing #markdownContent {
+            display: none;
+        }
+
+        .note-editor textarea {
+            flex: 1;
+            min-height: 300px;
+            resize: none;
+            padding: 12px;
+            background: var(--bg-input);
+            color: var(--text);
+            border: 1px solid var(--border);
+            border-radius: 4px;
+            font-family: "Consolas", "Monaco", "Courier New", monospace;
+            font-size: 13px;
+            line-height: 1.6;
+        }
+
+        .editor-actions {
+            display: flex;
+            align-items: center;
+            gap: 8px;
+            margin-top: 8px;
+        }
+
+        .editor-status {
+            color: var(--text-muted);
+            font-size: 13px;
+        }
+
         .content-header {
             padding: 15px 20px;
-            background: #2d2d30;
-            border-bottom: 1px solid #3e3e42;
+            background: var(--bg-header);
+            border-bottom: 1px solid var(--border);
+            display: flex;
+            justify-content: space-between;
+            align-items: center;
+            gap: 10px;
+        }
+
+        .content-actions {
+            display: flex;
+            gap: 6px;
+            flex-shrink: 0;
         }
 
         .content-header h2 {
             font-size: 16px;
-            color: #ffffff;
+            color: var(--text-strong);
+            flex: 1;
+        }
+
+        .last-updated {
+            font-size: 12px;
+            color: var(--text-muted);
+            white-space: nowrap;
+        }
+
+        .sidebar-toggle {
+            background: none;
+            border: none;
+            color: var(--text-muted);
+            font-size: 16px;
+            cursor: pointer;
+        }
+
+        .sidebar-toggle:hover {
+            color: var(--text-strong);
         }
 
         .content-body {
             flex: 1;
             overflow-y: auto;
             padding: 30px;
-            background: #1e1e1e;
+            background: var(--bg);
         }
 
         .content-body::-webkit-scrollbar {
@@ -559,16 +6587,16 @@ func generateHTML(outputFile string) error {
         }
 
         .content-body::-webkit-scrollbar-track {
-            background: #1e1e1e;
+            background: var(--bg);
         }
 
         .content-body::-webkit-scrollbar-thumb {
-            background: #424242;
+            background: var(--scrollbar);
             border-radius: 6px;
         }
 
         .content-body::-webkit-scrollbar-thumb:hover {
-            background: #4e4e4e;
+            background: var(--scrollbar-hover);
         }
 
         .markdown-body {
@@ -587,18 +6615,18 @@ func generateHTML(outputFile string) error {
             margin-bottom: 16px;
             font-weight: 600;
             line-height: 1.25;
-            color: #ffffff;
+            color: var(--text-strong);
         }
 
         .markdown-body h1 {
             font-size: 2em;
-            border-bottom: 1px solid #3e3e42;
+            border-bottom: 1px solid var(--border);
             padding-bottom: 10px;
         }
 
         .markdown-body h2 {
             font-size: 1.5em;
-            border-bottom: 1px solid #3e3e42;
+            border-bottom: 1px solid var(--border);
             padding-bottom: 8px;
         }
 
@@ -608,21 +6636,64 @@ func generateHTML(outputFile string) error {
 
         .markdown-body p {
             margin-bottom: 16px;
-            color: #d4d4d4;
+            color: var(--text);
         }
 
         .markdown-body code {
-            background: #2d2d30;
+            background: var(--bg-header);
             padding: 2px 6px;
             border-radius: 3px;
             font-family: "Consolas", "Monaco", "Courier New", monospace;
             font-size: 0.9em;
-            color: #d7ba7d;
+            color: var(--text-code);
+        }
+
+        .markdown-body code.inline-lang {
+            border-left: 3px solid var(--code-lang);
+            background: color-mix(in srgb, var(--code-lang) 12%, var(--bg-header));
+        }
+
+        /* 跳转到标题等锚点时在上方保留 --heading-offset 的距离 */
+        .markdown-body [id],
+        .markdown-body a[name] {
+            scroll-margin-top: var(--heading-offset, 0px);
+        }
+
+        .markdown-body .toc {
+            border-left: 3px solid var(--border);
+            padding: 4px 0 4px 12px;
+            margin-bottom: 16px;
+        }
+
+        .markdown-body .toc ul {
+            list-style: none;
+            padding-left: 1.2em;
+            margin: 0;
+        }
+
+        .markdown-body .toc > ul {
+            padding-left: 0;
+        }
+
+        .markdown-body .toc li {
+            margin: 2px 0;
+        }
+
+        .markdown-body .toc a {
+            text-decoration: none;
+        }
+
+        /* KaTeX 排版的公式块，过宽时横向滚动 */
+        .markdown-body .math-display {
+            display: block;
+            overflow-x: auto;
+            overflow-y: hidden;
+            margin-bottom: 16px;
         }
 
         .markdown-body pre {
-            background: #252526;
-            border: 1px solid #3e3e42;
+            background: var(--bg-sidebar);
+            border: 1px solid var(--border);
             border-radius: 6px;
             padding: 16px;
             overflow-x: auto;
@@ -630,10 +6701,35 @@ func generateHTML(outputFile string) error {
             position: relative;
         }
 
+        .markdown-body pre .diff-line {
+            display: block;
+            margin: 0 -16px;
+            padding: 0 16px;
+        }
+
+        .markdown-body pre .diff-add {
+            color: var(--success);
+            background: color-mix(in srgb, var(--success) 15%, transparent);
+        }
+
+        .markdown-body pre .diff-del {
+            color: var(--danger);
+            background: color-mix(in srgb, var(--danger) 15%, transparent);
+        }
+
+        .markdown-body pre .diff-hunk {
+            color: var(--accent-alt);
+        }
+
+        .markdown-body pre .diff-header {
+            color: var(--text-strong);
+            font-weight: 600;
+        }
+
         .markdown-body pre code {
             background: transparent;
             padding: 0;
-            color: #d4d4d4;
+            color: var(--text);
             font-size: 14px;
             line-height: 1.45;
             display: block;
@@ -645,66 +6741,222 @@ func generateHTML(outputFile string) error {
             margin-bottom: 16px;
         }
 
-        .code-block-header {
-            display: flex;
-            justify-content: space-between;
-            align-items: center;
-            background: #2d2d30;
-            border: 1px solid #3e3e42;
-            border-bottom: none;
-            border-radius: 6px 6px 0 0;
-            padding: 8px 12px;
-            font-size: 12px;
-            color: #858585;
+        .code-block-header {
+            display: flex;
+            justify-content: space-between;
+            align-items: center;
+            background: var(--bg-header);
+            border: 1px solid var(--border);
+            border-bottom: none;
+            border-radius: 6px 6px 0 0;
+            padding: 8px 12px;
+            font-size: 12px;
+            color: var(--text-muted);
+        }
+
+        .code-block-header .language {
+            font-weight: 500;
+            color: var(--accent-alt);
+        }
+
+        .copy-button {
+            background: var(--bg-input);
+            border: 1px solid var(--border);
+            color: var(--text);
+            padding: 4px 12px;
+            border-radius: 4px;
+            cursor: pointer;
+            font-size: 12px;
+            transition: all 0.2s;
+        }
+
+        .copy-button:hover {
+            background: var(--bg-button-hover);
+            border-color: var(--accent);
+        }
+
+        .copy-button.copied {
+            background: var(--accent);
+            color: var(--text-strong);
+        }
+
+        .code-block-wrapper pre {
+            margin: 0;
+            border-radius: 0 0 6px 6px;
+        }
+
+        .code-block-wrapper.foldable pre {
+            border-radius: 0;
+        }
+
+        .code-block-wrapper.folded pre {
+            overflow: hidden;
+        }
+
+        .code-expander {
+            display: block;
+            width: 100%;
+            background: var(--bg-header);
+            border: 1px solid var(--border);
+            border-top: none;
+            border-radius: 0 0 6px 6px;
+            color: var(--accent-alt);
+            padding: 6px;
+            font-size: 12px;
+            cursor: pointer;
+        }
+
+        .code-expander:hover {
+            background: var(--bg-item-active);
+        }
+
+        .markdown-body ul,
+        .markdown-body ol {
+            margin-bottom: 16px;
+            padding-left: 30px;
+            color: var(--text);
+        }
+
+        .markdown-body li {
+            margin-bottom: 8px;
+        }
+
+        .markdown-body blockquote {
+            border-left: 4px solid var(--accent);
+            padding-left: 16px;
+            margin: 16px 0;
+            color: var(--text-muted);
+        }
+
+        .markdown-body table.frontmatter {
+            width: auto;
+            margin-bottom: 24px;
+            font-size: 0.9em;
+        }
+
+        .markdown-body table.frontmatter th {
+            background: var(--bg-sidebar);
+            color: var(--text-muted);
+            font-weight: normal;
+            text-align: left;
+            vertical-align: top;
+        }
+
+        .markdown-body .frontmatter-item {
+            display: inline-block;
+            background: var(--bg-header);
+            border-radius: 10px;
+            padding: 0 8px;
+            margin: 1px 0;
+        }
+
+        .markdown-body a.tag {
+            background: var(--bg-header);
+            color: var(--accent-alt);
+            border-radius: 10px;
+            padding: 1px 8px;
+            font-size: 0.9em;
+            text-decoration: none;
+        }
+
+        .markdown-body a.tag:hover {
+            background: var(--bg-button-hover);
+        }
+
+        .markdown-body .callout {
+            --callout-color: var(--accent);
+            border-left: 4px solid var(--callout-color);
+            background-color: var(--bg-sidebar);
+            border-radius: 4px;
+            margin: 16px 0;
+            padding: 8px 16px;
+        }
+
+        .markdown-body .callout[data-callout="tip"],
+        .markdown-body .callout[data-callout="success"],
+        .markdown-body .callout[data-callout="check"],
+        .markdown-body .callout[data-callout="done"] {
+            --callout-color: var(--accent-alt);
+        }
+
+        .markdown-body .callout[data-callout="warning"],
+        .markdown-body .callout[data-callout="caution"],
+        .markdown-body .callout[data-callout="attention"],
+        .markdown-body .callout[data-callout="question"],
+        .markdown-body .callout[data-callout="faq"] {
+            --callout-color: var(--warning);
+        }
+
+        .markdown-body .callout[data-callout="danger"],
+        .markdown-body .callout[data-callout="error"],
+        .markdown-body .callout[data-callout="bug"],
+        .markdown-body .callout[data-callout="failure"] {
+            --callout-color: var(--danger);
+        }
+
+        .markdown-body .callout-title {
+            color: var(--callout-color);
+            font-weight: 600;
+            margin: 4px 0;
+        }
+
+        .markdown-body .callout-icon {
+            display: inline-block;
+            margin-right: 6px;
+        }
+
+        .markdown-body .callout-icon svg {
+            width: 1em;
+            height: 1em;
+            vertical-align: -0.125em;
         }
 
-        .code-block-header .language {
-            font-weight: 500;
-            color: #4ec9b0;
+        .markdown-body summary.callout-title {
+            cursor: pointer;
         }
 
-        .copy-button {
-            background: #3c3c3c;
-            border: 1px solid #3e3e42;
-            color: #d4d4d4;
-            padding: 4px 12px;
+        .markdown-body .callout-content > :last-child {
+            margin-bottom: 4px;
+        }
+
+        .markdown-body .note-embed {
+            border: 1px solid var(--border);
+            border-left: 3px solid var(--accent);
             border-radius: 4px;
-            cursor: pointer;
-            font-size: 12px;
-            transition: all 0.2s;
+            margin: 16px 0;
+            padding: 8px 16px;
         }
 
-        .copy-button:hover {
-            background: #4c4c4c;
-            border-color: #007acc;
+        .markdown-body .note-embed-title {
+            font-size: 13px;
+            margin-bottom: 8px;
         }
 
-        .copy-button.copied {
-            background: #007acc;
-            color: #ffffff;
+        .markdown-body .note-embed-title a::after {
+            content: " ↗";
         }
 
-        .code-block-wrapper pre {
-            margin: 0;
-            border-radius: 0 0 6px 6px;
+        .markdown-body .note-embed-content > :last-child {
+            margin-bottom: 4px;
         }
 
-        .markdown-body ul,
-        .markdown-body ol {
+        .markdown-body dl {
             margin-bottom: 16px;
-            padding-left: 30px;
-            color: #d4d4d4;
         }
 
-        .markdown-body li {
-            margin-bottom: 8px;
+        .markdown-body dt {
+            font-weight: 600;
+            color: var(--text-strong);
+            margin-top: 12px;
         }
 
-        .markdown-body blockquote {
-            border-left: 4px solid #007acc;
-            padding-left: 16px;
-            margin: 16px 0;
-            color: #858585;
+        .markdown-body dd {
+            margin: 4px 0 0 24px;
+            color: var(--text);
+        }
+
+        .markdown-body dd > p {
+            margin-bottom: 8px;
         }
 
         .markdown-body table {
@@ -715,23 +6967,57 @@ func generateHTML(outputFile string) error {
 
         .markdown-body table th,
         .markdown-body table td {
-            border: 1px solid #3e3e42;
+            border: 1px solid var(--border);
             padding: 8px 12px;
             text-align: left;
         }
 
         .markdown-body table th {
-            background: #2d2d30;
+            background: var(--bg-header);
             font-weight: 600;
-            color: #ffffff;
+            color: var(--text-strong);
         }
 
         .markdown-body table tr:nth-child(even) {
-            background: #252526;
+            background: var(--bg-sidebar);
+        }
+
+        .table-wrapper,
+        .data-table-wrapper {
+            overflow: auto;
+            max-height: 80vh;
+            margin-bottom: 16px;
+        }
+
+        .markdown-body .table-wrapper table {
+            width: auto;
+            min-width: 100%;
+            margin-bottom: 0;
+        }
+
+        /* 边框合并时表头的边框不随单元格固定，改用阴影画出底边 */
+        .markdown-body .table-wrapper th,
+        .markdown-body .data-table-wrapper th {
+            position: sticky;
+            top: 0;
+            z-index: 1;
+            box-shadow: inset 0 -1px 0 var(--border);
+        }
+
+        .markdown-body .data-table-wrapper table {
+            width: auto;
+            min-width: 100%;
+            margin-bottom: 0;
+            white-space: nowrap;
+        }
+
+        .data-table-info {
+            color: var(--text-muted);
+            font-size: 13px;
         }
 
         .markdown-body a {
-            color: #4ec9b0;
+            color: var(--accent-alt);
             text-decoration: none;
         }
 
@@ -739,6 +7025,16 @@ func generateHTML(outputFile string) error {
             text-decoration: underline;
         }
 
+        .markdown-body a.wikilink.broken {
+            color: var(--text-muted);
+            text-decoration: underline dotted;
+            cursor: default;
+        }
+
+        .markdown-body a.folder-link::before {
+            content: "📁 ";
+        }
+
         .markdown-body img {
             max-width: 100%;
             height: auto;
@@ -752,6 +7048,15 @@ func generateHTML(outputFile string) error {
             opacity: 0.8;
         }
 
+        .markdown-body img.banner {
+            display: block;
+            width: 100%;
+            max-height: 280px;
+            object-fit: cover;
+            border-radius: 6px;
+            margin: 0 0 20px;
+        }
+
         .preview-image {
             cursor: zoom-in;
         }
@@ -782,11 +7087,25 @@ func generateHTML(outputFile string) error {
             border-radius: 8px;
         }
 
+        .modal-diagram {
+            width: 90%;
+            height: 90%;
+            padding: 20px;
+            background: var(--bg-sidebar);
+            border-radius: 8px;
+        }
+
+        .modal-diagram svg {
+            display: block;
+            width: 100%;
+            height: 100%;
+        }
+
         .image-modal-close {
             position: absolute;
             top: 20px;
             right: 30px;
-            color: #ffffff;
+            color: var(--text-strong);
             font-size: 40px;
             font-weight: bold;
             cursor: pointer;
@@ -794,55 +7113,315 @@ func generateHTML(outputFile string) error {
         }
 
         .image-modal-close:hover {
-            color: #4ec9b0;
+            color: var(--accent-alt);
         }
 
         .empty-state {
             text-align: center;
             padding: 60px 20px;
-            color: #858585;
+            color: var(--text-muted);
         }
 
         .empty-state h3 {
             font-size: 20px;
             margin-bottom: 10px;
-            color: #d4d4d4;
+            color: var(--text);
+        }
+
+        .sitemap-root {
+            text-align: left;
+            max-width: 600px;
+            margin: 30px auto 0;
+        }
+
+        .sitemap {
+            list-style: none;
+            padding-left: 20px;
+            line-height: 1.8;
+        }
+
+        .sitemap-root > .sitemap {
+            padding-left: 0;
+        }
+
+        .sitemap-folder > span,
+        .sitemap-folder > a {
+            font-weight: 600;
+        }
+
+        .sitemap a {
+            color: var(--text-file);
+            text-decoration: none;
+        }
+
+        .sitemap a:hover {
+            text-decoration: underline;
+        }
+
+        .encoding-notice,
+        .embed-warning {
+            color: var(--warning);
+            font-size: 13px;
+            border-left: 3px solid var(--warning);
+            padding: 6px 12px;
+            margin-bottom: 16px;
+            background: var(--bg-sidebar);
+        }
+
+        .canvas-wrapper {
+            overflow: auto;
+            max-height: 80vh;
+            border: 1px solid var(--border);
+            border-radius: 6px;
+            margin-bottom: 16px;
+        }
+
+        .canvas {
+            position: relative;
+            background-image: radial-gradient(var(--border) 1px, transparent 1px);
+            background-size: 20px 20px;
+        }
+
+        .canvas-edges {
+            position: absolute;
+            left: 0;
+            top: 0;
+            pointer-events: none;
+        }
+
+        .canvas-edge {
+            fill: none;
+            stroke: var(--text-muted);
+            stroke-width: 2;
+        }
+
+        .canvas-edge-label {
+            fill: var(--text);
+            font-size: 12px;
+            text-anchor: middle;
+            dominant-baseline: middle;
+            paint-order: stroke;
+            stroke: var(--bg);
+            stroke-width: 4px;
+        }
+
+        .canvas-node {
+            position: absolute;
+            border: 2px solid var(--border);
+            border-radius: 8px;
+            background: var(--bg-sidebar);
+            padding: 8px 12px;
+            overflow: auto;
+            font-size: 14px;
+        }
+
+        .canvas-group {
+            background: transparent;
+            overflow: visible;
+        }
+
+        .canvas-group-label {
+            position: absolute;
+            top: -24px;
+            left: 0;
+            color: var(--text-muted);
+            font-size: 13px;
+            white-space: nowrap;
+        }
+
+        .canvas-node .note-embed {
+            margin: 0;
+            border: none;
+            padding: 0;
+        }
+
+        .canvas-node img {
+            margin: 0;
+            max-height: 100%;
         }
 
         .hidden {
             display: none;
         }
 
-        /* Mermaid 图表样式 */
-        .mermaid {
+        /* Mermaid 图表样式：宽的图表（甘特图、时间线、大型流程图）按原始大小显示并横向滚动 */
+        .mermaid,
+        .mermaid-svg {
             text-align: center;
             margin: 20px 0;
-            background: #252526;
-            border: 1px solid #3e3e42;
+            background: var(--bg-sidebar);
+            border: 1px solid var(--border);
             border-radius: 6px;
             padding: 20px;
+            max-width: 100%;
+            overflow-x: auto;
+        }
+
+        #markdownContent .mermaid svg,
+        #markdownContent .mermaid-svg svg {
+            cursor: zoom-in;
+        }
+
+        .mermaid-svg svg {
+            max-width: 100%;
+            height: auto;
+        }
+
+        /* 打印时表格完整展开 */
+        @media print {
+            .table-wrapper,
+            .data-table-wrapper {
+                overflow: visible;
+                max-height: none;
+            }
+
+            .markdown-body .table-wrapper th,
+            .markdown-body .data-table-wrapper th {
+                position: static;
+            }
+
+            body.has-banner {
+                padding-top: 0;
+            }
+
+            .page-banner {
+                position: static;
+            }
+        }
+`
+
+// 生成预览页面；导出模式下页面不连接服务器接口（文件变化通知、原始 markdown），并注册离线使用的 service worker
+func renderPage(export bool) ([]byte, error) {
+	mu.RLock()
+	treeJSON, err := json.Marshal(fileTree.Children)
+	mu.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+
+	rendered := renderAllFiles()
+	filesData := make(map[string]string)
+	for filePath, rf := range rendered {
+		filesData[filePath] = rf.HTML
+	}
+	mu.Lock()
+	renderedNotes = rendered
+	mu.Unlock()
+	slog.Info("文件处理完成，正在生成 HTML")
+
+	// 将文件数据转换为 JSON
+	filesJSON, err := json.Marshal(filesData)
+	if err != nil {
+		return nil, err
+	}
+
+	// 生成 HTML
+	tmpl := `<!DOCTYPE html>
+<html lang="zh-CN" data-theme="{{.Theme}}">
+<head>
+    <meta charset="UTF-8">
+    <meta name="viewport" content="width=device-width, initial-scale=1.0">
+    <meta name="generator" content="obsidian-preview">
+    <title>Obsidian 笔记预览</title>
+    <script>
+        // 在页面绘制前应用浏览器中保存的配色方案，避免闪烁
+        (function() {
+            const saved = localStorage.getItem('obsidian-preview-theme');
+            if (saved && {{.Themes}}.includes(saved)) {
+                document.documentElement.dataset.theme = saved;
+            }
+        })();
+    </script>
+    <style>
+{{.ThemeCSS}}
+{{.PageCSS}}
+        :root {
+            --heading-offset: {{.HeadingOffset}}px;
         }
     </style>
-    <script src="https://cdnjs.cloudflare.com/ajax/libs/mermaid/11.12.0/mermaid.min.js"></script>
+    {{if .MermaidScript}}<script src="{{.MermaidScript}}"></script>{{end}}
+    {{if .KaTeXScript}}<link rel="stylesheet" href="{{.KaTeXStyle}}"><script src="{{.KaTeXScript}}"></script>{{end}}
 </head>
-<body>
+<body{{if .Banner}} class="has-banner"{{end}}>
+    {{if .Banner}}<div class="page-banner" role="note" title="{{.Banner}}">{{.Banner}}</div>{{end}}
     <div class="sidebar">
         <div class="sidebar-header">
             <h1>📚 笔记库</h1>
-            <input type="text" class="search-box" id="searchBox" placeholder="搜索文件...">
+            <input type="text" class="search-box" id="searchBox" placeholder="搜索文件，#标签 按标签筛选...">
+            <div class="sidebar-actions">
+                <select class="sidebar-select" id="viewMode" title="显示方式">
+                    <option value="tree">树形</option>
+                    <option value="list">列表</option>
+                </select>
+                <button class="sidebar-button folder-action" onclick="setAllFoldersExpanded(true)" title="展开所有文件夹">全部展开</button>
+                <button class="sidebar-button folder-action" onclick="setAllFoldersExpanded(false)" title="折叠所有文件夹">全部折叠</button>
+                <select class="sidebar-select" id="treeDensity" title="文件树行距">
+                    <option value="normal">标准</option>
+                    <option value="compact">紧凑</option>
+                    <option value="comfortable">宽松</option>
+                </select>
+            </div>
+            <div class="sidebar-actions">
+                <select class="sidebar-select" id="sortMode" title="排序方式">
+                    <option value="name">按名称</option>
+                    <option value="modified">按修改时间</option>
+                    <option value="size">按大小</option>
+                    {{if .SortField}}<option value="frontmatter">按 {{.SortField}}</option>{{end}}
+                </select>
+                <label class="sidebar-option"><input type="checkbox" id="foldersFirst"> 文件夹优先</label>
+                <button class="sidebar-button" id="themeToggle" title="切换配色方案">🎨</button>
+                <button class="sidebar-button" onclick="openRandomNote()" title="随机打开一篇笔记">🎲</button>
+                {{if not .Export}}<a class="sidebar-button" href="stats" title="笔记库统计">📊</a>{{end}}
+            </div>
         </div>
-        <div class="file-tree" id="fileTree"></div>
+        <div class="pinned-section hidden" id="searchSection">
+            <div class="section-title">🔍 最佳匹配</div>
+            <div id="searchResults"></div>
+        </div>
+        <details class="pinned-section hidden" id="tagSection">
+            <summary class="section-title">🏷️ 标签</summary>
+            <div class="tag-tree" id="tagTree"></div>
+        </details>
+        <div class="pinned-section hidden" id="pinnedSection">
+            <div class="section-title">📌 已固定</div>
+            <div id="pinnedList"></div>
+        </div>
+        {{if .TreeRoot}}<div class="tree-root" title="笔记库">🗄️ {{.TreeRoot}}</div>{{end}}
+        <div class="file-tree" id="fileTree" role="tree" aria-label="文件树"></div>
     </div>
     <div class="content-area">
         <div class="content-header">
+            <button class="sidebar-toggle" onclick="toggleSidebar()" title="隐藏/显示侧边栏 (Ctrl+B)">☰</button>
             <h2 id="currentFile">选择一个文件</h2>
+            <span class="last-updated" id="wordCount"></span>
+            <span class="last-updated" id="lastUpdated"></span>
+            <div class="content-actions hidden" id="contentActions">
+                <button class="copy-button" onclick="copyRenderedHTML(this)" title="复制渲染后的 HTML">复制 HTML</button>
+                <button class="copy-button{{if .Export}} hidden{{end}}" onclick="copyMarkdownSource(this)" title="复制原始 markdown">复制源码</button>
+                <button class="copy-button" onclick="copyObsidianURI(this)" title="复制在 Obsidian 中打开该笔记的 obsidian:// 链接">复制 Obsidian 链接</button>
+                <button class="copy-button{{if .Export}} hidden{{end}}" id="splitToggle" onclick="toggleSplitView()" title="左侧显示原始 markdown，右侧显示渲染结果">分栏对照</button>
+                {{if .AllowEdit}}<button class="copy-button" id="editToggle" onclick="editingPath ? cancelEditing() : startEditing()" title="编辑原始 markdown，保存后写回文件">编辑</button>{{end}}
+            </div>
         </div>
-        <div class="content-body">
-            <div class="empty-state" id="emptyState">
-                <h3>👈 从左侧选择文件</h3>
-                <p>选择一个 markdown 文件开始预览</p>
+        <div class="content-panes">
+            <pre class="raw-pane hidden" id="rawPane"></pre>
+            <div class="content-body">
+                <div class="empty-state" id="emptyState">
+                    <h3>👈 从左侧选择文件</h3>
+                    <p>选择一个 markdown 文件开始预览</p>
+                    {{if .Sitemap}}<nav class="sitemap-root">{{.Sitemap}}</nav>{{end}}
+                </div>
+                <div class="markdown-body hidden" id="markdownContent"></div>
+                {{if .AllowEdit}}<div class="note-editor" id="noteEditor">
+                    <textarea id="editorText" spellcheck="false" aria-label="笔记源码"></textarea>
+                    <div class="editor-actions">
+                        <button class="copy-button" onclick="saveEditing()" title="保存 (Ctrl+S)">保存</button>
+                        <button class="copy-button" onclick="cancelEditing()">取消</button>
+                        <span class="editor-status" id="editorStatus"></span>
+                    </div>
+                </div>{{end}}
             </div>
-            <div class="markdown-body hidden" id="markdownContent"></div>
+            <button class="scroll-top-button" id="scrollTopButton" title="回到顶部">↑</button>
         </div>
     </div>
 
@@ -850,20 +7429,97 @@ func generateHTML(outputFile string) error {
     <div class="image-modal" id="imageModal" onclick="closeImageModal()">
         <span class="image-modal-close" onclick="closeImageModal()">&times;</span>
         <img id="modalImage" src="" alt="预览图片">
+        <div class="modal-diagram hidden" id="modalDiagram"></div>
     </div>
 
     <script>
         const fileTreeData = {{.TreeJSON}};
         const filesData = {{.FilesJSON}};
+        const codeFoldLines = {{.CodeFold}};
+        const openNotePath = {{.OpenNote}};
+        const indexFilePath = {{.IndexFile}};
+        const treeStateEnabled = {{.TreeState}};
+        // --base-path 指定的路径前缀，接口地址都需要加上
+        const basePath = {{.BasePath}};
+        // --export 导出的静态页面，没有服务器接口可用
+        const exportMode = {{.Export}};
+        // obsidian:// 链接中的库名称
+        const vaultName = {{.VaultName}};
+        // --open-browser-on-change：笔记被修改时切换到该笔记
+        const followChanges = {{.Follow}};
+        // --hide-extension：侧边栏中的笔记名称不显示扩展名
+        const hideExtension = {{.HideExt}};
+        // --note-types：frontmatter type 属性值（小写）对应的颜色
+        const noteTypeColors = {{.NoteTypes}} || {};
+
+        // 当前显示的笔记路径
+        let currentPath = null;
+
+        // 固定的笔记
+        let pinnedNotes = JSON.parse(localStorage.getItem('obsidian-preview-pinned') || '[]');
+
+        // 路径 -> 树节点，搜索和定位基于完整数据而不是已渲染的 DOM
+        const nodeIndex = new Map();
+        (function indexNodes(nodes) {
+            nodes.forEach(node => {
+                nodeIndex.set(node.path, node);
+                if (node.children) {
+                    indexNodes(node.children);
+                }
+            });
+        })(fileTreeData);
+
+        // 树的排序方式：name / modified / size / frontmatter，浏览器中没有保存时使用 --sort
+        // frontmatter 按 --sort frontmatter:字段 指定的属性排序，服务端未配置该字段时改为按名称
+        const sortField = {{.SortField}};
+        let sortMode = localStorage.getItem('obsidian-preview-sort') || {{.Sort}};
+        if (sortMode === 'frontmatter' && !sortField) {
+            sortMode = 'name';
+        }
+        let foldersFirst = localStorage.getItem('obsidian-preview-folders-first') !== 'false';
+
+        function sortNodes(nodes) {
+            return nodes.slice().sort((a, b) => {
+                // .order 文件中列出的子项按列出的顺序排在最前面，不受排序方式影响
+                if (a.order || b.order) {
+                    if (!a.order) return 1;
+                    if (!b.order) return -1;
+                    return a.order - b.order;
+                }
+                if (foldersFirst && a.isDir !== b.isDir) {
+                    return a.isDir ? -1 : 1;
+                }
+                if (sortMode === 'modified') {
+                    const diff = Date.parse(b.modTime) - Date.parse(a.modTime);
+                    if (diff) return diff;
+                } else if (sortMode === 'size') {
+                    const diff = b.size - a.size;
+                    if (diff) return diff;
+                } else if (sortMode === 'frontmatter') {
+                    // 没有该属性的排在有该属性的之后，属性值相同或都没有时按名称
+                    const hasA = a.weight !== undefined, hasB = b.weight !== undefined;
+                    if (hasA !== hasB) return hasA ? -1 : 1;
+                    const diff = (a.weight || 0) - (b.weight || 0);
+                    if (diff) return diff;
+                }
+                return a.name < b.name ? -1 : (a.name > b.name ? 1 : 0);
+            });
+        }
 
         function renderTree(nodes, container, level = 0, parentItem = null) {
-            nodes.forEach(node => {
+            sortNodes(nodes).forEach(node => {
                 const item = document.createElement('div');
                 item.className = 'tree-item' + (node.isDir ? ' folder' : ' file');
                 item.style.paddingLeft = (level * 16 + 8) + 'px';
+                // 键盘只能通过 Tab 进入树中的一项，其余项用方向键移动（见 handleTreeKeydown）
+                item.setAttribute('role', 'treeitem');
+                item.setAttribute('aria-level', level + 1);
+                item.setAttribute('aria-selected', 'false');
+                item.tabIndex = container.querySelector('.tree-item') || container.classList.contains('tree-children') ? -1 : 0;
                 
                 const icon = document.createElement('span');
                 icon.className = 'tree-item-icon';
+                icon.setAttribute('aria-hidden', 'true');
                 
                 if (node.isDir && node.children && node.children.length > 0) {
                     icon.textContent = '▶';
@@ -871,50 +7527,74 @@ func generateHTML(outputFile string) error {
                     icon.style.transform = 'rotate(0deg)';
                     icon.style.transition = 'transform 0.2s';
                     icon.dataset.expanded = 'false';
+                    item.setAttribute('aria-expanded', 'false');
                     
                     icon.addEventListener('click', (e) => {
                         e.stopPropagation();
-                        const expanded = icon.dataset.expanded === 'true';
-                        const childrenContainer = item.nextElementSibling;
-                        
-                        if (expanded) {
-                            icon.dataset.expanded = 'false';
-                            icon.style.transform = 'rotate(0deg)';
-                            if (childrenContainer) {
-                                childrenContainer.classList.add('collapsed');
-                            }
-                        } else {
-                            icon.dataset.expanded = 'true';
-                            icon.style.transform = 'rotate(90deg)';
-                            if (childrenContainer) {
-                                childrenContainer.classList.remove('collapsed');
-                            }
-                        }
+                        setFolderExpanded(icon, icon.dataset.expanded !== 'true');
                     });
                 } else if (node.isDir) {
                     icon.textContent = '📁';
                 } else {
-                    icon.textContent = '📄';
+                    icon.textContent = fileIcon(node.path);
                 }
                 
+                item.dataset.path = node.path;
+
                 const name = document.createElement('span');
-                name.textContent = node.name;
+                name.className = 'tree-item-name';
+                name.textContent = node.isDir ? node.name : noteDisplayName(node.name);
                 
                 item.appendChild(icon);
+                if (node.type) {
+                    item.appendChild(noteTypeDot(node.type));
+                }
                 item.appendChild(name);
+
+                if (node.isDir && node.count) {
+                    const count = document.createElement('span');
+                    count.className = 'tree-item-count';
+                    count.textContent = node.count;
+                    count.title = node.count + ' 个笔记' + (node.words ? '，共 ' + node.words + ' 字' : '');
+                    item.appendChild(count);
+                }
+
+                if (!node.isDir) {
+                    const pin = document.createElement('span');
+                    pin.className = 'pin-button';
+                    pin.textContent = '📌';
+                    pin.title = '固定到顶部';
+                    pin.setAttribute('aria-hidden', 'true');
+                    pin.addEventListener('click', (e) => {
+                        e.stopPropagation();
+                        togglePin(node.path);
+                    });
+                    item.appendChild(pin);
+                    item.classList.toggle('pinned', pinnedNotes.includes(node.path));
+                }
                 
                 if (!node.isDir) {
                     item.addEventListener('click', () => {
-                        document.querySelectorAll('.tree-item').forEach(el => {
-                            el.classList.remove('active');
-                        });
-                        item.classList.add('active');
+                        setActiveTreeItem(item);
                         showFile(node.path);
                     });
                 } else {
+                    if (node.folderNote) {
+                        item.classList.add('has-folder-note');
+                        item.title = '打开文件夹笔记 ' + node.folderNote;
+                    }
                     item.addEventListener('click', (e) => {
                         if (e.target === icon) return;
                         const expandIcon = item.querySelector('.expandable');
+                        // 有文件夹笔记时打开笔记并展开文件夹，再次点击才折叠
+                        if (node.folderNote && !item.classList.contains('active')) {
+                            setActiveTreeItem(item);
+                            showFile(node.folderNote);
+                            if (expandIcon) {
+                                setFolderExpanded(expandIcon, true);
+                            }
+                            return;
+                        }
                         if (expandIcon) {
                             expandIcon.click();
                         }
@@ -926,50 +7606,678 @@ func generateHTML(outputFile string) error {
                 if (node.isDir && node.children && node.children.length > 0) {
                     const childrenContainer = document.createElement('div');
                     childrenContainer.className = 'tree-children collapsed';
+                    // 子项容器与文件夹项是兄弟节点，通过 aria-owns 关联
+                    childrenContainer.id = 'tree-group-' + (++treeGroupCount);
+                    childrenContainer.setAttribute('role', 'group');
+                    item.setAttribute('aria-owns', childrenContainer.id);
+                    // 子项在首次展开时才渲染，避免大型笔记库一次性创建所有节点
+                    childrenContainer.renderChildren = () => {
+                        renderTree(node.children, childrenContainer, level + 1, item);
+                    };
                     container.appendChild(childrenContainer);
-                    renderTree(node.children, childrenContainer, level + 1, item);
+                    if (expandedFolders.has(node.path)) {
+                        setFolderExpanded(icon, true);
+                    }
+                }
+            });
+        }
+
+        let treeGroupCount = 0;
+
+        // 选中树中的一项（同一时间只有一项选中），并让 Tab 键回到这一项
+        function setActiveTreeItem(item) {
+            document.querySelectorAll('.tree-item').forEach(el => {
+                el.classList.remove('active');
+                if (el.hasAttribute('aria-selected')) {
+                    el.setAttribute('aria-selected', 'false');
+                }
+            });
+            item.classList.add('active');
+            if (item.getAttribute('role') === 'treeitem') {
+                item.setAttribute('aria-selected', 'true');
+                setTreeFocusItem(item);
+            }
+        }
+
+        // 漫游 tabindex：树中只有一项可以通过 Tab 键聚焦
+        function setTreeFocusItem(item) {
+            document.querySelectorAll('#fileTree .tree-item[tabindex="0"]').forEach(el => {
+                el.tabIndex = -1;
+            });
+            item.tabIndex = 0;
+        }
+
+        // 当前可见（未折叠、未被搜索隐藏）的树节点，按显示顺序排列
+        function visibleTreeItems() {
+            return Array.from(document.querySelectorAll('#fileTree .tree-item'))
+                .filter(item => !item.classList.contains('hidden') && !item.closest('.tree-children.collapsed'));
+        }
+
+        // 文件树的键盘操作：上下移动，右展开或进入子项，左折叠或回到上级，Home / End 到首尾，Enter / 空格打开
+        function handleTreeKeydown(e) {
+            const item = e.target.closest('.tree-item');
+            if (!item || e.altKey || e.ctrlKey || e.metaKey) return;
+            const items = visibleTreeItems();
+            const index = items.indexOf(item);
+            const icon = item.querySelector('.expandable');
+            const expanded = icon && icon.dataset.expanded === 'true';
+            let next = null;
+            switch (e.key) {
+                case 'ArrowDown':
+                    next = items[index + 1];
+                    break;
+                case 'ArrowUp':
+                    next = items[index - 1];
+                    break;
+                case 'Home':
+                    next = items[0];
+                    break;
+                case 'End':
+                    next = items[items.length - 1];
+                    break;
+                case 'ArrowRight':
+                    if (icon && !expanded) {
+                        setFolderExpanded(icon, true);
+                    } else if (expanded) {
+                        next = item.nextElementSibling.querySelector('.tree-item:not(.hidden)');
+                    }
+                    break;
+                case 'ArrowLeft':
+                    if (expanded) {
+                        setFolderExpanded(icon, false);
+                    } else {
+                        const group = item.parentElement.closest('.tree-children');
+                        next = group ? group.previousElementSibling : null;
+                    }
+                    break;
+                case 'Enter':
+                case ' ':
+                    item.click();
+                    break;
+                default:
+                    return;
+            }
+            e.preventDefault();
+            if (next) {
+                setTreeFocusItem(next);
+                next.focus();
+            }
+        }
+
+        // 随机打开一篇笔记（不含当前笔记和索引类笔记）
+        function openRandomNote() {
+            const paths = [];
+            nodeIndex.forEach((node, path) => {
+                if (!node.isDir && !node.index && path !== currentPath) {
+                    paths.push(path);
+                }
+            });
+            if (paths.length > 0) {
+                openNote(paths[Math.floor(Math.random() * paths.length)]);
+            }
+        }
+
+        // 固定 / 取消固定笔记
+        function togglePin(path) {
+            if (pinnedNotes.includes(path)) {
+                pinnedNotes = pinnedNotes.filter(p => p !== path);
+            } else {
+                pinnedNotes.push(path);
+            }
+            localStorage.setItem('obsidian-preview-pinned', JSON.stringify(pinnedNotes));
+            document.querySelectorAll('#fileTree .tree-item.file').forEach(item => {
+                item.classList.toggle('pinned', pinnedNotes.includes(item.dataset.path));
+            });
+            renderPinned();
+        }
+
+        // 渲染侧边栏顶部的固定笔记列表，已不存在的笔记不显示
+        function renderPinned() {
+            const section = document.getElementById('pinnedSection');
+            const list = document.getElementById('pinnedList');
+            list.innerHTML = '';
+            const paths = pinnedNotes.filter(path => filesData[path] !== undefined);
+            section.classList.toggle('hidden', paths.length === 0);
+
+            paths.forEach(path => {
+                const item = document.createElement('div');
+                item.className = 'tree-item file';
+                item.title = path;
+                item.dataset.path = path;
+
+                const icon = document.createElement('span');
+                icon.className = 'tree-item-icon';
+                icon.textContent = fileIcon(path);
+
+                const name = document.createElement('span');
+                name.className = 'tree-item-name';
+                name.textContent = noteDisplayName(path.split('/').pop());
+
+                const unpin = document.createElement('span');
+                unpin.className = 'pin-button';
+                unpin.textContent = '✕';
+                unpin.title = '取消固定';
+                unpin.addEventListener('click', (e) => {
+                    e.stopPropagation();
+                    togglePin(path);
+                });
+
+                item.appendChild(icon);
+                item.appendChild(name);
+                item.appendChild(unpin);
+                item.addEventListener('click', () => openNote(path));
+                list.appendChild(item);
+            });
+        }
+
+        // 展开的文件夹路径，基于树数据而不是已渲染的 DOM，
+        // 尚未渲染的子文件夹在上级文件夹展开时恢复展开状态
+        const expandedFolders = new Set();
+
+        // 设置文件夹的展开状态
+        function setFolderExpanded(icon, expanded) {
+            const path = icon.parentElement.dataset.path;
+            if (expanded) {
+                expandedFolders.add(path);
+            } else {
+                expandedFolders.delete(path);
+            }
+            icon.dataset.expanded = expanded ? 'true' : 'false';
+            icon.parentElement.setAttribute('aria-expanded', expanded ? 'true' : 'false');
+            icon.style.transform = expanded ? 'rotate(90deg)' : 'rotate(0deg)';
+            const childrenContainer = icon.parentElement.nextElementSibling;
+            if (childrenContainer && childrenContainer.classList.contains('tree-children')) {
+                if (expanded && childrenContainer.renderChildren) {
+                    childrenContainer.renderChildren();
+                    delete childrenContainer.renderChildren;
+                }
+                childrenContainer.classList.toggle('collapsed', !expanded);
+                // 折叠后 Tab 键无法到达其中的项，改为聚焦文件夹
+                if (!expanded && childrenContainer.querySelector('.tree-item[tabindex="0"]')) {
+                    setTreeFocusItem(icon.parentElement);
+                }
+            }
+            scheduleTreeStateSave();
+        }
+
+        // 服务端保存的展开状态（--tree-state），变化后延迟保存，合并连续的操作
+        let treeStateTimer = null;
+        let treeStateLoaded = false;
+        function scheduleTreeStateSave() {
+            if (!treeStateEnabled || !treeStateLoaded) return;
+            clearTimeout(treeStateTimer);
+            treeStateTimer = setTimeout(() => {
+                // 已不存在的文件夹不再保存
+                const expanded = Array.from(expandedFolders).filter(path => nodeIndex.has(path));
+                fetch(basePath + '/api/tree-state', {
+                    method: 'PUT',
+                    headers: { 'Content-Type': 'application/json' },
+                    body: JSON.stringify({ expanded: expanded })
+                }).catch(() => {});
+            }, 500);
+        }
+
+        function loadTreeState() {
+            if (!treeStateEnabled) return;
+            fetch(basePath + '/api/tree-state').then(resp => resp.json()).then(state => {
+                state.expanded.forEach(path => expandedFolders.add(path));
+                if (listRendered) {
+                    return;
                 }
+                // 只展开已渲染的文件夹，其余的在上级文件夹展开时由 renderTree 恢复
+                state.expanded.forEach(path => {
+                    const icon = document.querySelector('#fileTree .tree-item[data-path="' + CSS.escape(path) + '"] .expandable');
+                    if (icon && icon.dataset.expanded !== 'true') {
+                        setFolderExpanded(icon, true);
+                    }
+                });
+            }).catch(() => {}).finally(() => {
+                treeStateLoaded = true;
             });
         }
 
+        // 全部展开 / 全部折叠
+        function setAllFoldersExpanded(expanded) {
+            if (!expanded) {
+                document.querySelectorAll('#fileTree .expandable').forEach(icon => {
+                    setFolderExpanded(icon, false);
+                });
+                expandedFolders.clear();
+                scheduleTreeStateSave();
+                return;
+            }
+            // 展开时会渲染出新的子文件夹，重复直到全部展开
+            let icons;
+            while ((icons = document.querySelectorAll('#fileTree .expandable[data-expanded="false"]')).length > 0) {
+                icons.forEach(icon => setFolderExpanded(icon, true));
+            }
+        }
+
         function showFile(path) {
             const contentDiv = document.getElementById('markdownContent');
             const emptyState = document.getElementById('emptyState');
             const currentFile = document.getElementById('currentFile');
             
             const content = filesData[path];
+            if (editingPath && path !== editingPath) {
+                stopEditing();
+            }
             
             if (content) {
                 contentDiv.innerHTML = content;
+
+                // 排版数学公式，需要在处理代码块之前，公式块不显示为代码块
+                renderMath(contentDiv);
                 
-                // 处理代码块：添加复制按钮
+                // 处理代码块：添加复制按钮（包括嵌入笔记中的代码块）
                 processCodeBlocks(contentDiv);
+
+                // 恢复可折叠 callout 的展开状态
+                restoreCalloutStates(contentDiv, path);
                 
                 // 初始化 Mermaid 图表
                 if (typeof mermaid !== 'undefined') {
+                    // 图表配色跟随当前配色方案
+                    const style = getComputedStyle(document.documentElement);
+                    const cssVar = (name) => style.getPropertyValue(name).trim();
                     mermaid.initialize({ 
                         startOnLoad: true,
-                        theme: 'dark',
+                        theme: style.colorScheme === 'light' ? 'default' : 'dark',
+                        // 按原始大小绘制，超出内容区域时横向滚动，而不是缩小到看不清
+                        flowchart: { useMaxWidth: false },
+                        sequence: { useMaxWidth: false },
+                        gantt: { useMaxWidth: false },
+                        timeline: { useMaxWidth: false },
                         themeVariables: {
-                            primaryColor: '#007acc',
-                            primaryTextColor: '#d4d4d4',
-                            primaryBorderColor: '#3e3e42',
-                            lineColor: '#4ec9b0',
-                            secondaryColor: '#252526',
-                            tertiaryColor: '#1e1e1e'
+                            primaryColor: cssVar('--accent'),
+                            primaryTextColor: cssVar('--text'),
+                            primaryBorderColor: cssVar('--border'),
+                            lineColor: cssVar('--accent-alt'),
+                            secondaryColor: cssVar('--bg-sidebar'),
+                            tertiaryColor: cssVar('--bg')
                         }
                     });
+                    // 默认处理页面中所有 .mermaid 元素，包括嵌入笔记中的图表
                     mermaid.run();
                 }
                 
                 contentDiv.classList.remove('hidden');
                 emptyState.classList.add('hidden');
                 currentFile.textContent = path;
+                currentPath = path;
+                document.getElementById('contentActions').classList.remove('hidden');
             } else {
                 contentDiv.classList.add('hidden');
                 emptyState.classList.remove('hidden');
                 currentFile.textContent = '文件未找到';
+                currentPath = null;
+                document.getElementById('contentActions').classList.add('hidden');
+            }
+            updateRawPane();
+            updateLastUpdated();
+            updateWordCount();
+        }
+
+        // 标题栏显示当前笔记的字数
+        function updateWordCount() {
+            const label = document.getElementById('wordCount');
+            const node = currentPath ? nodeIndex.get(currentPath) : null;
+            label.textContent = node && node.words ? node.words + ' 字' : '';
+            label.title = node && node.index ? '索引类笔记，不计入文件夹字数' : '';
+        }
+
+        // 标题栏显示当前笔记的修改时间，如“2 小时前”
+        function updateLastUpdated() {
+            const label = document.getElementById('lastUpdated');
+            const node = currentPath ? nodeIndex.get(currentPath) : null;
+            const modTime = node ? new Date(node.modTime) : null;
+            if (!modTime || isNaN(modTime) || modTime.getFullYear() <= 1) {
+                label.textContent = '';
+                label.title = '';
+                return;
+            }
+            label.textContent = '更新于 ' + formatRelativeTime(modTime);
+            label.title = modTime.toLocaleString();
+        }
+
+        function formatRelativeTime(date) {
+            const seconds = Math.max(0, (Date.now() - date.getTime()) / 1000);
+            const units = [
+                [60 * 60 * 24 * 365, '年'],
+                [60 * 60 * 24 * 30, '个月'],
+                [60 * 60 * 24 * 7, '周'],
+                [60 * 60 * 24, '天'],
+                [60 * 60, '小时'],
+                [60, '分钟']
+            ];
+            for (const [size, unit] of units) {
+                if (seconds >= size) {
+                    return Math.floor(seconds / size) + ' ' + unit + '前';
+                }
+            }
+            return '刚刚';
+        }
+
+        // 相对时间随时间推移更新
+        setInterval(updateLastUpdated, 60 * 1000);
+
+        // 分栏对照：左侧显示原始 markdown，右侧显示渲染结果
+        let splitView = !exportMode && localStorage.getItem('obsidian-preview-split') === 'true';
+
+        function toggleSplitView() {
+            splitView = !splitView;
+            localStorage.setItem('obsidian-preview-split', splitView ? 'true' : 'false');
+            updateRawPane();
+        }
+
+        // 从接口的 JSON 错误响应中取出错误信息，解析失败时退回状态文本
+        function responseError(resp) {
+            return resp.json().then(body => {
+                throw new Error((body && body.error) || resp.statusText);
+            }, () => {
+                throw new Error(resp.statusText);
+            });
+        }
+
+        function updateRawPane() {
+            const rawPane = document.getElementById('rawPane');
+            document.getElementById('splitToggle').classList.toggle('active', splitView);
+            rawPane.classList.toggle('hidden', !splitView || !currentPath);
+            if (!splitView || !currentPath) return;
+
+            const path = currentPath;
+            rawPane.innerHTML = '<span class="spinner"></span>加载中...';
+            fetch(basePath + '/api/raw?path=' + encodeURIComponent(path)).then(resp => {
+                if (!resp.ok) {
+                    return responseError(resp);
+                }
+                return resp.text();
+            }).then(text => {
+                if (path === currentPath) {
+                    rawPane.textContent = text;
+                    syncScroll(document.querySelector('.content-body'), rawPane);
+                }
+            }).catch(err => {
+                if (path === currentPath) {
+                    rawPane.textContent = '无法加载源码: ' + err.message;
+                }
+            });
+        }
+
+        // 编辑模式（--allow-edit）：在文本框中修改原始 markdown，保存后由文件监听重新渲染并推送到页面
+        const allowEdit = {{.AllowEdit}};
+        let editingPath = null;
+        let editorETag = null;
+        let editorOriginal = '';
+        // 编辑期间收到需要刷新页面的通知时，推迟到结束编辑后再刷新
+        let reloadPending = false;
+
+        function editorDirty() {
+            return editingPath !== null && document.getElementById('editorText').value !== editorOriginal;
+        }
+
+        function confirmLeaveEditor() {
+            return !editorDirty() || confirm('放弃未保存的修改？');
+        }
+
+        function setEditing(on) {
+            document.querySelector('.content-body').classList.toggle('editing', on);
+            document.getElementById('editToggle').classList.toggle('active', on);
+        }
+
+        function startEditing() {
+            if (!allowEdit || !currentPath || editingPath) return;
+            const path = currentPath;
+            fetch(basePath + '/api/raw?path=' + encodeURIComponent(path), { cache: 'no-cache' }).then(resp => {
+                if (!resp.ok) {
+                    return responseError(resp);
+                }
+                editorETag = resp.headers.get('ETag');
+                return resp.text();
+            }).then(text => {
+                if (path !== currentPath) return;
+                const textarea = document.getElementById('editorText');
+                editingPath = path;
+                editorOriginal = text;
+                textarea.value = text;
+                document.getElementById('editorStatus').textContent = '';
+                setEditing(true);
+                textarea.focus();
+            }).catch(err => {
+                alert('无法加载源码: ' + err.message);
+            });
+        }
+
+        function stopEditing() {
+            editingPath = null;
+            setEditing(false);
+            if (reloadPending) {
+                reloadPending = false;
+                reloadPage(null);
+            }
+        }
+
+        function cancelEditing() {
+            if (confirmLeaveEditor()) {
+                stopEditing();
+            }
+        }
+
+        function saveEditing() {
+            const path = editingPath;
+            const text = document.getElementById('editorText').value;
+            const status = document.getElementById('editorStatus');
+            const headers = { 'Content-Type': 'text/markdown; charset=utf-8' };
+            if (editorETag) {
+                headers['If-Match'] = editorETag;
+            }
+            status.textContent = '保存中...';
+            fetch(basePath + '/api/save?path=' + encodeURIComponent(path), { method: 'POST', headers, body: text }).then(resp => {
+                if (!resp.ok) {
+                    return responseError(resp);
+                }
+                if (path === editingPath) {
+                    stopEditing();
+                }
+            }).catch(err => {
+                status.textContent = '保存失败: ' + err.message;
+            });
+        }
+
+        if (allowEdit) {
+            document.getElementById('editorText').addEventListener('keydown', (e) => {
+                if ((e.ctrlKey || e.metaKey) && !e.altKey && !e.shiftKey && e.key.toLowerCase() === 's') {
+                    e.preventDefault();
+                    saveEditing();
+                }
+            });
+            window.addEventListener('beforeunload', (e) => {
+                if (editorDirty()) {
+                    e.preventDefault();
+                    e.returnValue = '';
+                }
+            });
+        }
+
+        // 按滚动比例同步两个窗格，忽略由同步本身触发的滚动事件
+        let syncingPane = null;
+        function syncScroll(from, to) {
+            const range = from.scrollHeight - from.clientHeight;
+            const ratio = range > 0 ? from.scrollTop / range : 0;
+            const target = Math.round(ratio * (to.scrollHeight - to.clientHeight));
+            if (target !== Math.round(to.scrollTop)) {
+                syncingPane = to;
+                to.scrollTop = target;
+            }
+        }
+
+        [[document.querySelector('.content-body'), document.getElementById('rawPane')],
+         [document.getElementById('rawPane'), document.querySelector('.content-body')]].forEach(([from, to]) => {
+            from.addEventListener('scroll', () => {
+                if (syncingPane === from) {
+                    syncingPane = null;
+                    return;
+                }
+                if (splitView) {
+                    syncScroll(from, to);
+                }
+            });
+        });
+
+        // 回到顶部按钮：正文滚动超过一屏的一半后显示
+        const scrollTopButton = document.getElementById('scrollTopButton');
+        const contentBody = document.querySelector('.content-body');
+        contentBody.addEventListener('scroll', () => {
+            scrollTopButton.classList.toggle('visible', contentBody.scrollTop > contentBody.clientHeight / 2);
+        });
+        scrollTopButton.addEventListener('click', () => {
+            contentBody.scrollTo({ top: 0, behavior: 'smooth' });
+        });
+
+        // 展开指定路径的所有上级文件夹，使对应的树节点被渲染出来
+        function revealTreePath(path) {
+            const parts = path.split('/');
+            for (let i = 1; i < parts.length; i++) {
+                const dirPath = parts.slice(0, i).join('/');
+                const icon = document.querySelector('#fileTree .tree-item[data-path="' + CSS.escape(dirPath) + '"] .expandable');
+                if (icon && icon.dataset.expanded !== 'true') {
+                    setFolderExpanded(icon, true);
+                }
+            }
+            return document.querySelector('#fileTree .tree-item[data-path="' + CSS.escape(path) + '"]');
+        }
+
+        // 在树中选中并展开到指定文件
+        function selectTreeItem(path) {
+            document.querySelectorAll('.tree-item').forEach(el => {
+                el.classList.remove('active');
+            });
+            const item = revealTreePath(path);
+            if (!item) return;
+            setActiveTreeItem(item);
+            item.scrollIntoView({ block: 'nearest' });
+        }
+
+        // 在文件树中展开并选中文件夹，用于指向没有文件夹笔记的文件夹的 wikilink
+        function revealFolder(path) {
+            toggleSidebar(false);
+            const item = revealTreePath(path);
+            if (!item) return;
+            const icon = item.querySelector('.expandable');
+            if (icon && icon.dataset.expanded !== 'true') {
+                setFolderExpanded(icon, true);
+            }
+            setActiveTreeItem(item);
+            item.scrollIntoView({ block: 'nearest' });
+        }
+
+        // 打开笔记，可选滚动到指定标题
+        function openNote(path, heading) {
+            if (editingPath && path !== editingPath && !confirmLeaveEditor()) return;
+            selectTreeItem(path);
+            showFile(path);
+            if (heading) {
+                // 按标题文本（不区分大小写）或 --heading-ids 生成的 id 匹配
+                const wanted = heading.trim().toLowerCase();
+                const target = Array.from(document.querySelectorAll('#markdownContent h1, #markdownContent h2, #markdownContent h3, #markdownContent h4, #markdownContent h5, #markdownContent h6'))
+                    .find(h => h.textContent.trim().toLowerCase() === wanted || h.id === heading.trim());
+                if (target) {
+                    target.scrollIntoView();
+                }
+            }
+        }
+
+        // 可折叠 callout 的展开状态，按笔记保存：{ 路径: { 标识: 是否展开 } }
+        const calloutStates = JSON.parse(localStorage.getItem('obsidian-preview-callouts') || '{}');
+
+        // callout 的标识由其在笔记中的序号和标题组成，笔记修改后仍能大致对应
+        function calloutKey(details, index) {
+            const summary = details.querySelector('summary');
+            if (!summary) return index + ':';
+            // 不含图标，修改图标配置后仍能对应
+            const icon = summary.querySelector('.callout-icon');
+            const text = summary.textContent.slice(icon ? icon.textContent.length : 0);
+            return index + ':' + text.trim();
+        }
+
+        function restoreCalloutStates(container, path) {
+            const saved = calloutStates[path] || {};
+            container.querySelectorAll('details.callout').forEach((details, index) => {
+                const key = calloutKey(details, index);
+                details.dataset.calloutKey = key;
+                details.dataset.defaultOpen = details.open;
+                if (key in saved) {
+                    details.open = saved[key];
+                }
+            });
+        }
+
+        // toggle 事件不冒泡，在捕获阶段统一处理
+        document.getElementById('markdownContent').addEventListener('toggle', (e) => {
+            const details = e.target;
+            if (!currentPath || !details.matches || !details.matches('details.callout')) return;
+            const saved = calloutStates[currentPath] || (calloutStates[currentPath] = {});
+            // 只记录与笔记中默认状态不同的 callout
+            if (String(details.open) === details.dataset.defaultOpen) {
+                delete saved[details.dataset.calloutKey];
+            } else {
+                saved[details.dataset.calloutKey] = details.open;
+            }
+            if (Object.keys(saved).length === 0) {
+                delete calloutStates[currentPath];
+            }
+            localStorage.setItem('obsidian-preview-callouts', JSON.stringify(calloutStates));
+        }, true);
+
+        // 标签点击：按标签筛选侧边栏
+        document.getElementById('markdownContent').addEventListener('click', (e) => {
+            const link = e.target.closest('a.tag');
+            if (!link) return;
+            e.preventDefault();
+            filterByTag(link.dataset.tag.toLowerCase());
+        });
+
+        // 页内锚点链接 [跳转](#标题)：笔记内容是插入到页面中的，滚动到当前笔记中的对应元素
+        document.getElementById('markdownContent').addEventListener('click', (e) => {
+            const link = e.target.closest('a[href^="#"]');
+            if (!link || link.classList.contains('wikilink') || link.getAttribute('href') === '#') return;
+            e.preventDefault();
+            let id = link.getAttribute('href').slice(1);
+            try {
+                id = decodeURIComponent(id);
+            } catch (err) {
+                // 保留原始的 id
+            }
+            const content = document.getElementById('markdownContent');
+            const target = content.querySelector('[id="' + CSS.escape(id) + '"], a[name="' + CSS.escape(id) + '"]');
+            if (target) {
+                target.scrollIntoView();
+            }
+        });
+
+        // wikilink 点击：在预览内跳转（包括空状态中的笔记索引）
+        ['markdownContent', 'emptyState'].forEach(id => document.getElementById(id).addEventListener('click', (e) => {
+            const link = e.target.closest('a.wikilink');
+            if (!link) return;
+            e.preventDefault();
+            if (link.dataset.path) {
+                openNote(link.dataset.path, link.dataset.heading);
+            } else if (link.dataset.folder) {
+                revealFolder(link.dataset.folder);
             }
+        }));
+
+        // 使用 KaTeX 排版 --math 生成的公式，范围是整篇笔记，包括 callout、表格和嵌入笔记中的公式；
+        // 行内公式为 <code class="language-math">，公式块外面还有 <pre>（与 math 语言的代码块相同）
+        function renderMath(container) {
+            if (typeof katex === 'undefined') return;
+            container.querySelectorAll('code.language-math').forEach(code => {
+                const pre = code.parentElement.tagName === 'PRE' ? code.parentElement : null;
+                const math = document.createElement(pre ? 'div' : 'span');
+                math.className = pre ? 'math math-display' : 'math math-inline';
+                katex.render(code.textContent, math, { displayMode: pre !== null, throwOnError: false });
+                (pre || code).replaceWith(math);
+            });
         }
 
         // 处理代码块：添加复制按钮
@@ -997,7 +8305,7 @@ func generateHTML(outputFile string) error {
                         break;
                     }
                 }
-                const code = preCode.textContent;
+                const code = codeSourceText(preCode);
                 
                 // 创建包装器
                 const wrapper = document.createElement('div');
@@ -1019,20 +8327,80 @@ func generateHTML(outputFile string) error {
                 
                 // 包装 pre 元素
                 const newPre = document.createElement('pre');
-                newPre.appendChild(preCode.cloneNode(true));
+                // 保留 chroma 等 class，高亮样式依赖它们
+                newPre.className = pre.className;
+                const newCode = preCode.cloneNode(true);
+                if (language === 'diff') {
+                    highlightDiffLines(newCode, code);
+                }
+                newPre.appendChild(newCode);
                 
                 wrapper.appendChild(header);
                 wrapper.appendChild(newPre);
+
+                // 长代码块默认折叠，复制按钮仍复制完整代码
+                const lineCount = code.replace(/\n$/, '').split('\n').length;
+                if (codeFoldLines > 0 && lineCount > codeFoldLines) {
+                    const foldedHeight = (codeFoldLines * 14 * 1.45 + 32) + 'px';
+                    const moreText = '显示剩余 ' + (lineCount - codeFoldLines) + ' 行';
+                    const expander = document.createElement('button');
+                    expander.className = 'code-expander';
+                    expander.textContent = moreText;
+                    expander.onclick = function() {
+                        const folded = wrapper.classList.toggle('folded');
+                        newPre.style.maxHeight = folded ? foldedHeight : '';
+                        expander.textContent = folded ? moreText : '收起';
+                    };
+                    wrapper.classList.add('foldable', 'folded');
+                    newPre.style.maxHeight = foldedHeight;
+                    wrapper.appendChild(expander);
+                }
                 
                 // 替换原来的 pre
                 pre.parentNode.replaceChild(wrapper, pre);
             });
         }
 
+        // diff 代码块按行着色：+ 开头为新增，- 开头为删除，@@ 为位置标记
+        // 每行的文本保持不变，复制按钮仍复制带 +/- 标记的原始内容
+        function highlightDiffLines(codeEl, code) {
+            codeEl.textContent = '';
+            code.replace(/\n$/, '').split('\n').forEach(line => {
+                const span = document.createElement('span');
+                span.className = 'diff-line';
+                if (/^(\+\+\+|---|diff |index )/.test(line)) {
+                    span.classList.add('diff-header');
+                } else if (line.startsWith('+')) {
+                    span.classList.add('diff-add');
+                } else if (line.startsWith('-')) {
+                    span.classList.add('diff-del');
+                } else if (line.startsWith('@@')) {
+                    span.classList.add('diff-hunk');
+                }
+                span.textContent = line + '\n';
+                codeEl.appendChild(span);
+            });
+        }
+
+        // 获取代码块的原始文本，排除行号和高亮标记
+        // 优先使用渲染时保存的 data-source，否则去掉行号元素后取文本（保留末尾换行）
+        function codeSourceText(codeEl) {
+            if (codeEl.dataset.source !== undefined) {
+                return codeEl.dataset.source;
+            }
+            const clone = codeEl.cloneNode(true);
+            clone.querySelectorAll('.line-number, .ln, .lnt').forEach(el => el.remove());
+            return clone.textContent;
+        }
+
         // 复制代码功能
         function copyCode(button) {
-            const code = button.dataset.code;
-            navigator.clipboard.writeText(code).then(() => {
+            copyText(button, button.dataset.code);
+        }
+
+        // 复制文本（或文本的 Promise）到剪贴板，并在按钮上显示反馈
+        function copyText(button, text) {
+            Promise.resolve(text).then(value => navigator.clipboard.writeText(value)).then(() => {
                 const originalText = button.textContent;
                 button.textContent = '已复制!';
                 button.classList.add('copied');
@@ -1046,33 +8414,367 @@ func generateHTML(outputFile string) error {
             });
         }
 
+        // 复制当前笔记渲染后的 HTML
+        function copyRenderedHTML(button) {
+            copyText(button, document.getElementById('markdownContent').innerHTML);
+        }
+
+        // 复制在 Obsidian 中打开当前笔记的链接，便于从预览跳回编辑
+        function copyObsidianURI(button) {
+            if (!currentPath) return;
+            copyText(button, 'obsidian://open?vault=' + encodeURIComponent(vaultName) + '&file=' + encodeURIComponent(currentPath));
+        }
+
+        // 复制当前笔记的原始 markdown
+        function copyMarkdownSource(button) {
+            if (!currentPath) return;
+            copyText(button, fetch(basePath + '/api/raw?path=' + encodeURIComponent(currentPath)).then(resp => {
+                if (!resp.ok) {
+                    return responseError(resp);
+                }
+                return resp.text();
+            }));
+        }
+
         // 图片预览功能
         function openImageModal(src) {
             const modal = document.getElementById('imageModal');
             const modalImg = document.getElementById('modalImage');
             modalImg.src = src;
+            modalImg.classList.remove('hidden');
+            document.getElementById('modalDiagram').classList.add('hidden');
             modal.classList.add('active');
         }
 
+        // Mermaid 图表在同一个预览框中放大，按 viewBox 缩放到适合窗口
+        function openDiagramModal(svg) {
+            const clone = svg.cloneNode(true);
+            clone.removeAttribute('width');
+            clone.removeAttribute('height');
+            clone.style.maxWidth = '';
+            const diagram = document.getElementById('modalDiagram');
+            diagram.replaceChildren(clone);
+            diagram.classList.remove('hidden');
+            document.getElementById('modalImage').classList.add('hidden');
+            document.getElementById('imageModal').classList.add('active');
+        }
+
         function closeImageModal() {
             const modal = document.getElementById('imageModal');
             modal.classList.remove('active');
+            document.getElementById('modalDiagram').replaceChildren();
         }
 
+        // 点击图表放大，图表中的链接照常打开
+        document.getElementById('markdownContent').addEventListener('click', (e) => {
+            const diagram = e.target.closest('.mermaid, .mermaid-svg');
+            const svg = diagram && diagram.querySelector('svg');
+            if (svg && !e.target.closest('a')) {
+                openDiagramModal(svg);
+            }
+        });
+
         document.addEventListener('keydown', (e) => {
             if (e.key === 'Escape') {
                 closeImageModal();
             }
+            // Ctrl+B / Cmd+B 隐藏或显示侧边栏
+            if ((e.ctrlKey || e.metaKey) && !e.altKey && !e.shiftKey && e.key.toLowerCase() === 'b') {
+                e.preventDefault();
+                toggleSidebar();
+            }
+        });
+
+        // 侧边栏的隐藏状态保存在浏览器中
+        function toggleSidebar(hidden = !document.body.classList.contains('sidebar-hidden')) {
+            document.body.classList.toggle('sidebar-hidden', hidden);
+            localStorage.setItem('obsidian-preview-sidebar-hidden', hidden ? 'true' : 'false');
+        }
+        toggleSidebar(localStorage.getItem('obsidian-preview-sidebar-hidden') === 'true');
+
+        // 以 # 开头的搜索词按标签筛选，返回小写的标签名，否则返回 null
+        function tagQuery(term) {
+            return term.length > 1 && term.startsWith('#') ? term.slice(1) : null;
+        }
+
+        // 笔记类型的圆点，未配置颜色的类型使用默认颜色
+        function noteTypeDot(type) {
+            const dot = document.createElement('span');
+            dot.className = 'note-type-dot';
+            dot.title = '类型：' + type;
+            const color = noteTypeColors[type.toLowerCase()];
+            if (color) {
+                dot.style.background = color;
+            }
+            return dot;
+        }
+
+        // 侧边栏中显示的笔记名称，--hide-extension 时去掉 markdown 笔记的扩展名（表格和画布文件保留）
+        function noteDisplayName(name) {
+            if (!hideExtension || /\.(csv|tsv|canvas)$/i.test(name)) return name;
+            const dot = name.lastIndexOf('.');
+            return dot > 0 ? name.slice(0, dot) : name;
+        }
+
+        // 表格文件（--csv）和画布文件使用单独的图标
+        function fileIcon(path) {
+            if (/\.(csv|tsv)$/i.test(path)) return '📊';
+            if (/\.canvas$/i.test(path)) return '🗺️';
+            return '📄';
+        }
+
+        // 笔记是否带有指定标签，嵌套标签的子标签也算匹配（#project 匹配 #project/a）
+        function hasTag(node, tag) {
+            if (!node || !node.tags) return false;
+            return node.tags.some(t => {
+                t = t.toLowerCase();
+                return t === tag || t.startsWith(tag + '/');
+            });
+        }
+
+        // 标签浏览：按 / 拆分为层级，父标签的数量包含所有子标签的笔记（每个笔记只计一次）
+        function buildTagTree() {
+            const root = { children: new Map() };
+            nodeIndex.forEach((node, path) => {
+                if (node.isDir || !node.tags) return;
+                node.tags.forEach(tag => {
+                    let parent = root;
+                    let full = '';
+                    tag.split('/').filter(part => part).forEach(part => {
+                        full = full ? full + '/' + part : part;
+                        const key = part.toLowerCase();
+                        if (!parent.children.has(key)) {
+                            parent.children.set(key, { name: part, tag: full.toLowerCase(), notes: new Set(), children: new Map() });
+                        }
+                        parent = parent.children.get(key);
+                        parent.notes.add(path);
+                    });
+                });
+            });
+            return root;
+        }
+
+        function renderTagTree(tags, container, level = 0) {
+            Array.from(tags.values())
+                .sort((a, b) => a.name.localeCompare(b.name))
+                .forEach(tag => {
+                    const item = document.createElement('div');
+                    item.className = 'tree-item tag-item';
+                    item.style.paddingLeft = (level * 16 + 8) + 'px';
+                    item.dataset.tag = tag.tag;
+
+                    const icon = document.createElement('span');
+                    icon.className = 'tree-item-icon';
+                    icon.textContent = tag.children.size > 0 ? '▶' : '#';
+
+                    const name = document.createElement('span');
+                    name.className = 'tree-item-name';
+                    name.textContent = tag.name;
+
+                    const count = document.createElement('span');
+                    count.className = 'tree-item-count';
+                    count.textContent = tag.notes.size;
+                    count.title = tag.notes.size + ' 个笔记';
+
+                    item.appendChild(icon);
+                    item.appendChild(name);
+                    item.appendChild(count);
+                    item.addEventListener('click', () => filterByTag(tag.tag));
+                    container.appendChild(item);
+
+                    if (tag.children.size > 0) {
+                        const children = document.createElement('div');
+                        children.className = 'tree-children collapsed';
+                        renderTagTree(tag.children, children, level + 1);
+                        container.appendChild(children);
+                        icon.classList.add('expandable');
+                        icon.style.transition = 'transform 0.2s';
+                        icon.addEventListener('click', (e) => {
+                            e.stopPropagation();
+                            const collapsed = children.classList.toggle('collapsed');
+                            icon.style.transform = collapsed ? '' : 'rotate(90deg)';
+                        });
+                    }
+                });
+        }
+
+        // 标签区域的展开状态保存在浏览器中
+        const tagSection = document.getElementById('tagSection');
+        const tagTree = buildTagTree();
+        renderTagTree(tagTree.children, document.getElementById('tagTree'));
+        tagSection.classList.toggle('hidden', tagTree.children.size === 0);
+        tagSection.open = localStorage.getItem('obsidian-preview-tags-open') === 'true';
+        tagSection.addEventListener('toggle', () => {
+            localStorage.setItem('obsidian-preview-tags-open', tagSection.open ? 'true' : 'false');
+        });
+
+        // 高亮当前筛选的标签
+        function updateActiveTag(tag) {
+            document.querySelectorAll('#tagTree .tag-item').forEach(item => {
+                item.classList.toggle('current', item.dataset.tag === tag);
+            });
+        }
+
+        // 点击标签：在侧边栏中按标签筛选
+        function filterByTag(tag) {
+            toggleSidebar(false);
+            const searchBox = document.getElementById('searchBox');
+            searchBox.value = '#' + tag;
+            searchBox.dispatchEvent(new Event('input'));
+        }
+
+        function matchAlias(node, term) {
+            if (!node || !node.aliases) return null;
+            return node.aliases.find(alias => alias.toLowerCase().includes(term)) || null;
+        }
+
+        function setAliasHint(item, alias) {
+            let hint = item.querySelector('.tree-item-alias');
+            if (!alias) {
+                if (hint) hint.remove();
+                return;
+            }
+            if (!hint) {
+                hint = document.createElement('span');
+                hint.className = 'tree-item-alias';
+                item.querySelector('.tree-item-name').after(hint);
+            }
+            hint.textContent = '别名: ' + alias;
+        }
+
+        // 模糊匹配评分，不匹配时返回 null
+        // 子串匹配优先（越靠前、越接近完整名称得分越高），否则按子序列匹配，连续字符和单词开头加分
+        function fuzzyScore(text, term) {
+            if (!term) return 0;
+            const index = text.indexOf(term);
+            if (index !== -1) {
+                return 1000 - index * 2 - (text.length - term.length) * 0.1;
+            }
+            let score = 0;
+            let last = -1;
+            for (const ch of term) {
+                const pos = text.indexOf(ch, last + 1);
+                if (pos === -1) return null;
+                score += 10;
+                if (pos === last + 1) score += 15;
+                if (pos === 0 || ' -_/.'.includes(text[pos - 1])) score += 10;
+                score -= pos - last - 1;
+                last = pos;
+            }
+            return score;
+        }
+
+        // 笔记正文的纯文本（小写），首次全文搜索时从渲染结果中提取
+        let noteTexts = null;
+        function noteText(path) {
+            if (!noteTexts) {
+                noteTexts = new Map();
+                const parser = new DOMParser();
+                Object.keys(filesData).forEach(p => {
+                    const doc = parser.parseFromString(filesData[p], 'text/html');
+                    noteTexts.set(p, doc.body.textContent.toLowerCase());
+                });
+            }
+            return noteTexts.get(path) || '';
+        }
+
+        // 按得分列出最匹配的笔记，回车打开第一个
+        // 文件名和别名匹配在前，其次是正文包含关键词的笔记；索引类笔记（--index-marker）排在最后，且不参与正文匹配
+        let searchMatches = [];
+        function renderSearchResults(searchTerm) {
+            const section = document.getElementById('searchSection');
+            const list = document.getElementById('searchResults');
+            list.innerHTML = '';
+            searchMatches = [];
+            const tag = tagQuery(searchTerm);
+            if (searchTerm) {
+                nodeIndex.forEach((node, path) => {
+                    if (node.isDir) return;
+                    let score;
+                    let content = false;
+                    if (tag !== null) {
+                        score = hasTag(node, tag) ? 0 : null;
+                    } else {
+                        score = fuzzyScore(node.name.toLowerCase(), searchTerm);
+                        if (score === null && matchAlias(node, searchTerm)) {
+                            score = 500;
+                        }
+                        if (score === null && !node.index && searchTerm.length >= 2 && noteText(path).includes(searchTerm)) {
+                            score = 0;
+                            content = true;
+                        }
+                    }
+                    if (score !== null) {
+                        const tier = (node.index ? 2 : 0) + (content ? 1 : 0);
+                        searchMatches.push({ path, score, tier, content });
+                    }
+                });
+                searchMatches.sort((a, b) => a.tier - b.tier || b.score - a.score || (a.path < b.path ? -1 : 1));
+                searchMatches = searchMatches.slice(0, 10);
+            }
+            section.classList.toggle('hidden', searchMatches.length === 0);
+
+            searchMatches.forEach(({ path, content }) => {
+                const item = document.createElement('div');
+                item.className = 'tree-item file search-result';
+                item.title = path;
+
+                const icon = document.createElement('span');
+                icon.className = 'tree-item-icon';
+                icon.textContent = fileIcon(path);
+
+                const name = document.createElement('span');
+                name.className = 'tree-item-name';
+                name.textContent = noteDisplayName(path.split('/').pop());
+
+                item.appendChild(icon);
+                item.appendChild(name);
+                if (content) {
+                    const hint = document.createElement('span');
+                    hint.className = 'tree-item-alias';
+                    hint.textContent = '正文';
+                    item.appendChild(hint);
+                }
+                item.addEventListener('click', () => openNote(path));
+                list.appendChild(item);
+            });
+        }
+
+        document.getElementById('searchBox').addEventListener('keydown', (e) => {
+            if (e.key === 'Enter' && searchMatches.length > 0) {
+                openNote(searchMatches[0].path);
+            }
         });
 
         // 搜索功能
         document.getElementById('searchBox').addEventListener('input', (e) => {
             const searchTerm = e.target.value.toLowerCase();
-            const items = document.querySelectorAll('.tree-item');
+            const tag = tagQuery(searchTerm);
+            updateActiveTag(tag);
+
+            // 基于完整的树数据查找匹配项，先渲染出尚未展开的匹配节点
+            if (searchTerm) {
+                nodeIndex.forEach((node, path) => {
+                    const matched = tag !== null
+                        ? hasTag(node, tag)
+                        : fuzzyScore(node.name.toLowerCase(), searchTerm) !== null || matchAlias(node, searchTerm);
+                    if (matched) {
+                        revealTreePath(path);
+                    }
+                });
+            }
+            renderSearchResults(searchTerm);
+
+            const items = document.querySelectorAll('#fileTree .tree-item, #pinnedList .tree-item');
             
             items.forEach(item => {
-                const text = item.textContent.toLowerCase();
-                if (text.includes(searchTerm)) {
+                const text = item.querySelector('.tree-item-name').textContent.toLowerCase();
+                const node = nodeIndex.get(item.dataset.path);
+                const matched = tag !== null ? hasTag(node, tag) : fuzzyScore(text, searchTerm) !== null;
+                // 通过别名匹配时在文件名后显示命中的别名
+                const alias = searchTerm && tag === null && !matched ? matchAlias(node, searchTerm) : null;
+                setAliasHint(item, alias);
+                if (matched || alias) {
                     item.classList.remove('hidden');
                     let parent = item.parentElement;
                     while (parent && parent.classList.contains('tree-children')) {
@@ -1083,6 +8785,7 @@ func generateHTML(outputFile string) error {
                             if (expandIcon) {
                                 expandIcon.dataset.expanded = 'true';
                                 expandIcon.style.transform = 'rotate(90deg)';
+                                prevSibling.setAttribute('aria-expanded', 'true');
                             }
                         }
                         parent = parent.parentElement;
@@ -1093,31 +8796,269 @@ func generateHTML(outputFile string) error {
             });
         });
 
+        // 显示方式：tree 按文件夹层级显示，list 将所有笔记平铺为按路径排序的列表
+        let viewMode = localStorage.getItem('obsidian-preview-view') === 'list' ? 'list' : 'tree';
+        // 列表视图中没有文件夹，切换回树形视图时由 renderTree 按 expandedFolders 恢复展开状态
+        let listRendered = false;
+
+        // 将树展开为笔记列表，名称显示相对路径，排序和点击等行为与树中的笔记相同
+        function flattenNotes(nodes, notes = []) {
+            nodes.forEach(node => {
+                if (node.isDir) {
+                    flattenNotes(node.children || [], notes);
+                } else {
+                    // 列表视图中的笔记来自不同目录，.order 的位置没有意义
+                    notes.push(Object.assign({}, node, { name: node.path, order: 0 }));
+                }
+            });
+            return notes;
+        }
+
+        // 重新渲染树，保留展开和选中状态
+        function rerenderTree() {
+            const active = document.querySelector('#fileTree .tree-item.active');
+
+            treeContainer.innerHTML = '';
+            listRendered = viewMode === 'list';
+            document.querySelectorAll('.folder-action').forEach(button => {
+                button.disabled = listRendered;
+            });
+            if (listRendered) {
+                renderTree(flattenNotes(fileTreeData), treeContainer);
+            } else {
+                renderTree(fileTreeData, treeContainer);
+            }
+            if (active) {
+                selectTreeItem(active.dataset.path);
+            }
+            const searchBox = document.getElementById('searchBox');
+            if (searchBox.value) {
+                searchBox.dispatchEvent(new Event('input'));
+            }
+        }
+
+        // 排序切换
+        const sortSelect = document.getElementById('sortMode');
+        const foldersFirstBox = document.getElementById('foldersFirst');
+        sortSelect.value = sortMode;
+        foldersFirstBox.checked = foldersFirst;
+        sortSelect.addEventListener('change', () => {
+            sortMode = sortSelect.value;
+            localStorage.setItem('obsidian-preview-sort', sortMode);
+            rerenderTree();
+        });
+        foldersFirstBox.addEventListener('change', () => {
+            foldersFirst = foldersFirstBox.checked;
+            localStorage.setItem('obsidian-preview-folders-first', foldersFirst ? 'true' : 'false');
+            rerenderTree();
+        });
+
+        // 树形 / 列表视图切换
+        const viewSelect = document.getElementById('viewMode');
+        viewSelect.value = viewMode;
+        viewSelect.addEventListener('change', () => {
+            viewMode = viewSelect.value;
+            localStorage.setItem('obsidian-preview-view', viewMode);
+            rerenderTree();
+        });
+
+        // 文件树密度：通过 body 上的 tree-compact / tree-comfortable 类调整行距
+        const densitySelect = document.getElementById('treeDensity');
+        function applyDensity(density) {
+            document.body.classList.toggle('tree-compact', density === 'compact');
+            document.body.classList.toggle('tree-comfortable', density === 'comfortable');
+        }
+        densitySelect.value = localStorage.getItem('obsidian-preview-density') || 'normal';
+        applyDensity(densitySelect.value);
+        densitySelect.addEventListener('change', () => {
+            localStorage.setItem('obsidian-preview-density', densitySelect.value);
+            applyDensity(densitySelect.value);
+        });
+
+        // 配色方案：依次切换内置方案，选择保存在浏览器中
+        const themeNames = {{.Themes}};
+        const themeToggle = document.getElementById('themeToggle');
+        function updateThemeToggle() {
+            themeToggle.title = '切换配色方案（当前：' + document.documentElement.dataset.theme + '）';
+        }
+        updateThemeToggle();
+        themeToggle.addEventListener('click', () => {
+            const current = themeNames.indexOf(document.documentElement.dataset.theme);
+            const next = themeNames[(current + 1) % themeNames.length];
+            document.documentElement.dataset.theme = next;
+            localStorage.setItem('obsidian-preview-theme', next);
+            updateThemeToggle();
+            // 重新显示当前笔记，使 Mermaid 图表使用新的配色
+            if (currentPath) {
+                const scrollTop = document.querySelector('.content-body').scrollTop;
+                showFile(currentPath);
+                document.querySelector('.content-body').scrollTop = scrollTop;
+            }
+        });
+
         // 初始化
         const treeContainer = document.getElementById('fileTree');
-        renderTree(fileTreeData, treeContainer);
+        treeContainer.addEventListener('keydown', handleTreeKeydown);
+        rerenderTree();
+        renderPinned();
+        loadTreeState();
+
+        // 恢复刷新前打开的笔记和滚动位置
+        const noteParam = new URLSearchParams(location.search).get('note');
+        const reloadState = sessionStorage.getItem('obsidian-preview-reload');
+        if (reloadState) {
+            sessionStorage.removeItem('obsidian-preview-reload');
+            const state = JSON.parse(reloadState);
+            if (state.path && filesData[state.path]) {
+                openNote(state.path);
+                document.querySelector('.content-body').scrollTop = state.scrollTop || 0;
+            }
+        } else if (noteParam && filesData[noteParam]) {
+            // 从 /sitemap 等页面通过 ?note= 链接打开的笔记
+            openNote(noteParam);
+        } else if (openNotePath) {
+            // 启动参数指定的笔记，不存在时 showFile 会显示空状态
+            openNote(openNotePath);
+        } else if (indexFilePath && filesData[indexFilePath]) {
+            // 笔记库首页，不存在时保持空状态
+            openNote(indexFilePath);
+        }
+
+        // 导出的页面通过 service worker 缓存页面和图片，之后离线也能打开
+        if (exportMode && 'serviceWorker' in navigator) {
+            navigator.serviceWorker.register('sw.js').catch(err => console.warn('注册 service worker 失败', err));
+        }
+
+        // 文件变化时自动刷新
+        if (window.EventSource && !exportMode) {
+            const events = new EventSource(basePath + '/events');
+            events.onmessage = (e) => {
+                const event = JSON.parse(e.data);
+                // 编辑中不跟随切换笔记
+                const follow = followChanges && !editingPath && event.changed && event.changed !== currentPath ? event.changed : null;
+                if (event.type === 'update') {
+                    updateNotes(event.paths, follow);
+                } else if (event.type === 'reload') {
+                    if (editingPath) {
+                        reloadPending = true;
+                        return;
+                    }
+                    reloadPage(follow);
+                }
+            };
+        }
+
+        // 刷新页面，刷新后恢复打开的笔记（指定 follow 时为该笔记）和滚动位置
+        function reloadPage(follow) {
+            sessionStorage.setItem('obsidian-preview-reload', JSON.stringify({
+                path: follow || currentPath,
+                scrollTop: follow ? 0 : document.querySelector('.content-body').scrollTop
+            }));
+            location.reload();
+        }
+
+        // 只有笔记内容变化：取回这些笔记的渲染结果，当前笔记原地更新并保持滚动位置；
+        // 指定 follow 时改为打开该笔记
+        async function updateNotes(paths, follow) {
+            const results = await Promise.all(paths.map(async (path) => {
+                const response = await fetch(basePath + '/api/note?path=' + encodeURIComponent(path));
+                return response.ok ? [path, await response.json()] : null;
+            })).catch(() => null);
+            if (!results || results.includes(null)) {
+                location.reload();
+                return;
+            }
+            for (const [path, note] of results) {
+                filesData[path] = note.html;
+                const node = nodeIndex.get(path);
+                if (node) {
+                    node.size = note.size;
+                    node.modTime = note.modTime;
+                    node.words = note.words;
+                }
+            }
+            noteTexts = null;
+            if (follow) {
+                openNote(follow);
+                document.querySelector('.content-body').scrollTop = 0;
+            } else if (currentPath && paths.includes(currentPath)) {
+                const body = document.querySelector('.content-body');
+                const scrollTop = body.scrollTop;
+                showFile(currentPath);
+                body.scrollTop = scrollTop;
+            }
+        }
     </script>
 </body>
 </html>`
 
 	t, err := template.New("html").Parse(tmpl)
 	if err != nil {
-		return err
-	}
-
-	file, err := os.Create(outputFile)
-	if err != nil {
-		return err
+		return nil, err
 	}
-	defer file.Close()
 
 	data := struct {
 		TreeJSON  template.JS
 		FilesJSON template.JS
+		CodeFold  int
+		OpenNote  string
+		IndexFile string
+		TreeState bool
+		ThemeCSS  template.CSS
+		PageCSS   template.CSS
+		Theme     string
+		Themes    []string
+		BasePath  string
+		Export    bool
+		VaultName string
+		Sitemap   template.HTML
+		Follow    bool
+		HideExt   bool
+		NoteTypes map[string]string
+		Sort      string
+		SortField string
+		AllowEdit bool
+		TreeRoot  string
+		Banner    string
+
+		HeadingOffset int
+		MermaidScript string
+		KaTeXScript   string
+		KaTeXStyle    string
 	}{
 		TreeJSON:  template.JS(string(treeJSON)),
 		FilesJSON: template.JS(string(filesJSON)),
+		CodeFold:  config.CodeFold,
+		OpenNote:  resolveStartNote(config.OpenNote),
+		IndexFile: resolveStartNote(config.IndexFile),
+		TreeState: config.TreeState != "" && !export,
+		ThemeCSS:  template.CSS(themeCSS()),
+		PageCSS:   template.CSS(pageCSS),
+		Theme:     config.Theme,
+		Themes:    themeNames,
+		BasePath:  config.BasePath,
+		Export:    export,
+		VaultName: config.VaultName,
+		Sitemap:   template.HTML(sitemapHTML()),
+		Follow:    config.OpenBrowserOnChange && !export,
+		HideExt:   config.HideExtension,
+		NoteTypes: config.NoteTypes,
+		Sort:      strings.SplitN(config.Sort, ":", 2)[0],
+		SortField: sortField(),
+		AllowEdit: config.AllowEdit && !export,
+		TreeRoot:  treeRootLabel(),
+		Banner:    bannerText(),
+
+		HeadingOffset: config.HeadingOffset,
+		MermaidScript: mermaidScript(),
+	}
+	if config.Math {
+		data.KaTeXScript, data.KaTeXStyle = katexScriptURL, katexStyleURL
 	}
 
-	return t.Execute(file, data)
+	var page bytes.Buffer
+	if err := t.Execute(&page, data); err != nil {
+		return nil, err
+	}
+	return page.Bytes(), nil
 }
@@ -0,0 +1,709 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"golang.org/x/text/encoding/simplifiedchinese"
+	textunicode "golang.org/x/text/encoding/unicode"
+)
+
+// 在临时目录中建立笔记库并切换进去，files 的键为 / 分隔的路径，以 / 结尾表示空目录
+// 测试结束后恢复工作目录和配置
+func setupVault(t *testing.T, files map[string]string) {
+	t.Helper()
+	dir := t.TempDir()
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if strings.HasSuffix(name, "/") {
+			if err := os.MkdirAll(path, 0755); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	savedConfig, savedRoot := config, rootDir
+	t.Cleanup(func() {
+		os.Chdir(wd)
+		config, rootDir = savedConfig, savedRoot
+	})
+	rootDir = "."
+}
+
+// 递归收集文件树中的路径
+func treePaths(node *FileNode) []string {
+	var paths []string
+	for _, child := range node.Children {
+		paths = append(paths, child.Path)
+		paths = append(paths, treePaths(child)...)
+	}
+	return paths
+}
+
+func TestSlashPath(t *testing.T) {
+	tests := map[string]string{
+		filepath.Join("notes", "sub", "a.md"): "notes/sub/a.md",
+		filepath.Join(".", "a.md"):            "a.md",
+		"notes/b.md":                          "notes/b.md",
+	}
+	// \ 只在 Windows 上是路径分隔符，其他系统上是合法的文件名字符
+	if filepath.Separator == '\\' {
+		tests[`notes\sub\c.md`] = "notes/sub/c.md"
+	}
+	for in, want := range tests {
+		if got := slashPath(in); got != want {
+			t.Errorf("slashPath(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestScanDirectorySlashPaths(t *testing.T) {
+	setupVault(t, map[string]string{
+		"notes/sub/a.md":  "# A\n",
+		"notes/img/p.png": "png",
+		"b.md":            "# B\n",
+	})
+	if err := rescanDirectory(); err != nil {
+		t.Fatal(err)
+	}
+
+	paths := treePaths(fileTree)
+	want := []string{"notes", "notes/sub", "notes/sub/a.md", "b.md"}
+	if strings.Join(paths, ",") != strings.Join(want, ",") {
+		t.Errorf("文件树路径 = %q, want %q", paths, want)
+	}
+	if len(assetFiles) != 1 || assetFiles[0] != "notes/img/p.png" {
+		t.Errorf("附件路径 = %q, want [notes/img/p.png]", assetFiles)
+	}
+
+	// 以系统分隔符传入的目录，子项路径同样使用 /
+	node := &FileNode{IsDir: true}
+	if err := scanDirectory(filepath.Join("notes", "sub"), node); err != nil {
+		t.Fatal(err)
+	}
+	if len(node.Children) != 1 || node.Children[0].Path != "notes/sub/a.md" {
+		t.Errorf("子目录扫描结果 = %q, want [notes/sub/a.md]", treePaths(node))
+	}
+}
+
+func TestFixImagePathsBackslash(t *testing.T) {
+	setupVault(t, map[string]string{
+		"notes/sub/a.md":  "# A\n",
+		"notes/img/p.png": "png",
+	})
+	if err := rescanDirectory(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		src    string
+		mdFile string
+	}{
+		{`..\img\p.png`, filepath.Join("notes", "sub", "a.md")},
+		{`img\p.png`, filepath.Join("notes", "a.md")},
+		{`.\notes\img\p.png`, "a.md"},
+		{`notes\img\p.png`, "a.md"},
+	}
+	for _, tt := range tests {
+		html := fixImagePaths(`<img src="`+tt.src+`" alt="p">`, tt.mdFile)
+		if !strings.Contains(html, `src="notes/img/p.png?v=`) {
+			t.Errorf("fixImagePaths(%q, %q) = %s, want src notes/img/p.png", tt.src, tt.mdFile, html)
+		}
+		if strings.Contains(html, `\`) {
+			t.Errorf("fixImagePaths(%q, %q) 结果中仍有 \\: %s", tt.src, tt.mdFile, html)
+		}
+	}
+}
+
+func TestRenderWikiLinkImageSize(t *testing.T) {
+	setupVault(t, map[string]string{
+		"a.md":  "# A\n",
+		"p.png": "png",
+	})
+	if err := rescanDirectory(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		inner string
+		want  []string
+		not   []string
+	}{
+		{"p.png|300", []string{`width="300"`}, []string{"height="}},
+		{"p.png|300x200", []string{`width="300"`, `height="200"`}, nil},
+		{"p.png|x200", []string{`height="200"`}, []string{"width="}},
+		{"p.png|300x", []string{`width="300"`}, []string{"height="}},
+		{"p.png|x", nil, []string{"width=", "height="}},
+	}
+	for _, tt := range tests {
+		html := renderWikiLink(tt.inner, true, "a.md")
+		for _, w := range tt.want {
+			if !strings.Contains(html, w) {
+				t.Errorf("renderWikiLink(%q) = %s, want %s", tt.inner, html, w)
+			}
+		}
+		for _, n := range tt.not {
+			if strings.Contains(html, n) {
+				t.Errorf("renderWikiLink(%q) = %s, 不应包含 %s", tt.inner, html, n)
+			}
+		}
+	}
+}
+
+func TestScanDirectoryEmptyDirs(t *testing.T) {
+	files := map[string]string{
+		"notes/a.md":           "# A\n",
+		"notes/empty/":         "",
+		"outer/inner/":         "",
+		"deep/x/y/z/":          "",
+		"images/only/p.png":    "png",
+		"mixed/empty/":         "",
+		"mixed/notes/c.md":     "# C\n",
+		"mixed/notes/nothing/": "",
+	}
+
+	tests := []struct {
+		name          string
+		showEmptyDirs bool
+		want          []string
+	}{
+		{
+			name: "默认不显示",
+			want: []string{"mixed", "mixed/notes", "mixed/notes/c.md", "notes", "notes/a.md"},
+		},
+		{
+			name:          "--show-empty-dirs",
+			showEmptyDirs: true,
+			want: []string{
+				"deep", "deep/x", "deep/x/y", "deep/x/y/z",
+				"images", "images/only",
+				"mixed", "mixed/empty", "mixed/notes", "mixed/notes/nothing", "mixed/notes/c.md",
+				"notes", "notes/empty", "notes/a.md",
+				"outer", "outer/inner",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupVault(t, files)
+			config.ShowEmptyDirs = tt.showEmptyDirs
+			if err := rescanDirectory(); err != nil {
+				t.Fatal(err)
+			}
+			if got := treePaths(fileTree); strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("文件树路径 = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEmbeddedNoteMermaid(t *testing.T) {
+	setupVault(t, map[string]string{
+		"host.md":    "# Host\n\n```go\nfmt.Println(1)\n```\n\n![[diagram]]\n",
+		"diagram.md": "# Diagram\n\n```mermaid\ngraph TD\n  A-->B\n```\n",
+	})
+	if err := rescanDirectory(); err != nil {
+		t.Fatal(err)
+	}
+
+	html, err := renderMarkdownFile("host.md")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(html, `<div class="note-embed"`) {
+		t.Fatalf("笔记没有被嵌入: %s", html)
+	}
+	if !strings.Contains(html, "<div class=\"mermaid\">graph TD\n  A--&gt;B</div>") {
+		t.Errorf("嵌入笔记中的 mermaid 代码块没有转换为 <div class=\"mermaid\">: %s", html)
+	}
+	// 只有宿主笔记中的 go 代码块被高亮，mermaid 代码块不应留下 <pre>
+	if n := strings.Count(html, "<pre"); n != 1 || !strings.Contains(html, `<pre class="chroma"><code class="language-go">`) {
+		t.Errorf("应只有宿主笔记的 go 代码块输出 <pre>，实际 %d 个: %s", n, html)
+	}
+}
+
+func TestMermaidSanitize(t *testing.T) {
+	setupVault(t, map[string]string{
+		"a.md": "# A\n\n```mermaid\n<img src=x onerror=alert(1)>\n```\n",
+	})
+	config.Sanitize = true
+	if err := rescanDirectory(); err != nil {
+		t.Fatal(err)
+	}
+
+	html, err := renderMarkdownFile("a.md")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(html, "<img") {
+		t.Errorf("mermaid 代码块中的标签绕过了 --sanitize: %s", html)
+	}
+	if !strings.Contains(html, `<div class="mermaid">&lt;img src=x onerror=alert(1)&gt;</div>`) {
+		t.Errorf("mermaid 代码应保持转义: %s", html)
+	}
+}
+
+func TestHandleNoteConditional(t *testing.T) {
+	setupVault(t, map[string]string{"a.md": "# A\n"})
+	if err := rescanDirectory(); err != nil {
+		t.Fatal(err)
+	}
+	modTime := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	mu.Lock()
+	saved := renderedNotes
+	renderedNotes = map[string]*RenderedFile{"a.md": {HTML: "<h1>A</h1>", ModTime: modTime}}
+	mu.Unlock()
+	t.Cleanup(func() {
+		mu.Lock()
+		renderedNotes = saved
+		mu.Unlock()
+	})
+
+	get := func(header, value string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/api/note?path=a.md", nil)
+		if header != "" {
+			req.Header.Set(header, value)
+		}
+		w := httptest.NewRecorder()
+		handleNote(w, req)
+		return w
+	}
+
+	w := get("", "")
+	etag := w.Header().Get("ETag")
+	if w.Code != http.StatusOK || !strings.HasPrefix(etag, `W/"`) || w.Header().Get("Last-Modified") != modTime.Format(http.TimeFormat) {
+		t.Fatalf("首次请求: %d ETag=%q Last-Modified=%q", w.Code, etag, w.Header().Get("Last-Modified"))
+	}
+	if w := get("If-None-Match", etag); w.Code != http.StatusNotModified {
+		t.Errorf("If-None-Match 相同时应返回 304，实际 %d", w.Code)
+	}
+	if w := get("If-Modified-Since", modTime.Format(http.TimeFormat)); w.Code != http.StatusNotModified {
+		t.Errorf("If-Modified-Since 未变化时应返回 304，实际 %d", w.Code)
+	}
+
+	// 经过 gzip 压缩的响应使用相同的 ETag，压缩与否都能用它得到 304
+	config.Gzip = true
+	handler := withGzip(http.HandlerFunc(handleNote))
+	gzipGet := func(acceptEncoding, ifNoneMatch string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/api/note?path=a.md", nil)
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+		if ifNoneMatch != "" {
+			req.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+	gw := gzipGet("gzip", "")
+	if gw.Code != http.StatusOK || gw.Header().Get("Content-Encoding") != "gzip" || gw.Header().Get("ETag") != etag {
+		t.Errorf("gzip 响应: %d Content-Encoding=%q ETag=%q, want ETag %q", gw.Code, gw.Header().Get("Content-Encoding"), gw.Header().Get("ETag"), etag)
+	}
+	for _, encoding := range []string{"gzip", "identity"} {
+		if w := gzipGet(encoding, gw.Header().Get("ETag")); w.Code != http.StatusNotModified {
+			t.Errorf("Accept-Encoding: %s 时 If-None-Match 应返回 304，实际 %d", encoding, w.Code)
+		}
+	}
+
+	// 渲染结果变化（修改时间不变）后 ETag 随之改变
+	mu.Lock()
+	renderedNotes["a.md"] = &RenderedFile{HTML: "<h1>B</h1>", ModTime: modTime}
+	mu.Unlock()
+	if w := get("If-None-Match", etag); w.Code != http.StatusOK || w.Header().Get("ETag") == etag {
+		t.Errorf("渲染结果变化后应返回 200 和新的 ETag，实际 %d ETag=%q", w.Code, w.Header().Get("ETag"))
+	}
+}
+
+func TestDecodeText(t *testing.T) {
+	encode := func(enc interface{ Bytes([]byte) ([]byte, error) }, s string) []byte {
+		b, err := enc.Bytes([]byte(s))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	utf16le := textunicode.UTF16(textunicode.LittleEndian, textunicode.UseBOM).NewEncoder()
+	utf16be := textunicode.UTF16(textunicode.BigEndian, textunicode.UseBOM).NewEncoder()
+
+	tests := []struct {
+		name     string
+		input    []byte
+		want     string
+		encoding string
+	}{
+		{"UTF-8", []byte("# 笔记 café\n"), "# 笔记 café\n", ""},
+		{"UTF-8 BOM", append([]byte{0xEF, 0xBB, 0xBF}, "# 笔记\n"...), "# 笔记\n", ""},
+		{"Latin-1", []byte("# Caf\xe9 cr\xe8me br\xfbl\xe9e\n"), "# Café crème brûlée\n", "Windows-1252"},
+		{"Windows-1252 引号", []byte("\x93quoted\x94 \x80\n"), "\u201cquoted\u201d €\n", "Windows-1252"},
+		{"GB18030", encode(simplifiedchinese.GB18030.NewEncoder(), "# 中文笔记\n内容\n"), "# 中文笔记\n内容\n", "GB18030"},
+		{"UTF-16LE BOM", encode(utf16le, "# 笔记 😀\n"), "# 笔记 😀\n", "UTF-16LE"},
+		{"UTF-16BE BOM", encode(utf16be, "# 笔记 😀\n"), "# 笔记 😀\n", "UTF-16BE"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, encoding := decodeText(tt.input)
+			if string(got) != tt.want || encoding != tt.encoding {
+				t.Fatalf("decodeText = %q, %q, want %q, %q", got, encoding, tt.want, tt.encoding)
+			}
+			// 解码结果通过 /api/note 等接口以 JSON 返回，编码后不应出现替换字符
+			data, err := json.Marshal(string(got))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var back string
+			if err := json.Unmarshal(data, &back); err != nil {
+				t.Fatal(err)
+			}
+			if back != tt.want || strings.ContainsRune(back, '\uFFFD') {
+				t.Errorf("JSON 往返结果 = %q, want %q", back, tt.want)
+			}
+		})
+	}
+}
+
+func TestNonUTF8NotesInFilesData(t *testing.T) {
+	gbk, err := simplifiedchinese.GB18030.NewEncoder().Bytes([]byte("# 标题\n\n中文内容\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	setupVault(t, map[string]string{
+		"gbk.md":   string(gbk),
+		"latin.md": "# Caf\xe9\n\nna\xefve\n",
+	})
+	if err := rescanDirectory(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 与 renderPage 相同：渲染所有笔记后编码为页面中的 filesData
+	filesData := make(map[string]string)
+	for filePath, rf := range renderAllFiles() {
+		if rf.Error != "" {
+			t.Fatalf("%s 渲染失败: %s", filePath, rf.Error)
+		}
+		filesData[filePath] = rf.HTML
+	}
+	filesJSON, err := json.Marshal(filesData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !json.Valid(filesJSON) {
+		t.Fatalf("filesData 不是有效的 JSON: %s", filesJSON)
+	}
+	if strings.Contains(string(filesJSON), "\uFFFD") || strings.Contains(string(filesJSON), `\ufffd`) {
+		t.Errorf("filesData 中有 U+FFFD: %s", filesJSON)
+	}
+
+	var decoded map[string]string
+	if err := json.Unmarshal(filesJSON, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	for path, want := range map[string][]string{
+		"gbk.md":   {"标题", "中文内容"},
+		"latin.md": {"Café", "naïve"},
+	} {
+		for _, w := range want {
+			if !strings.Contains(decoded[path], w) {
+				t.Errorf("%s 的渲染结果中没有 %q: %s", path, w, decoded[path])
+			}
+		}
+	}
+}
+
+func TestEmbeddedNoteHeadingIDs(t *testing.T) {
+	setupVault(t, map[string]string{
+		"host.md":       "# Host\n\n## Intro\n\n![[Other Note]]\n\n![[Other Note#Details]]\n",
+		"Other Note.md": "## Intro\n\n[跳转](#details) [外部](#host)\n\n## Details\n\ntext\n",
+	})
+	if err := rescanDirectory(); err != nil {
+		t.Fatal(err)
+	}
+
+	html, err := renderMarkdownFile("host.md")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		`<h2 id="intro">Intro</h2>`,
+		`<h2 id="embed-Other-Note-intro">Intro</h2>`,
+		`<h2 id="embed-Other-Note-details">Details</h2>`,
+		`<a href="#embed-Other-Note-details">跳转</a>`,
+		`<a href="#host">外部</a>`,
+		`<h2 id="embed-Other-Note-2-details">Details</h2>`,
+		`data-heading="Details"`,
+	} {
+		if !strings.Contains(html, want) {
+			t.Errorf("渲染结果中缺少 %s: %s", want, html)
+		}
+	}
+	ids := idAttrPattern.FindAllStringSubmatch(html, -1)
+	seen := make(map[string]bool)
+	for _, id := range ids {
+		if seen[id[1]] {
+			t.Errorf("id %q 重复", id[1])
+		}
+		seen[id[1]] = true
+	}
+}
+
+func TestMathInCallouts(t *testing.T) {
+	setupVault(t, map[string]string{
+		"math.md": "# Math\n\n" +
+			"> [!note] 质能方程\n" +
+			"> 能量 $E=mc^2$，其中 $c$ 为光速。\n" +
+			"> $$\n" +
+			"> \\int_0^1 x^2\\,dx = [[a]] \\# b^2^\n" +
+			"> $$\n\n" +
+			"| 公式 | 说明 |\n|---|---|\n| $\\alpha_1$ | 表格 |\n\n" +
+			"价格为 $20 和 $30，`$code$` 不是公式。\n\n" +
+			"![[other]]\n",
+		"other.md": "$$ \\sum_i x_i $$\n",
+	})
+	config.Math = true
+	config.SubSup = true
+	if err := rescanDirectory(); err != nil {
+		t.Fatal(err)
+	}
+
+	html, err := renderMarkdownFile("math.md")
+	if err != nil {
+		t.Fatal(err)
+	}
+	callout := html[strings.Index(html, `<div class="callout"`):strings.Index(html, `<div class="table-wrapper">`)]
+	for _, want := range []string{
+		`<code class="language-math">E=mc^2</code>`,
+		`<code class="language-math">c</code>`,
+		"<pre><code class=\"language-math\">\\int_0^1 x^2\\,dx = [[a]] \\# b^2^\n</code></pre>",
+	} {
+		if !strings.Contains(callout, want) {
+			t.Errorf("callout 中缺少 %s: %s", want, callout)
+		}
+	}
+	for _, want := range []string{
+		`<td><code class="language-math">\alpha_1</code></td>`,
+		"价格为 $20 和 $30，<code>$code$</code> 不是公式。",
+		`<pre><code class="language-math"> \sum_i x_i </code></pre>`,
+	} {
+		if !strings.Contains(html, want) {
+			t.Errorf("渲染结果中缺少 %s: %s", want, html)
+		}
+	}
+
+	// 未启用时 $ 保持原样
+	config.Math = false
+	if html, err := renderMarkdownFile("math.md"); err != nil || strings.Contains(html, "language-math") {
+		t.Errorf("未启用 --math 时不应生成公式: %v %s", err, html)
+	}
+}
+
+func TestNewRequestIDFallback(t *testing.T) {
+	saved := randomBytes
+	t.Cleanup(func() { randomBytes = saved })
+
+	if id := newRequestID(); len(id) != 16 || !requestIDPattern.MatchString(id) {
+		t.Errorf("随机请求 ID = %q", id)
+	}
+
+	randomBytes = func([]byte) (int, error) { return 0, errors.New("no entropy") }
+	seen := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		id := newRequestID()
+		if !requestIDPattern.MatchString(id) || seen[id] {
+			t.Fatalf("随机数不可用时的请求 ID %q 无效或重复", id)
+		}
+		seen[id] = true
+	}
+}
+
+func TestMermaidCacheEviction(t *testing.T) {
+	t.Cleanup(func() {
+		mermaidCache.Init()
+		clear(mermaidCacheIndex)
+	})
+
+	mermaidCachePut("first", "<svg>0</svg>")
+	for i := 1; i < mermaidCacheSize; i++ {
+		mermaidCachePut(strconv.Itoa(i), "<svg></svg>")
+	}
+	// 访问后 first 成为最近使用，下一次淘汰的是 "1"
+	if _, ok := mermaidCacheGet("first"); !ok {
+		t.Fatal("first 应在缓存中")
+	}
+	mermaidCachePut("new", "<svg></svg>")
+
+	if mermaidCache.Len() != mermaidCacheSize || len(mermaidCacheIndex) != mermaidCacheSize {
+		t.Errorf("缓存大小 = %d/%d, want %d", mermaidCache.Len(), len(mermaidCacheIndex), mermaidCacheSize)
+	}
+	if _, ok := mermaidCacheGet("1"); ok {
+		t.Error("最久未使用的条目未被淘汰")
+	}
+	if svg, ok := mermaidCacheGet("first"); !ok || svg != "<svg>0</svg>" {
+		t.Errorf("mermaidCacheGet(first) = %q, %v", svg, ok)
+	}
+}
+
+func TestTreeStatePath(t *testing.T) {
+	cache := t.TempDir()
+	t.Setenv("XDG_CACHE_HOME", cache)
+	t.Setenv("HOME", cache)
+	want, err := os.UserCacheDir()
+	if err != nil {
+		t.Skip("没有用户缓存目录:", err)
+	}
+
+	got, err := treeStatePath("state.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != filepath.Join(want, "obsidian-preview", "state.json") {
+		t.Errorf("treeStatePath(state.json) = %s, want 位于 %s 中", got, want)
+	}
+	abs := filepath.Join(cache, "other", "state.json")
+	if got, _ := treeStatePath(abs); got != abs {
+		t.Errorf("treeStatePath(%s) = %s, 绝对路径应保持不变", abs, got)
+	}
+}
+
+func TestHandleStaticHiddenAndTreeState(t *testing.T) {
+	setupVault(t, map[string]string{
+		"a.png":              "png",
+		"state.json":         "{}",
+		".obsidian/app.json": "{}",
+		"notes/.draft.md":    "# Draft\n",
+	})
+	abs, err := filepath.Abs("state.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.TreeState = abs
+
+	tests := []struct {
+		path string
+		code int
+	}{
+		{"/a.png", http.StatusOK},
+		{"/state.json", http.StatusNotFound},
+		{"/.obsidian/app.json", http.StatusNotFound},
+		{"/notes/.draft.md", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		handleStatic(rec, httptest.NewRequest(http.MethodGet, tt.path, nil))
+		if rec.Code != tt.code {
+			t.Errorf("GET %s = %d, want %d", tt.path, rec.Code, tt.code)
+		}
+	}
+
+	for _, name := range []string{"state.json", "state.json.tmp"} {
+		if isWatchedFile(name) || !isTreeStateFile(name) {
+			t.Errorf("状态文件 %s 不应触发刷新", name)
+		}
+	}
+}
+
+func TestHandleRenderConcurrencyLimit(t *testing.T) {
+	setupVault(t, map[string]string{"a.md": "# A\n"})
+	if err := rescanDirectory(); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	savedReady := ready
+	ready = true
+	mu.Unlock()
+	t.Cleanup(func() {
+		mu.Lock()
+		ready = savedReady
+		mu.Unlock()
+	})
+
+	render := func() *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handleRender(rec, httptest.NewRequest(http.MethodPost, "/api/render", strings.NewReader("**b**")))
+		return rec
+	}
+
+	// 占满所有名额，模拟仍在后台进行的渲染
+	for i := 0; i < renderAPIConcurrency; i++ {
+		renderAPISlots <- struct{}{}
+	}
+	if rec := render(); rec.Code != http.StatusTooManyRequests {
+		t.Errorf("名额用完时 = %d, want %d", rec.Code, http.StatusTooManyRequests)
+	}
+	for i := 0; i < renderAPIConcurrency; i++ {
+		<-renderAPISlots
+	}
+
+	rec := render()
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "<strong>b</strong>") {
+		t.Errorf("render = %d %s", rec.Code, rec.Body.String())
+	}
+	if n := len(renderAPISlots); n != 0 {
+		t.Errorf("渲染结束后仍占用 %d 个名额", n)
+	}
+}
+
+func TestShouldRescan(t *testing.T) {
+	setupVault(t, map[string]string{
+		"a.md":          "# A\n",
+		"sub/b.md":      "# B\n",
+		".a.md.swp":     "swap",
+		"a.md.tmp":      "tmp",
+		".order":        "a.md\n",
+		"new/":          "",
+		".hidden-dir/":  "",
+		".draft.md.tmp": "tmp",
+	})
+	if err := rescanDirectory(); err != nil {
+		t.Fatal(err)
+	}
+	// 文件夹移走后只能从文件树中判断它是文件夹
+	if err := os.RemoveAll("sub"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		op   fsnotify.Op
+		want bool
+	}{
+		{"a.md", fsnotify.Write, true},
+		{"a.md", fsnotify.Create, true},
+		{".order", fsnotify.Write, true},
+		{"new", fsnotify.Create, true},
+		{"sub", fsnotify.Remove, true},
+		{"sub", fsnotify.Rename, true},
+		{".a.md.swp", fsnotify.Create, false},
+		{".a.md.swp", fsnotify.Remove, false},
+		{".draft.md.tmp", fsnotify.Rename, false},
+		{"a.md.tmp", fsnotify.Create, false},
+		{"a.md.tmp", fsnotify.Remove, false},
+		{".hidden-dir", fsnotify.Create, false},
+		{"gone.txt", fsnotify.Remove, false},
+	}
+	for _, tt := range tests {
+		if got := shouldRescan(fsnotify.Event{Name: tt.name, Op: tt.op}); got != tt.want {
+			t.Errorf("shouldRescan(%s %s) = %v, want %v", tt.op, tt.name, got, tt.want)
+		}
+	}
+}